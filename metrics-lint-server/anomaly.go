@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// AnomalyDetection configures the rolling statistics kept per pushed series
+// and when a value counts as anomalous. Gauge and untyped values are checked
+// as pushed; counters are checked by their increase since the previous push.
+type AnomalyDetection struct {
+	// Metrics lists globs of the metric names to check. Defaults to all.
+	Metrics []string `yaml:"metrics"`
+	// Alpha is the EWMA smoothing factor. Defaults to 0.1.
+	Alpha float64 `yaml:"alpha"`
+	// Window is the number of recent values the median and MAD are
+	// computed over. Defaults to 60.
+	Window int `yaml:"window"`
+	// MinSamples is the number of values a series needs before it is
+	// checked. Defaults to 10.
+	MinSamples int `yaml:"min_samples"`
+	// EWMAThreshold is the largest accepted distance from the EWMA mean
+	// in EWMA standard deviations. Defaults to 6; negative disables it.
+	EWMAThreshold float64 `yaml:"ewma_threshold"`
+	// MADThreshold is the largest accepted distance from the median in
+	// scaled MADs. Defaults to 8; negative disables it.
+	MADThreshold float64 `yaml:"mad_threshold"`
+	// Action is "warn" (default) to flag anomalies or "reject" to refuse
+	// pushes containing them.
+	Action string `yaml:"action"`
+	// MaxSeries bounds the series statistics are kept for. When it is
+	// reached, the least recently pushed tenth is forgotten. Defaults to
+	// 100000.
+	MaxSeries int `yaml:"max_series"`
+}
+
+// AnomalyReport lists recent anomalies, the latest first.
+type AnomalyReport struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+// Anomaly is a pushed value that deviated from its series' statistics.
+type Anomaly struct {
+	Time        time.Time `json:"time"`
+	GroupingKey string    `json:"grouping_key"`
+	Metric      string    `json:"metric"`
+	Labels      string    `json:"labels"`
+	// Value is the pushed value, or the increase for counters.
+	Value     float64 `json:"value"`
+	Mean      float64 `json:"ewma_mean"`
+	StdDev    float64 `json:"ewma_stddev"`
+	Median    float64 `json:"median"`
+	MAD       float64 `json:"mad"`
+	EWMAScore float64 `json:"ewma_score,omitempty"`
+	MADScore  float64 `json:"mad_score,omitempty"`
+	// Action is "flagged" or "rejected".
+	Action string `json:"action"`
+}
+
+// madScale makes the MAD of normally distributed values comparable to their
+// standard deviation, as meanADScale does for the mean absolute deviation.
+const (
+	madScale    = 1.4826
+	meanADScale = 1.2533
+)
+
+// A spread is at least minRelativeSpread of the baseline's magnitude and at
+// least minSpread, so a series that has been constant is scored against 1%
+// of its value instead of being skipped, and scores stay finite.
+const (
+	minRelativeSpread = 0.01
+	minSpread         = 1e-9
+)
+
+// maxAnomalies bounds the anomalies kept for the report.
+const maxAnomalies = 500
+
+type seriesStats struct {
+	n        int
+	mean     float64
+	variance float64
+	window   []float64
+	// last is the previous counter value, increases are computed from.
+	last    float64
+	hasLast bool
+	// streak holds the values of consecutive anomalies.
+	streak []float64
+	// seen is when the series was last pushed.
+	seen time.Time
+}
+
+func (s *seriesStats) add(x, alpha float64, window int) {
+	if s.n == 0 {
+		s.mean = x
+	} else {
+		diff := x - s.mean
+		incr := alpha * diff
+		s.mean += incr
+		s.variance = (1 - alpha) * (s.variance + diff*incr)
+	}
+	s.n++
+	s.window = append(s.window, x)
+	if len(s.window) > window {
+		s.window = s.window[len(s.window)-window:]
+	}
+}
+
+// medianMAD returns the median of the window, the median absolute deviation
+// from it and the mean absolute deviation from it.
+func (s *seriesStats) medianMAD() (med, mad, meanAD float64) {
+	values := append([]float64(nil), s.window...)
+	med = median(values)
+	for i, v := range values {
+		values[i] = math.Abs(v - med)
+		meanAD += values[i]
+	}
+	return med, median(values), meanAD / float64(len(values))
+}
+
+// spreadFloor returns spread raised to the minimum spread around center.
+func spreadFloor(spread, center float64) float64 {
+	return math.Max(spread, math.Max(minRelativeSpread*math.Abs(center), minSpread))
+}
+
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// anomalyObservation is a value of a pushed series, recorded once the push
+// is accepted.
+type anomalyObservation struct {
+	key       string
+	time      time.Time
+	value     float64
+	hasValue  bool
+	counter   float64
+	isCounter bool
+	anomaly   bool
+}
+
+// anomalyDetector keeps rolling statistics per series of accepted pushes.
+type anomalyDetector struct {
+	cfg    *AnomalyDetection
+	mu     sync.Mutex
+	series map[string]*seriesStats
+	recent []Anomaly
+}
+
+func newAnomalyDetector(cfg *AnomalyDetection) (*anomalyDetector, error) {
+	d := &anomalyDetector{series: map[string]*seriesStats{}}
+	if cfg == nil {
+		return d, nil
+	}
+	c := *cfg
+	cfg, d.cfg = &c, &c
+	for _, glob := range cfg.Metrics {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("anomaly detection: invalid metric glob %q", glob)
+		}
+	}
+	if cfg.Alpha == 0 {
+		cfg.Alpha = 0.1
+	}
+	if cfg.Alpha < 0 || cfg.Alpha > 1 {
+		return nil, fmt.Errorf("anomaly detection: alpha must be between 0 and 1")
+	}
+	if cfg.Window == 0 {
+		cfg.Window = 60
+	}
+	if cfg.MinSamples == 0 {
+		cfg.MinSamples = 10
+	}
+	if cfg.MaxSeries == 0 {
+		cfg.MaxSeries = 100000
+	}
+	if cfg.Window < 0 || cfg.MinSamples < 0 || cfg.MaxSeries < 0 {
+		return nil, fmt.Errorf("anomaly detection: window, min_samples and max_series must be positive")
+	}
+	if cfg.EWMAThreshold == 0 {
+		cfg.EWMAThreshold = 6
+	}
+	if cfg.MADThreshold == 0 {
+		cfg.MADThreshold = 8
+	}
+	switch cfg.Action {
+	case "":
+		cfg.Action = "warn"
+	case "warn", "reject":
+	default:
+		return nil, fmt.Errorf("anomaly detection: unknown action %q, expected warn or reject", cfg.Action)
+	}
+	return d, nil
+}
+
+// Action returns the effective action for anomalies: reject, or warn if the
+// detector only warns or enforce is not set.
+func (d *anomalyDetector) Action(enforce bool) string {
+	if d.cfg == nil || !enforce {
+		return "warn"
+	}
+	return d.cfg.Action
+}
+
+func (d *anomalyDetector) checked(name string) bool {
+	if len(d.cfg.Metrics) == 0 {
+		return true
+	}
+	for _, glob := range d.cfg.Metrics {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check scores the gauge, untyped and counter values of a push against their
+// series' statistics without updating them. It returns the observations to
+// pass to Observe once the push is accepted and the anomalies found, which
+// are also kept for the report. Anomalies are only rejected if enforce is
+// set, so clients a canary rollout does not enforce rejection for are only
+// warned.
+func (d *anomalyDetector) Check(groupLabels model.LabelSet, families []*dto.MetricFamily, now time.Time, enforce bool) ([]anomalyObservation, []Anomaly) {
+	if d.cfg == nil {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	action := "flagged"
+	if d.Action(enforce) == "reject" {
+		action = "rejected"
+	}
+	group := groupLabels.String()
+	var observations []anomalyObservation
+	var anomalies []Anomaly
+	for _, mf := range families {
+		if !d.checked(mf.GetName()) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			obs := anomalyObservation{key: group + "\xfe" + mf.GetName() + "\xfe" + lint.SeriesKey(m), time: now}
+			s := d.series[obs.key]
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				obs.value, obs.hasValue = m.GetGauge().GetValue(), true
+			case dto.MetricType_UNTYPED:
+				obs.value, obs.hasValue = m.GetUntyped().GetValue(), true
+			case dto.MetricType_COUNTER:
+				obs.counter, obs.isCounter = m.GetCounter().GetValue(), true
+				// A decrease is a counter reset and has no increase.
+				if s != nil && s.hasLast && obs.counter >= s.last {
+					obs.value, obs.hasValue = obs.counter-s.last, true
+				}
+			default:
+				continue
+			}
+			if math.IsNaN(obs.value) || math.IsInf(obs.value, 0) {
+				obs.hasValue = false
+			}
+			if obs.hasValue && s != nil {
+				if a, ok := d.score(s, obs.value); ok {
+					obs.anomaly = true
+					a.Time, a.GroupingKey, a.Metric, a.Labels, a.Action = now, group, mf.GetName(), lint.LabelPairsString(m.GetLabel()), action
+					anomalies = append(anomalies, a)
+				}
+			}
+			observations = append(observations, obs)
+		}
+	}
+	d.recent = append(d.recent, anomalies...)
+	if len(d.recent) > maxAnomalies {
+		d.recent = d.recent[len(d.recent)-maxAnomalies:]
+	}
+	return observations, anomalies
+}
+
+// score reports whether x deviates from the statistics beyond a threshold.
+// Spreads are floored by spreadFloor, so a series that has been constant is
+// flagged on any change. When more than half the window holds one value, the
+// MAD is 0 and the mean absolute deviation stands in for it.
+func (d *anomalyDetector) score(s *seriesStats, x float64) (Anomaly, bool) {
+	if s.n < d.cfg.MinSamples {
+		return Anomaly{}, false
+	}
+	a := Anomaly{Value: x, Mean: s.mean, StdDev: math.Sqrt(s.variance)}
+	var meanAD float64
+	a.Median, a.MAD, meanAD = s.medianMAD()
+
+	a.EWMAScore = math.Abs(x-a.Mean) / spreadFloor(a.StdDev, a.Mean)
+	spread := madScale * a.MAD
+	if a.MAD == 0 {
+		spread = meanADScale * meanAD
+	}
+	a.MADScore = math.Abs(x-a.Median) / spreadFloor(spread, a.Median)
+
+	anomalous := d.cfg.EWMAThreshold > 0 && a.EWMAScore > d.cfg.EWMAThreshold ||
+		d.cfg.MADThreshold > 0 && a.MADScore > d.cfg.MADThreshold
+	return a, anomalous
+}
+
+// Observe folds the observations of an accepted push into the statistics.
+// Anomalous values are left out so a single bad push does not skew them,
+// unless a series is anomalous MinSamples times in a row: it is then taken
+// to have moved to a new level and its statistics start over from the
+// anomalous values.
+func (d *anomalyDetector) Observe(observations []anomalyObservation) {
+	d.observe(observations, true)
+}
+
+// ObserveRejected counts the anomalies of a push refused for them towards
+// their series' streaks, so a series that moved to a new level is taken to
+// have done so even though its pushes are refused until then. Nothing else
+// of the push is recorded.
+func (d *anomalyDetector) ObserveRejected(observations []anomalyObservation) {
+	d.observe(observations, false)
+}
+
+func (d *anomalyDetector) observe(observations []anomalyObservation, accepted bool) {
+	if d.cfg == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, obs := range observations {
+		if !accepted && !obs.anomaly {
+			continue
+		}
+		s, ok := d.series[obs.key]
+		if !ok {
+			if len(d.series) >= d.cfg.MaxSeries {
+				d.forgetOldestSeries()
+			}
+			s = &seriesStats{}
+			d.series[obs.key] = s
+		}
+		s.seen = obs.time
+		if accepted && obs.isCounter {
+			s.last, s.hasLast = obs.counter, true
+		}
+		if !obs.hasValue {
+			continue
+		}
+		if obs.anomaly {
+			if s.streak = append(s.streak, obs.value); len(s.streak) < d.cfg.MinSamples {
+				continue
+			}
+			streak := s.streak
+			*s = seriesStats{last: s.last, hasLast: s.hasLast, seen: s.seen}
+			for _, v := range streak {
+				s.add(v, d.cfg.Alpha, d.cfg.Window)
+			}
+			continue
+		}
+		s.streak = nil
+		s.add(obs.value, d.cfg.Alpha, d.cfg.Window)
+	}
+}
+
+// forgetOldestSeries drops the least recently pushed tenth of the series, so
+// the cost of finding them is shared by the series added until the next
+// time the bound is reached.
+func (d *anomalyDetector) forgetOldestSeries() {
+	keys := make([]string, 0, len(d.series))
+	for k := range d.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.series[keys[i]].seen.Before(d.series[keys[j]].seen) })
+	for _, k := range keys[:len(keys)/10+1] {
+		delete(d.series, k)
+	}
+}
+
+// Rejects reports whether anomalies make the push fail.
+func (d *anomalyDetector) Rejects(anomalies []Anomaly) bool {
+	return len(anomalies) > 0 && anomalies[0].Action == "rejected"
+}
+
+// anomalyProblems returns lint problems for flagged anomalies.
+func anomalyProblems(anomalies []Anomaly) []lint.ProblemDetails {
+	var problems []lint.ProblemDetails
+	for _, a := range anomalies {
+		problems = append(problems, lint.ProblemDetails{
+			Metric: a.Metric,
+			Text:   fmt.Sprintf("value %g of %s is anomalous (EWMA mean %g, median %g)", a.Value, a.Labels, a.Mean, a.Median),
+			Code:   ruleAnomalies,
+		})
+	}
+	return problems
+}
+
+// Recent returns the kept anomalies, the latest first.
+func (d *anomalyDetector) Recent() []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recent := make([]Anomaly, len(d.recent))
+	for i, a := range d.recent {
+		recent[len(d.recent)-1-i] = a
+	}
+	return recent
+}
+
+// handleAnomalies lists recent anomalies; ?metric= limits the list to one
+// metric.
+func handleAnomalies(detector *anomalyDetector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed. Use GET.", http.StatusMethodNotAllowed)
+			return
+		}
+		if detector.cfg == nil {
+			writeJSON(w, http.StatusNotFound, AnomalyReport{Status: "error", Message: "Anomaly detection is not configured.", Anomalies: []Anomaly{}})
+			return
+		}
+
+		anomalies := detector.Recent()
+		if metric := r.URL.Query().Get("metric"); metric != "" {
+			filtered := anomalies[:0]
+			for _, a := range anomalies {
+				if a.Metric == metric {
+					filtered = append(filtered, a)
+				}
+			}
+			anomalies = filtered
+		}
+
+		report := AnomalyReport{Status: "success", Message: "No anomalies detected.", Anomalies: anomalies}
+		if len(anomalies) > 0 {
+			report.Status = "warning"
+			report.Message = fmt.Sprintf("%d anomalous values detected", len(anomalies))
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// pushAnomalyValues checks and records each value as the push proxy does
+// and returns one character per push: - for accepted without anomalies, f
+// for flagged and r for rejected.
+func pushAnomalyValues(t *testing.T, d *anomalyDetector, groupLabels model.LabelSet, typ string, values []float64, enforce bool) string {
+	t.Helper()
+	var b strings.Builder
+	now := time.Unix(1700000000, 0)
+	for i, v := range values {
+		families := parseFamilies(t, fmt.Sprintf("# TYPE value_%s %s\nvalue_%s %g\n", typ, typ, typ, v))
+		observations, anomalies := d.Check(groupLabels, families, now.Add(time.Duration(i)*time.Minute), enforce)
+		switch {
+		case d.Rejects(anomalies):
+			d.ObserveRejected(observations)
+			b.WriteByte('r')
+		case len(anomalies) > 0:
+			d.Observe(observations)
+			b.WriteByte('f')
+		default:
+			d.Observe(observations)
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+func TestAnomalyDetection(t *testing.T) {
+	baseline := []float64{10, 11, 9, 10, 12}
+	tests := []struct {
+		name    string
+		action  string
+		enforce bool
+		typ     string
+		values  []float64
+		want    string
+	}{
+		{name: "flagged outlier", action: "warn", values: []float64{100, 10}, want: "-----f-"},
+		{name: "rejected outlier", action: "reject", enforce: true, values: []float64{100, 10}, want: "-----r-"},
+		{name: "reject not enforced for the client", action: "reject", values: []float64{100, 10}, want: "-----f-"},
+		{name: "outliers do not skew the statistics", action: "warn", values: []float64{100, 10, 100, 100, 10, 100}, want: "-----f-ff-f"},
+		{name: "new level after flagged streak", action: "warn", values: []float64{100, 100, 100, 100, 101}, want: "-----fff--"},
+		{name: "new level after rejected streak", action: "reject", enforce: true, values: []float64{100, 100, 100, 100, 101}, want: "-----rrr--"},
+		{name: "leaving a constant new level", action: "reject", enforce: true, values: []float64{100, 100, 100, 10}, want: "-----rrrr"},
+		{name: "counters are checked by their increase", action: "warn", typ: "counter", values: []float64{20, 31, 40, 50, 62, 1000, 1010}, want: "------f-"},
+		{name: "counter resets are not anomalies", action: "warn", typ: "counter", values: []float64{20, 31, 40, 50, 62, 5, 15}, want: "--------"},
+	}
+	groupLabels := model.LabelSet{"job": "batch"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newAnomalyDetector(&AnomalyDetection{MinSamples: 3, Action: tt.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+			typ, values := tt.typ, tt.values
+			if typ == "" {
+				typ, values = "gauge", append(append([]float64(nil), baseline...), values...)
+			} else {
+				values = append([]float64{10}, values...)
+			}
+			if got := pushAnomalyValues(t, d, groupLabels, typ, values, tt.enforce); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnomalyDetectionLowSpread(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    string
+		values []float64
+		want   string
+	}{
+		{name: "constant gauge then spike", typ: "gauge", values: []float64{5, 5, 5, 5, 5, 1e18, 5}, want: "-----f-"},
+		{name: "constant gauge then a 10% change", typ: "gauge", values: []float64{5, 5, 5, 5, 5, 5.5}, want: "-----f"},
+		{name: "change within the relative floor", typ: "gauge", values: []float64{5000, 5000, 5000, 5000, 5010}, want: "-----"},
+		{name: "constant zero then change", typ: "gauge", values: []float64{0, 0, 0, 0, 1}, want: "----f"},
+		{name: "constant gauge", typ: "gauge", values: []float64{7, 7, 7, 7, 7, 7}, want: "------"},
+		{name: "mostly constant gauge", typ: "gauge", values: []float64{0, 0, 1, 0, 0, 1, 0, 1, 0}, want: "---------"},
+		{name: "constant counter increase then jump", typ: "counter", values: []float64{10, 20, 30, 40, 50, 60, 1e18}, want: "------f"},
+	}
+	groupLabels := model.LabelSet{"job": "batch"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newAnomalyDetector(&AnomalyDetection{MinSamples: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pushAnomalyValues(t, d, groupLabels, tt.typ, tt.values, false); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnomalyDetectorBoundsSeries(t *testing.T) {
+	d, err := newAnomalyDetector(&AnomalyDetection{MaxSeries: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := parseFamilies(t, "# TYPE queue_size gauge\nqueue_size 1\n")
+	for i := 0; i < 50; i++ {
+		groupLabels := model.LabelSet{"job": model.LabelValue(fmt.Sprintf("job-%02d", i))}
+		observations, _ := d.Check(groupLabels, families, time.Unix(int64(i), 0), false)
+		d.Observe(observations)
+	}
+	if len(d.series) > 20 {
+		t.Errorf("%d series kept, want at most 20", len(d.series))
+	}
+	for _, job := range []string{"job-00", "job-49"} {
+		_, ok := d.series[model.LabelSet{"job": model.LabelValue(job)}.String()+"\xfequeue_size\xfe"]
+		if want := job == "job-49"; ok != want {
+			t.Errorf("series of %s kept = %v, want %v", job, ok, want)
+		}
+	}
+}
+
+func TestNewAnomalyDetectorErrors(t *testing.T) {
+	tests := []struct {
+		cfg  AnomalyDetection
+		want string
+	}{
+		{AnomalyDetection{Alpha: 2}, "alpha must be between 0 and 1"},
+		{AnomalyDetection{MaxSeries: -1}, "must be positive"},
+		{AnomalyDetection{Action: "drop"}, "unknown action"},
+		{AnomalyDetection{Metrics: []string{"["}}, "invalid metric glob"},
+	}
+	for _, tt := range tests {
+		if _, err := newAnomalyDetector(&tt.cfg); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("newAnomalyDetector(%+v) error %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+}
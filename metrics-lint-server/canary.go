@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// Enforcing rules that can be rolled out to a percentage of clients.
+const (
+	ruleUntypedMetrics   = lint.RuleUntypedMetrics
+	ruleUTF8Names        = lint.RuleUTF8Names
+	ruleHistogramLayouts = "histogram_layouts"
+	ruleDeprecations     = lint.RuleDeprecations
+	ruleAnomalies        = "anomaly_detection"
+)
+
+var canaryRules = []string{ruleUntypedMetrics, ruleUTF8Names, ruleHistogramLayouts, ruleDeprecations, ruleAnomalies}
+
+// Canary rolls enforcing rules out to a stable slice of clients. Clients
+// outside the slice only get warnings, as if the rule were in warn mode.
+type Canary struct {
+	// IdentityLabel is the label identifying a client, such as userid or
+	// instance. It is read from the grouping key or, if the key does not
+	// have it, from the pushed series. Pushes without it are never
+	// enforced.
+	IdentityLabel string `yaml:"identity_label"`
+	// Rules maps rule names to the percentage of clients they are
+	// enforced for. Rules not listed here or in a profile are enforced
+	// for all clients.
+	Rules map[string]float64 `yaml:"rules"`
+	// Profiles are named sets of rules rolled out together.
+	Profiles map[string]CanaryProfile `yaml:"profiles"`
+}
+
+// CanaryProfile rolls several rules out to the same clients.
+type CanaryProfile struct {
+	// Percent is the percentage of clients the rules are enforced for.
+	Percent float64 `yaml:"percent"`
+	// Rules lists the rules of the profile. A rule belongs to at most
+	// one profile and is then not listed under the canary's rules.
+	Rules []string `yaml:"rules"`
+}
+
+// canaryRollout assigns clients to cohorts per rule and counts pushes and
+// rule hits by cohort.
+type canaryRollout struct {
+	label   model.LabelName
+	percent map[string]float64
+	// rollout names the rollout a rule is part of: the rule itself or its
+	// profile.
+	rollout map[string]string
+	pushes  *prometheus.CounterVec
+	hits    *prometheus.CounterVec
+}
+
+func newCanaryRollout(cfg Canary) (*canaryRollout, error) {
+	c := &canaryRollout{
+		label:   model.LabelName(cfg.IdentityLabel),
+		percent: map[string]float64{},
+		rollout: map[string]string{},
+		pushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metriclint_canary_pushes_total",
+			Help: "Pushes checked by a rule in canary rollout, by cohort.",
+		}, []string{"rule", "cohort"}),
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metriclint_canary_rule_hits_total",
+			Help: "Pushes a rule in canary rollout matched, enforced in the canary cohort and only warned in the control cohort.",
+		}, []string{"rule", "cohort"}),
+	}
+	if len(cfg.Rules) == 0 && len(cfg.Profiles) == 0 {
+		return c, nil
+	}
+	if !c.label.IsValid() {
+		return nil, fmt.Errorf("canary: invalid identity_label %q", cfg.IdentityLabel)
+	}
+	known := map[string]bool{}
+	for _, rule := range canaryRules {
+		known[rule] = true
+	}
+	for rule, percent := range cfg.Rules {
+		if !known[rule] {
+			return nil, fmt.Errorf("canary: unknown rule %q, expected one of %v", rule, canaryRules)
+		}
+		if percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("canary: percentage of %s must be between 0 and 100", rule)
+		}
+		c.percent[rule] = percent
+		c.rollout[rule] = rule
+	}
+
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	profileOf := map[string]string{}
+	for _, name := range names {
+		profile := cfg.Profiles[name]
+		if profile.Percent < 0 || profile.Percent > 100 {
+			return nil, fmt.Errorf("canary: percentage of profile %s must be between 0 and 100", name)
+		}
+		if len(profile.Rules) == 0 {
+			return nil, fmt.Errorf("canary: profile %s has no rules", name)
+		}
+		for _, rule := range profile.Rules {
+			switch {
+			case !known[rule]:
+				return nil, fmt.Errorf("canary: profile %s: unknown rule %q, expected one of %v", name, rule, canaryRules)
+			case profileOf[rule] != "":
+				return nil, fmt.Errorf("canary: rule %s is in profiles %s and %s", rule, profileOf[rule], name)
+			}
+			if _, ok := cfg.Rules[rule]; ok {
+				return nil, fmt.Errorf("canary: rule %s is in profile %s and has its own percentage", rule, name)
+			}
+			profileOf[rule] = name
+			c.percent[rule] = profile.Percent
+			c.rollout[rule] = profileRollout(name)
+		}
+	}
+	return c, nil
+}
+
+// profileRollout is the rollout name of a profile, kept apart from the rule
+// names.
+func profileRollout(profile string) string {
+	return "profile/" + profile
+}
+
+// identityBucket maps an identity to [0, 100) by hashing, so a client keeps
+// its position as percentages grow and stays enforced once it is. The
+// rollout name is hashed too, so rules and profiles at the same percentage
+// are enforced for different clients instead of all for the same ones.
+func identityBucket(rollout, identity string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(rollout))
+	h.Write([]byte{0xff})
+	h.Write([]byte(identity))
+	// FNV spreads similar identities poorly over the low bits, so the
+	// hash is mixed like MurmurHash3 finalizes it.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return float64(x%10000) / 100
+}
+
+// canaryAssignment is the cohort of one push for every rule in rollout.
+type canaryAssignment struct {
+	rollout *canaryRollout
+	cohorts map[string]string
+}
+
+// Assign places the pushing client in the canary or control cohort of every
+// rule in rollout.
+func (c *canaryRollout) Assign(groupLabels model.LabelSet, families []*dto.MetricFamily) *canaryAssignment {
+	a := &canaryAssignment{rollout: c, cohorts: map[string]string{}}
+	if len(c.percent) == 0 {
+		return a
+	}
+	identities := c.identities(groupLabels, families)
+	for rule, percent := range c.percent {
+		a.cohorts[rule] = "control"
+		for _, identity := range identities {
+			if identityBucket(c.rollout[rule], identity) < percent {
+				a.cohorts[rule] = "canary"
+				break
+			}
+		}
+	}
+	return a
+}
+
+// identities returns the identities of the pushing client. The identity label
+// of the grouping key identifies it; without one the series' identity labels
+// do. A push whose series carry several identities is in the canary cohort
+// of a rule if any of them is, so a rule enforced for any of its clients is
+// enforced for the push.
+func (c *canaryRollout) identities(groupLabels model.LabelSet, families []*dto.MetricFamily) []string {
+	if identity := groupLabels[c.label]; identity != "" {
+		return []string{string(identity)}
+	}
+	var identities []string
+	seen := map[string]bool{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				identity := lp.GetValue()
+				if lp.GetName() != string(c.label) || identity == "" || seen[identity] {
+					continue
+				}
+				seen[identity] = true
+				identities = append(identities, identity)
+			}
+		}
+	}
+	return identities
+}
+
+// Enforced reports whether the rule is enforced for the push.
+func (a *canaryAssignment) Enforced(rule string) bool {
+	cohort, ok := a.cohorts[rule]
+	return !ok || cohort == "canary"
+}
+
+// Record counts the push for a rule in rollout and whether the rule matched.
+func (a *canaryAssignment) Record(rule string, hit bool) {
+	cohort, ok := a.cohorts[rule]
+	if !ok {
+		return
+	}
+	a.rollout.pushes.WithLabelValues(rule, cohort).Inc()
+	if hit {
+		a.rollout.hits.WithLabelValues(rule, cohort).Inc()
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *canaryRollout) Describe(ch chan<- *prometheus.Desc) {
+	c.pushes.Describe(ch)
+	c.hits.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *canaryRollout) Collect(ch chan<- prometheus.Metric) {
+	c.pushes.Collect(ch)
+	c.hits.Collect(ch)
+}
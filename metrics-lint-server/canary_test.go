@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestIdentityBucket(t *testing.T) {
+	below := map[float64]int{}
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		b := identityBucket(ruleDeprecations, id)
+		if b < 0 || b >= 100 {
+			t.Fatalf("bucket of %s is %v, want [0, 100)", id, b)
+		}
+		if identityBucket(ruleDeprecations, id) != b {
+			t.Fatalf("bucket of %s is not stable", id)
+		}
+		for _, percent := range []float64{1, 10, 50} {
+			if b < percent {
+				below[percent]++
+			}
+		}
+	}
+	for percent, n := range below {
+		if got := float64(n) / 100; got < percent*0.8 || got > percent*1.2 {
+			t.Errorf("%.1f%% of identities below %v, want about %v%%", got, percent, percent)
+		}
+	}
+}
+
+func TestIdentityBucketIndependentRollouts(t *testing.T) {
+	// Two rollouts at 10% should share about 1% of the clients, not all of
+	// them.
+	both := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		if identityBucket(ruleDeprecations, id) < 10 && identityBucket(profileRollout("strict"), id) < 10 {
+			both++
+		}
+	}
+	if got := float64(both) / 100; got > 2 {
+		t.Errorf("%.1f%% of identities are in both 10%% rollouts, want about 1%%", got)
+	}
+}
+
+func TestCanaryAssign(t *testing.T) {
+	// Find identities below 50 and at or above 50 for both the rule and the
+	// profile at 50%, so the cases do not depend on the hash function's
+	// values.
+	var low, high string
+	for i := 0; low == "" || high == ""; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		rule, profile := identityBucket(ruleUntypedMetrics, id), identityBucket(profileRollout("strict"), id)
+		switch {
+		case rule < 50 && profile < 50:
+			low = id
+		case rule >= 50 && profile >= 50:
+			high = id
+		}
+	}
+
+	rollout, err := newCanaryRollout(Canary{
+		IdentityLabel: "userid",
+		Rules:         map[string]float64{ruleUntypedMetrics: 50, ruleUTF8Names: 100, ruleDeprecations: 0},
+		Profiles: map[string]CanaryProfile{
+			"strict": {Percent: 50, Rules: []string{ruleHistogramLayouts, ruleAnomalies}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		groupLabels model.LabelSet
+		series      string
+		want        string // enforced rules
+	}{
+		{name: "canary identity in the grouping key", groupLabels: model.LabelSet{"job": "batch", "userid": model.LabelValue(low)}, want: "anomaly_detection histogram_layouts untyped_metrics utf8_names"},
+		{name: "control identity in the grouping key", groupLabels: model.LabelSet{"job": "batch", "userid": model.LabelValue(high)}, want: "utf8_names"},
+		{name: "identity in the series labels", series: fmt.Sprintf("requests_total{userid=%q} 1\n", low), want: "anomaly_detection histogram_layouts untyped_metrics utf8_names"},
+		{name: "grouping key wins over series labels", groupLabels: model.LabelSet{"job": "batch", "userid": model.LabelValue(high)}, series: fmt.Sprintf("requests_total{userid=%q} 1\n", low), want: "utf8_names"},
+		{name: "any canary identity enforces", series: fmt.Sprintf("requests_total{userid=%q} 1\nrequests_total{userid=%q} 1\n", high, low), want: "anomaly_detection histogram_layouts untyped_metrics utf8_names"},
+		{name: "no identity", series: "requests_total 1\n", want: ""},
+		{name: "empty identity", groupLabels: model.LabelSet{"job": "batch", "userid": ""}, series: "requests_total{userid=\"\"} 1\n", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groupLabels := tt.groupLabels
+			if groupLabels == nil {
+				groupLabels = model.LabelSet{"job": "batch"}
+			}
+			series := "# TYPE requests_total counter\n" + tt.series
+			a := rollout.Assign(groupLabels, parseFamilies(t, series))
+			var enforced []string
+			for _, rule := range []string{ruleAnomalies, ruleDeprecations, ruleHistogramLayouts, ruleUntypedMetrics, ruleUTF8Names} {
+				if a.Enforced(rule) {
+					enforced = append(enforced, rule)
+				}
+			}
+			if strings.Join(enforced, " ") != tt.want {
+				t.Errorf("enforced %v, want %s", enforced, tt.want)
+			}
+		})
+	}
+
+	if a := rollout.Assign(model.LabelSet{"job": "batch"}, nil); !a.Enforced("created_series") {
+		t.Error("rules not in rollout must be enforced")
+	}
+}
+
+func TestNewCanaryRolloutErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Canary
+		want string
+	}{
+		{name: "invalid identity label", cfg: Canary{IdentityLabel: "", Rules: map[string]float64{ruleDeprecations: 10}}, want: "invalid identity_label"},
+		{name: "unknown rule", cfg: Canary{IdentityLabel: "userid", Rules: map[string]float64{"renames": 10}}, want: `unknown rule "renames"`},
+		{name: "percentage", cfg: Canary{IdentityLabel: "userid", Rules: map[string]float64{ruleDeprecations: 110}}, want: "must be between 0 and 100"},
+		{name: "empty profile", cfg: Canary{IdentityLabel: "userid", Profiles: map[string]CanaryProfile{"p": {Percent: 10}}}, want: "profile p has no rules"},
+		{name: "profile percentage", cfg: Canary{IdentityLabel: "userid", Profiles: map[string]CanaryProfile{"p": {Percent: -1, Rules: []string{ruleDeprecations}}}}, want: "percentage of profile p"},
+		{name: "unknown profile rule", cfg: Canary{IdentityLabel: "userid", Profiles: map[string]CanaryProfile{"p": {Percent: 10, Rules: []string{"renames"}}}}, want: `profile p: unknown rule "renames"`},
+		{
+			name: "rule in two profiles",
+			cfg: Canary{IdentityLabel: "userid", Profiles: map[string]CanaryProfile{
+				"a": {Percent: 10, Rules: []string{ruleDeprecations}},
+				"b": {Percent: 20, Rules: []string{ruleDeprecations}},
+			}},
+			want: "rule deprecations is in profiles a and b",
+		},
+		{
+			name: "rule in a profile and the rules",
+			cfg: Canary{IdentityLabel: "userid", Rules: map[string]float64{ruleDeprecations: 5}, Profiles: map[string]CanaryProfile{
+				"a": {Percent: 10, Rules: []string{ruleDeprecations}},
+			}},
+			want: "has its own percentage",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCanaryRollout(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
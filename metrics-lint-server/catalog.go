@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CatalogEntry describes one metric family known from registered schemas,
+// observed pushes, or both.
+type CatalogEntry struct {
+	Name          string              `json:"name"`
+	Type          string              `json:"type"`
+	Help          string              `json:"help,omitempty"`
+	Unit          string              `json:"unit,omitempty"`
+	Labels        []string            `json:"labels,omitempty"`
+	ExampleValues map[string][]string `json:"example_values,omitempty"`
+	FirstSeen     *time.Time          `json:"first_seen,omitempty"`
+	LastSeen      *time.Time          `json:"last_seen,omitempty"`
+	Jobs          []string            `json:"jobs,omitempty"`
+	Registered    bool                `json:"registered"`
+	Observed      bool                `json:"observed"`
+}
+
+// buildCatalog merges registered schemas with observed traffic. Registered
+// descriptions take precedence for type, help and unit when set; labels are
+// the union of both.
+func buildCatalog(registry *Schema, observed map[string]familyObservation) []CatalogEntry {
+	entries := map[string]*CatalogEntry{}
+	for _, ms := range registry.Metrics {
+		entries[ms.Name] = &CatalogEntry{
+			Name:       ms.Name,
+			Type:       ms.Type,
+			Help:       ms.Help,
+			Unit:       ms.Unit,
+			Labels:     append([]string(nil), ms.Labels...),
+			Registered: true,
+		}
+	}
+
+	for name, o := range observed {
+		e, ok := entries[name]
+		if !ok {
+			e = &CatalogEntry{Name: name}
+			entries[name] = e
+		}
+		if e.Type == "" {
+			e.Type = o.Schema.Type
+		}
+		if e.Help == "" {
+			e.Help = o.Schema.Help
+		}
+		if e.Unit == "" {
+			e.Unit = o.Schema.Unit
+		}
+		_, added := diffStrings(e.Labels, o.Schema.Labels)
+		e.Labels = append(e.Labels, added...)
+		sort.Strings(e.Labels)
+
+		first, last := o.FirstSeen, o.LastSeen
+		e.FirstSeen, e.LastSeen = &first, &last
+		e.ExampleValues = o.Examples
+		for job := range o.Jobs {
+			e.Jobs = append(e.Jobs, job)
+		}
+		sort.Strings(e.Jobs)
+		e.Observed = true
+	}
+
+	catalog := make([]CatalogEntry, 0, len(entries))
+	for _, e := range entries {
+		catalog = append(catalog, *e)
+	}
+	sort.Slice(catalog, func(i, j int) bool { return catalog[i].Name < catalog[j].Name })
+	return catalog
+}
+
+// writeCatalog renders the catalog as json, markdown or html.
+func writeCatalog(w io.Writer, catalog []CatalogEntry, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(catalog)
+	case "markdown", "md":
+		return writeCatalogMarkdown(w, catalog)
+	case "html":
+		return catalogTemplate.Execute(w, catalog)
+	}
+	return fmt.Errorf("unknown catalog format %q, expected json, markdown or html", format)
+}
+
+func writeCatalogMarkdown(w io.Writer, catalog []CatalogEntry) error {
+	var b bytes.Buffer
+	b.WriteString("# Metric catalog\n\n")
+	b.WriteString("| Metric | Type | Unit | Labels | Jobs | First seen | Last seen |\n")
+	b.WriteString("|---|---|---|---|---|---|---|\n")
+	for _, e := range catalog {
+		fmt.Fprintf(&b, "| [`%s`](#%s) | %s | %s | %s | %s | %s | %s |\n",
+			escapePipes(e.Name), escapePipes(e.Name), markdownEscape(e.Type), markdownEscape(e.Unit),
+			markdownEscape(strings.Join(e.Labels, ", ")), markdownEscape(strings.Join(e.Jobs, ", ")),
+			formatSeen(e.FirstSeen), formatSeen(e.LastSeen))
+	}
+
+	for _, e := range catalog {
+		fmt.Fprintf(&b, "\n## %s\n\n", markdownEscape(e.Name))
+		if e.Help != "" {
+			fmt.Fprintf(&b, "%s\n\n", markdownEscape(e.Help))
+		}
+		fmt.Fprintf(&b, "- Type: %s\n", markdownEscape(e.Type))
+		if e.Unit != "" {
+			fmt.Fprintf(&b, "- Unit: %s\n", markdownEscape(e.Unit))
+		}
+		fmt.Fprintf(&b, "- Registered: %t, observed: %t\n", e.Registered, e.Observed)
+		if len(e.Jobs) > 0 {
+			fmt.Fprintf(&b, "- Jobs: %s\n", markdownEscape(strings.Join(e.Jobs, ", ")))
+		}
+		if e.Observed {
+			fmt.Fprintf(&b, "- First seen: %s, last seen: %s\n", formatSeen(e.FirstSeen), formatSeen(e.LastSeen))
+		}
+		for _, l := range e.Labels {
+			if examples := e.ExampleValues[l]; len(examples) > 0 {
+				escaped := make([]string, len(examples))
+				for i, v := range examples {
+					escaped[i] = markdownEscape(v)
+				}
+				fmt.Fprintf(&b, "- Label `%s`, e.g. %s\n", l, strings.Join(escaped, ", "))
+			} else {
+				fmt.Fprintf(&b, "- Label `%s`\n", l)
+			}
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// markdownEscape escapes pushed text for use in the Markdown catalog, so
+// that pipes don't end a table cell, line breaks don't end a table row or
+// list item, and values aren't rendered as emphasis, links or HTML.
+var markdownEscape = strings.NewReplacer(
+	"\\", "\\\\", "`", "\\`", "*", "\\*", "_", "\\_", "[", "\\[", "]", "\\]",
+	"<", "\\<", ">", "\\>", "|", "\\|", "\r\n", " ", "\n", " ",
+).Replace
+
+// escapePipes escapes the pipes of a code span or link inside a Markdown
+// table cell, where other backslash escapes would be shown literally.
+func escapePipes(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
+
+func formatSeen(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+var catalogTemplate = template.Must(template.New("catalog").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"seen": formatSeen,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Metric catalog</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+code { font-size: 90%; }
+</style>
+</head>
+<body>
+<h1>Metric catalog</h1>
+<table>
+<tr><th>Metric</th><th>Type</th><th>Unit</th><th>Help</th><th>Labels</th><th>Jobs</th><th>First seen</th><th>Last seen</th></tr>
+{{- range . }}
+<tr>
+<td id="{{ .Name }}"><code>{{ .Name }}</code>{{ if not .Registered }} <em>(unregistered)</em>{{ end }}{{ if not .Observed }} <em>(never pushed)</em>{{ end }}</td>
+<td>{{ .Type }}</td>
+<td>{{ .Unit }}</td>
+<td>{{ .Help }}</td>
+<td>{{ $examples := .ExampleValues }}{{ range .Labels }}<code>{{ . }}</code>{{ with index $examples . }} e.g. {{ join . ", " }}{{ end }}<br>{{ end }}</td>
+<td>{{ join .Jobs ", " }}</td>
+<td>{{ seen .FirstSeen }}</td>
+<td>{{ seen .LastSeen }}</td>
+</tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+// handleCatalog serves the metric catalog. The format is taken from the
+// format query parameter, defaulting to HTML for browsers and JSON otherwise.
+func handleCatalog(store *metricStore, registry *Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed. Use GET.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				format = "html"
+			}
+		}
+
+		var b bytes.Buffer
+		if err := writeCatalog(&b, buildCatalog(registry, store.Observations()), format); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch format {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+		case "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		default:
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		}
+		w.Write(b.Bytes())
+	}
+}
+
+// runCatalog implements the "catalog" subcommand. Registered families come
+// from the configured schemas; exposition files given as arguments are
+// treated as observed traffic, using the file name as the job.
+func runCatalog(cfg *Config, args []string) int {
+	fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+	format := fs.String("format", "markdown", "Output format: markdown, html or json.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: metriclint_server [-config file] catalog [flags] [exposition files...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	registry, err := loadSchemas(cfg.Schemas)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	store, err := storeFromFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := writeCatalog(os.Stdout, buildCatalog(registry, store.Observations()), *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
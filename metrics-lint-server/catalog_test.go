@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildCatalog(t *testing.T) {
+	registry := &Schema{Metrics: []MetricSchema{
+		{Name: "requests_total", Type: "counter", Help: "Registered help.", Labels: []string{"method"}},
+		{Name: "unused_seconds", Type: "gauge", Unit: "seconds"},
+	}}
+	observed := map[string]familyObservation{
+		"requests_total": {
+			Schema:    MetricSchema{Name: "requests_total", Type: "counter", Help: "Pushed help.", Labels: []string{"code", "method"}},
+			Examples:  map[string][]string{"code": {"200", "500"}},
+			FirstSeen: t0,
+			LastSeen:  t0.Add(time.Minute),
+			Jobs:      map[string]time.Time{"worker": t0, "batch": t0.Add(time.Minute)},
+		},
+		"queue_size": {
+			Schema:    MetricSchema{Name: "queue_size", Type: "gauge", Help: "Pushed only."},
+			FirstSeen: t0,
+			LastSeen:  t0,
+			Jobs:      map[string]time.Time{"worker": t0},
+		},
+	}
+
+	catalog := buildCatalog(registry, observed)
+	var names []string
+	for _, e := range catalog {
+		names = append(names, e.Name)
+	}
+	if got, want := strings.Join(names, ","), "queue_size,requests_total,unused_seconds"; got != want {
+		t.Fatalf("catalog lists %s, want %s", got, want)
+	}
+
+	queue, requests, unused := catalog[0], catalog[1], catalog[2]
+	if queue.Registered || !queue.Observed || queue.Help != "Pushed only." || queue.Type != "gauge" {
+		t.Errorf("pushed-only entry %+v", queue)
+	}
+	if !requests.Registered || !requests.Observed {
+		t.Errorf("requests_total registered %t, observed %t", requests.Registered, requests.Observed)
+	}
+	if requests.Help != "Registered help." {
+		t.Errorf("help %q, want the registered help", requests.Help)
+	}
+	if got := strings.Join(requests.Labels, ","); got != "code,method" {
+		t.Errorf("labels %s, want the union code,method", got)
+	}
+	if got := strings.Join(requests.Jobs, ","); got != "batch,worker" {
+		t.Errorf("jobs %s, want batch,worker", got)
+	}
+	if requests.FirstSeen == nil || !requests.FirstSeen.Equal(t0) || requests.LastSeen == nil || !requests.LastSeen.Equal(t0.Add(time.Minute)) {
+		t.Errorf("seen from %v to %v", requests.FirstSeen, requests.LastSeen)
+	}
+	if !unused.Registered || unused.Observed || unused.FirstSeen != nil || len(unused.Jobs) != 0 {
+		t.Errorf("never pushed entry %+v", unused)
+	}
+}
+
+func TestWriteCatalogMarkdown(t *testing.T) {
+	seen := t0
+	catalog := []CatalogEntry{{
+		Name:          "requests_total",
+		Type:          "counter",
+		Help:          "Requests by route, e.g. a|b.\nSecond line.",
+		Labels:        []string{"route"},
+		ExampleValues: map[string][]string{"route": {"/a|/b", "/c"}},
+		Jobs:          []string{"api|edge"},
+		FirstSeen:     &seen,
+		LastSeen:      &seen,
+		Registered:    true,
+		Observed:      true,
+	}}
+
+	var b bytes.Buffer
+	if err := writeCatalog(&b, catalog, "markdown"); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"| [`requests_total`](#requests_total) | counter |  | route | api\\|edge | 2023-11-14T22:15:00Z | 2023-11-14T22:15:00Z |\n",
+		"\n## requests\\_total\n\nRequests by route, e.g. a\\|b. Second line.\n\n",
+		"- Label `route`, e.g. /a\\|/b, /c\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("markdown lacks %q:\n%s", want, out)
+		}
+	}
+
+	// Every table row must have the header's number of cells.
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "|") {
+			continue
+		}
+		if cells := strings.Count(strings.ReplaceAll(line, "\\|", ""), "|") - 1; cells != 7 {
+			t.Errorf("table row has %d cells, want 7: %s", cells, line)
+		}
+	}
+}
+
+func TestWriteCatalogHTML(t *testing.T) {
+	catalog := []CatalogEntry{
+		{
+			Name:          "requests_total",
+			Type:          "counter",
+			Help:          "Requests <by> route & code.",
+			Labels:        []string{"code"},
+			ExampleValues: map[string][]string{"code": {"200", "5xx"}},
+			Observed:      true,
+		},
+		{Name: "unused", Type: "gauge", Registered: true},
+	}
+
+	var b bytes.Buffer
+	if err := writeCatalog(&b, catalog, "html"); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		`<td id="requests_total"><code>requests_total</code> <em>(unregistered)</em></td>`,
+		`<td>Requests &lt;by&gt; route &amp; code.</td>`,
+		`<code>code</code> e.g. 200, 5xx<br>`,
+		`<td id="unused"><code>unused</code> <em>(never pushed)</em></td>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("html lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteCatalogFormats(t *testing.T) {
+	catalog := []CatalogEntry{{Name: "up", Type: "gauge", Registered: true}}
+
+	var b bytes.Buffer
+	if err := writeCatalog(&b, catalog, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []CatalogEntry
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatalf("json output: %v", err)
+	}
+	if len(decoded) != 1 || decoded[0].Name != "up" {
+		t.Errorf("json output %+v", decoded)
+	}
+
+	if err := writeCatalog(&b, catalog, "pdf"); err == nil || !strings.Contains(err.Error(), "unknown catalog format") {
+		t.Errorf("unknown format: got error %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Severities of a compatibility change.
+const (
+	severityBreaking = "breaking"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+// CompatChange is a single difference between an old and a new schema.
+type CompatChange struct {
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Metric   string `json:"metric"`
+	Text     string `json:"text"`
+}
+
+// CompatReport lists all changes found between two schemas.
+type CompatReport struct {
+	Status   string         `json:"status"`
+	Message  string         `json:"message,omitempty"`
+	Changes  []CompatChange `json:"changes,omitempty"`
+	Breaking int            `json:"breaking"`
+	Warnings int            `json:"warnings"`
+}
+
+// CompatRequest is the body accepted by the /compat endpoint. Both fields
+// hold either a text exposition or a YAML/JSON schema.
+type CompatRequest struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// compareSchemas reports changes from old to new that can break queries,
+// dashboards and alerts built on the old metrics.
+func compareSchemas(oldSchema, newSchema *Schema) *CompatReport {
+	report := &CompatReport{}
+	add := func(severity, kind, metric, format string, args ...interface{}) {
+		report.Changes = append(report.Changes, CompatChange{
+			Severity: severity,
+			Kind:     kind,
+			Metric:   metric,
+			Text:     fmt.Sprintf(format, args...),
+		})
+		switch severity {
+		case severityBreaking:
+			report.Breaking++
+		case severityWarning:
+			report.Warnings++
+		}
+	}
+
+	for _, o := range oldSchema.Metrics {
+		n := newSchema.Lookup(o.Name)
+		if n == nil {
+			if renamed := findRenamed(o, oldSchema, newSchema); renamed != "" {
+				add(severityBreaking, "family_renamed", o.Name, "metric family was removed, possibly renamed to %q", renamed)
+			} else {
+				add(severityBreaking, "family_removed", o.Name, "metric family was removed")
+			}
+			continue
+		}
+
+		if o.Type != n.Type {
+			add(severityBreaking, "type_changed", o.Name, "type changed from %s to %s", o.Type, n.Type)
+		}
+		if o.Unit != n.Unit {
+			add(severityBreaking, "unit_changed", o.Name, "unit changed from %q to %q", o.Unit, n.Unit)
+		}
+
+		removed, added := diffStrings(o.Labels, n.Labels)
+		if len(removed) == 1 && len(added) == 1 {
+			add(severityBreaking, "label_renamed", o.Name, "label %q renamed to %q", removed[0], added[0])
+		} else {
+			for _, l := range removed {
+				add(severityBreaking, "label_removed", o.Name, "label %q was removed", l)
+			}
+			for _, l := range added {
+				add(severityWarning, "label_added", o.Name, "label %q was added, which splits existing series", l)
+			}
+		}
+
+		if removedBuckets, addedBuckets := diffFloats(o.Buckets, n.Buckets); len(removedBuckets) > 0 {
+			add(severityBreaking, "buckets_changed", o.Name, "bucket boundaries %v were removed (old %v, new %v)", removedBuckets, o.Buckets, n.Buckets)
+		} else if len(addedBuckets) > 0 {
+			add(severityWarning, "buckets_changed", o.Name, "bucket boundaries %v were added", addedBuckets)
+		}
+
+		if o.Help != n.Help && o.Help != "" && n.Help != "" {
+			add(severityInfo, "help_changed", o.Name, "help text changed to %q", n.Help)
+		}
+	}
+
+	for _, n := range newSchema.Metrics {
+		if oldSchema.Lookup(n.Name) == nil {
+			add(severityInfo, "family_added", n.Name, "metric family was added")
+		}
+	}
+
+	switch {
+	case report.Breaking > 0:
+		report.Status = "error"
+		report.Message = fmt.Sprintf("Found %d breaking changes", report.Breaking)
+	case report.Warnings > 0:
+		report.Status = "warning"
+		report.Message = fmt.Sprintf("No breaking changes, but found %d warnings", report.Warnings)
+	default:
+		report.Status = "success"
+		report.Message = "No breaking changes found."
+	}
+	return report
+}
+
+// findRenamed looks for a family that only exists in new and has the same
+// type and labels as the removed family o.
+func findRenamed(o MetricSchema, oldSchema, newSchema *Schema) string {
+	for _, n := range newSchema.Metrics {
+		if oldSchema.Lookup(n.Name) != nil || n.Type != o.Type {
+			continue
+		}
+		if removed, added := diffStrings(o.Labels, n.Labels); len(removed) == 0 && len(added) == 0 {
+			return n.Name
+		}
+	}
+	return ""
+}
+
+// diffStrings returns the elements only in a and only in b.
+func diffStrings(a, b []string) (onlyA, onlyB []string) {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, s := range a {
+		inA[s] = true
+	}
+	for _, s := range b {
+		inB[s] = true
+		if !inA[s] {
+			onlyB = append(onlyB, s)
+		}
+	}
+	for _, s := range a {
+		if !inB[s] {
+			onlyA = append(onlyA, s)
+		}
+	}
+	return onlyA, onlyB
+}
+
+func diffFloats(a, b []float64) (onlyA, onlyB []float64) {
+	inA, inB := map[float64]bool{}, map[float64]bool{}
+	for _, f := range a {
+		inA[f] = true
+	}
+	for _, f := range b {
+		inB[f] = true
+		if !inA[f] {
+			onlyB = append(onlyB, f)
+		}
+	}
+	for _, f := range a {
+		if !inB[f] {
+			onlyA = append(onlyA, f)
+		}
+	}
+	return onlyA, onlyB
+}
+
+func handleCompat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed. Use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CompatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, CompatReport{Status: "error", Message: "Invalid request body: " + err.Error()})
+		return
+	}
+
+	oldSchema, err := parseSchema([]byte(req.Old))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, CompatReport{Status: "error", Message: "Invalid old input: " + err.Error()})
+		return
+	}
+	newSchema, err := parseSchema([]byte(req.New))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, CompatReport{Status: "error", Message: "Invalid new input: " + err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, compareSchemas(oldSchema, newSchema))
+}
+
+// runCompat implements the "compat" subcommand. It exits non-zero when
+// breaking changes are found, so it can gate client releases in CI.
+func runCompat(args []string) int {
+	fs := flag.NewFlagSet("compat", flag.ExitOnError)
+	output := fs.String("output", "text", "Output format: text or json.")
+	failOnWarning := fs.Bool("fail-on-warning", false, "Also exit non-zero on warnings.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: metriclint_server compat [flags] <old> <new>")
+		fmt.Fprintln(fs.Output(), "Inputs are text expositions or YAML/JSON schemas; use - for stdin.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var schemas [2]*Schema
+	for i, path := range fs.Args() {
+		data, err := readInput(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if schemas[i], err = parseSchema(data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+	}
+
+	report := compareSchemas(schemas[0], schemas[1])
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		changes := append([]CompatChange(nil), report.Changes...)
+		sort.SliceStable(changes, func(i, j int) bool { return severityRank(changes[i].Severity) > severityRank(changes[j].Severity) })
+		for _, c := range changes {
+			fmt.Printf("%-8s %s: %s\n", strings.ToUpper(c.Severity), c.Metric, c.Text)
+		}
+		fmt.Println(report.Message)
+	}
+
+	if report.Breaking > 0 || *failOnWarning && report.Warnings > 0 {
+		return 1
+	}
+	return 0
+}
+
+func severityRank(s string) int {
+	switch s {
+	case severityBreaking:
+		return 2
+	case severityWarning:
+		return 1
+	}
+	return 0
+}
+
+// readInput reads a file, or stdin when path is "-".
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
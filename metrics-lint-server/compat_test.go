@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompareSchemas(t *testing.T) {
+	tests := []struct {
+		name       string
+		old, new   string
+		want       []string // severity:kind:metric of each change
+		wantStatus string
+	}{
+		{
+			name:       "unchanged",
+			old:        "# TYPE requests_total counter\nrequests_total{method=\"GET\"} 1\n",
+			new:        "# TYPE requests_total counter\nrequests_total{method=\"POST\"} 7\n",
+			wantStatus: "success",
+		},
+		{
+			name:       "type changed",
+			old:        "# TYPE queue_size gauge\nqueue_size 1\n",
+			new:        "# TYPE queue_size counter\nqueue_size 1\n",
+			want:       []string{"breaking:type_changed:queue_size"},
+			wantStatus: "error",
+		},
+		{
+			name:       "label removed",
+			old:        "# TYPE requests_total counter\nrequests_total{method=\"GET\",code=\"200\",path=\"/\"} 1\n",
+			new:        "# TYPE requests_total counter\nrequests_total{method=\"GET\"} 1\n",
+			want:       []string{"breaking:label_removed:requests_total", "breaking:label_removed:requests_total"},
+			wantStatus: "error",
+		},
+		{
+			name:       "label renamed",
+			old:        "# TYPE requests_total counter\nrequests_total{method=\"GET\"} 1\n",
+			new:        "# TYPE requests_total counter\nrequests_total{verb=\"GET\"} 1\n",
+			want:       []string{"breaking:label_renamed:requests_total"},
+			wantStatus: "error",
+		},
+		{
+			name:       "label added",
+			old:        "# TYPE requests_total counter\nrequests_total{method=\"GET\"} 1\n",
+			new:        "# TYPE requests_total counter\nrequests_total{method=\"GET\",code=\"200\",path=\"/\"} 1\n",
+			want:       []string{"warning:label_added:requests_total", "warning:label_added:requests_total"},
+			wantStatus: "warning",
+		},
+		{
+			name:       "metric removed",
+			old:        "# TYPE a gauge\na 1\n# TYPE b counter\nb{x=\"1\"} 1\n",
+			new:        "# TYPE a gauge\na 1\n",
+			want:       []string{"breaking:family_removed:b"},
+			wantStatus: "error",
+		},
+		{
+			name:       "metric renamed",
+			old:        "# TYPE requests_total counter\nrequests_total{method=\"GET\"} 1\n",
+			new:        "# TYPE http_requests_total counter\nhttp_requests_total{method=\"GET\"} 1\n",
+			want:       []string{"breaking:family_renamed:requests_total", "info:family_added:http_requests_total"},
+			wantStatus: "error",
+		},
+		{
+			name:       "metric added",
+			old:        "# TYPE a gauge\na 1\n",
+			new:        "# TYPE a gauge\na 1\n# TYPE b gauge\nb 1\n",
+			want:       []string{"info:family_added:b"},
+			wantStatus: "success",
+		},
+		{
+			name:       "unit changed",
+			old:        "metrics:\n- name: latency\n  type: gauge\n  unit: seconds\n",
+			new:        "metrics:\n- name: latency\n  type: gauge\n  unit: milliseconds\n",
+			want:       []string{"breaking:unit_changed:latency"},
+			wantStatus: "error",
+		},
+		{
+			name:       "buckets removed",
+			old:        "metrics:\n- name: latency_seconds\n  type: histogram\n  buckets: [0.1, 1, 10]\n",
+			new:        "metrics:\n- name: latency_seconds\n  type: histogram\n  buckets: [0.1, 10]\n",
+			want:       []string{"breaking:buckets_changed:latency_seconds"},
+			wantStatus: "error",
+		},
+		{
+			name:       "buckets added",
+			old:        "metrics:\n- name: latency_seconds\n  type: histogram\n  buckets: [0.1, 10]\n",
+			new:        "metrics:\n- name: latency_seconds\n  type: histogram\n  buckets: [0.1, 1, 10]\n",
+			want:       []string{"warning:buckets_changed:latency_seconds"},
+			wantStatus: "warning",
+		},
+		{
+			name:       "help changed",
+			old:        "# HELP a Old help.\n# TYPE a gauge\na 1\n",
+			new:        "# HELP a New help.\n# TYPE a gauge\na 1\n",
+			want:       []string{"info:help_changed:a"},
+			wantStatus: "success",
+		},
+		{
+			name:       "schema against exposition",
+			old:        `{"metrics": [{"name": "requests_total", "type": "counter", "labels": ["method"]}]}`,
+			new:        "# TYPE requests_total counter\nrequests_total{method=\"GET\"} 1\n",
+			wantStatus: "success",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldSchema, err := parseSchema([]byte(tt.old))
+			if err != nil {
+				t.Fatalf("old: %v", err)
+			}
+			newSchema, err := parseSchema([]byte(tt.new))
+			if err != nil {
+				t.Fatalf("new: %v", err)
+			}
+			report := compareSchemas(oldSchema, newSchema)
+
+			var got []string
+			breaking, warnings := 0, 0
+			for _, c := range report.Changes {
+				got = append(got, c.Severity+":"+c.Kind+":"+c.Metric)
+				switch c.Severity {
+				case severityBreaking:
+					breaking++
+				case severityWarning:
+					warnings++
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("changes %v, want %v", got, tt.want)
+			}
+			if report.Status != tt.wantStatus {
+				t.Errorf("status %q, want %q", report.Status, tt.wantStatus)
+			}
+			if report.Breaking != breaking || report.Warnings != warnings {
+				t.Errorf("counted %d breaking and %d warnings, want %d and %d", report.Breaking, report.Warnings, breaking, warnings)
+			}
+		})
+	}
+}
+
+func TestHandleCompat(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:       "breaking",
+			method:     http.MethodPost,
+			body:       `{"old": "# TYPE a gauge\na 1\n", "new": "# TYPE a counter\na 1\n"}`,
+			wantCode:   http.StatusOK,
+			wantStatus: "error",
+		},
+		{
+			name:       "compatible",
+			method:     http.MethodPost,
+			body:       `{"old": "# TYPE a gauge\na 1\n", "new": "# TYPE a gauge\na 2\n"}`,
+			wantCode:   http.StatusOK,
+			wantStatus: "success",
+		},
+		{
+			name:       "invalid input",
+			method:     http.MethodPost,
+			body:       `{"old": "", "new": "# TYPE a gauge\na 1\n"}`,
+			wantCode:   http.StatusBadRequest,
+			wantStatus: "error",
+		},
+		{
+			name:     "wrong method",
+			method:   http.MethodGet,
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleCompat(rec, httptest.NewRequest(tt.method, "/compat", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("code %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+			var report CompatReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != tt.wantStatus {
+				t.Errorf("status %q, want %q", report.Status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// Config is the lint server configuration, loaded from the YAML file given
+// with -config. All sections are optional.
+type Config struct {
+	// Schemas lists files describing registered metric families, either as
+	// YAML/JSON schemas or as example expositions. Relative paths are
+	// resolved against the directory of the config file.
+	Schemas []string `yaml:"schemas"`
+
+	// Gateways lists the Pushgateways Prometheus scrapes, used to find the
+	// scrape jobs that target them. Defaults to the -gateway URL.
+	Gateways []GatewayBackend `yaml:"gateways"`
+
+	// Freshness lists per-job-pattern SLOs that alerting rules are
+	// generated from.
+	Freshness []FreshnessSLO `yaml:"freshness"`
+
+	// ExpectedPushers lists clients that should push at a regular cadence.
+	ExpectedPushers []ExpectedPusher `yaml:"expected_pushers"`
+
+	// JobNormalization lists rules moving per-run job name suffixes into
+	// grouping-key labels.
+	JobNormalization []JobNormalization `yaml:"job_normalization"`
+
+	// HistogramLayouts lists canonical bucket layouts per histogram.
+	HistogramLayouts []HistogramLayout `yaml:"histogram_layouts"`
+
+	// CreatedSeries is the policy for _created companion series: keep
+	// (default), drop, or convert into created timestamps.
+	CreatedSeries string `yaml:"created_series"`
+
+	// Config holds the policies shared with the lint engine: utf8_names,
+	// untyped_metrics, renames, deprecations and path_normalization.
+	lint.Config `yaml:",inline"`
+
+	// DeltaPush selects jobs whose pushes carry increments that are added
+	// up into cumulative values before forwarding.
+	DeltaPush DeltaPush `yaml:"delta_push"`
+
+	// AnomalyDetection enables flagging pushed values that deviate from
+	// their series' rolling statistics.
+	AnomalyDetection *AnomalyDetection `yaml:"anomaly_detection"`
+
+	// Canary enforces rules for a percentage of clients only.
+	Canary Canary `yaml:"canary"`
+
+	// PushHistory records incoming pushes for replaying rule changes.
+	PushHistory PushHistory `yaml:"push_history"`
+
+	// PolicyEndpoint serves clients their effective policy for linting
+	// before they push.
+	PolicyEndpoint PolicyEndpoint `yaml:"policy_endpoint"`
+}
+
+// loadConfig reads and parses the config file. An empty path yields the
+// default (empty) configuration.
+func loadConfig(path string) (*Config, error) {
+	if path == "" {
+		return &Config{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig parses the contents of a config file, resolving relative paths
+// against dir.
+func parseConfig(data []byte, dir string) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	for i, p := range cfg.Schemas {
+		if !filepath.IsAbs(p) {
+			cfg.Schemas[i] = filepath.Join(dir, p)
+		}
+	}
+	paths := []*string{&cfg.DeltaPush.StateFile, &cfg.PushHistory.File, &cfg.PushHistory.TokenFile}
+	for i := range cfg.PolicyEndpoint.Clients {
+		paths = append(paths, &cfg.PolicyEndpoint.Clients[i].TokenFile)
+	}
+	for _, p := range paths {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return cfg, nil
+}
+
+// loadSchemas merges all configured schema files into one registry. When a
+// family is described more than once, the first description wins.
+func loadSchemas(paths []string) (*Schema, error) {
+	registry := &Schema{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s, err := parseSchema(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, ms := range s.Metrics {
+			if registry.Lookup(ms.Name) == nil {
+				registry.Metrics = append(registry.Metrics, ms)
+			}
+		}
+	}
+	return registry, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/config"
+	"gopkg.in/yaml.v3"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// ConfigFinding is a problem with the lint server configuration. Errors
+// keep the server from starting; warnings point at rules that conflict or
+// have no effect.
+type ConfigFinding struct {
+	Severity string `json:"severity"`
+	Section  string `json:"section"`
+	Text     string `json:"text"`
+}
+
+// ConfigCheckReport is the result of checking a configuration file.
+type ConfigCheckReport struct {
+	Status   string          `json:"status"`
+	Message  string          `json:"message,omitempty"`
+	Findings []ConfigFinding `json:"findings,omitempty"`
+}
+
+// addFinding records a finding of a config check.
+type addFinding func(severity, section, format string, args ...interface{})
+
+// checkConfig loads the config file strictly, so misspelt keys are caught,
+// builds every policy the server would build at startup, reads the files the
+// config refers to and looks for rules that conflict or can never apply. If
+// scrapeConfig names a Prometheus config, the scrape jobs of the configured
+// gateways are checked too, including their certificates, keys and secret
+// files.
+func checkConfig(file, scrapeConfig string) (*ConfigCheckReport, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ConfigCheckReport{}
+	var add addFinding = func(severity, section, format string, args ...interface{}) {
+		report.Findings = append(report.Findings, ConfigFinding{Severity: severity, Section: section, Text: fmt.Sprintf(format, args...)})
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var strict Config
+	if err := dec.Decode(&strict); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			add("error", "config", "%v", err)
+			return finishConfigCheck(report), nil
+		}
+		for _, e := range typeErr.Errors {
+			add("error", "config", "%s", e)
+		}
+	}
+	cfg, err := loadConfig(file)
+	if err != nil {
+		// Type errors were reported above.
+		return finishConfigCheck(report), nil
+	}
+
+	check := func(section string, err error) {
+		if err != nil {
+			add("error", section, "%v", err)
+		}
+	}
+	for _, g := range cfg.Gateways {
+		switch g.Auth {
+		case "", "none", "basic", "bearer", "tls":
+		default:
+			add("error", "gateways", "gateway %s: unknown auth %q, expected none, basic, bearer or tls", g.Address, g.Auth)
+		}
+	}
+	_, err = loadSchemas(cfg.Schemas)
+	check("schemas", err)
+	_, err = renderFreshnessRules(cfg.Freshness)
+	check("freshness", err)
+	_, err = newPushTracker(cfg.ExpectedPushers, time.Now())
+	check("expected_pushers", err)
+	_, err = newJobNormalizer(cfg.JobNormalization)
+	check("job_normalization", err)
+	_, err = lint.NewPathPolicy(cfg.PathNormalization)
+	check(lint.RulePathNormalization, err)
+	_, err = newHistogramLayouts(cfg.HistogramLayouts)
+	check("histogram_layouts", err)
+	_, err = newCreatedPolicy(cfg.CreatedSeries)
+	check("created_series", err)
+	_, err = lint.NewNamePolicy(cfg.UTF8Names)
+	check(lint.RuleUTF8Names, err)
+	_, err = lint.NewUntypedPolicy(cfg.UntypedMetrics)
+	check(lint.RuleUntypedMetrics, err)
+	_, err = lint.NewRenameMap(cfg.Renames)
+	check(lint.RuleRenames, err)
+	deprecations, err := lint.NewDeprecationPolicy(cfg.Deprecations)
+	check(lint.RuleDeprecations, err)
+	_, err = newDeltaAccumulator(cfg.DeltaPush)
+	check("delta_push", err)
+	if cfg.DeltaPush.StateFile != "" {
+		checkDir("delta_push", cfg.DeltaPush.StateFile, add)
+	}
+	_, err = newAnomalyDetector(cfg.AnomalyDetection)
+	check("anomaly_detection", err)
+	_, err = newCanaryRollout(cfg.Canary)
+	check("canary", err)
+	_, err = openPushHistory(cfg.PushHistory)
+	check("push_history", err)
+	if cfg.PushHistory.File != "" {
+		checkDir("push_history", cfg.PushHistory.File, add)
+	}
+	_, err = loadImpactToken(cfg.PushHistory)
+	check("push_history", err)
+	_, err = loadPolicyTokens(cfg.PolicyEndpoint)
+	check("policy_endpoint", err)
+
+	checkJobNormalizationReachable(cfg.JobNormalization, add)
+	if deprecations != nil {
+		checkDeprecationsReachable(cfg.Deprecations, add)
+		for _, r := range cfg.Renames {
+			if e := deprecations.Match(r.To); e != nil {
+				add("warning", lint.RuleRenames, "%s is renamed to %s, which is deprecated by %s", r.From, r.To, e.Metric)
+			}
+		}
+	}
+	checkLayoutsAfterRenames(cfg, add)
+	checkCanaryEffective(cfg, add)
+	if scrapeConfig != "" {
+		checkGatewayScrapeJobs(scrapeConfig, cfg.Gateways, add)
+	}
+	return finishConfigCheck(report), nil
+}
+
+// checkGatewayScrapeJobs adds the errors and warnings of check scrape-config
+// for a Prometheus config file.
+func checkGatewayScrapeJobs(file string, gateways []GatewayBackend, add addFinding) {
+	promCfg, err := config.LoadFile(file, false, promslog.NewNopLogger())
+	if err != nil {
+		add("error", "scrape_config", "%v", err)
+		return
+	}
+	report, err := checkScrapeConfig(promCfg, gateways, true)
+	if err != nil {
+		add("error", "scrape_config", "%v", err)
+		return
+	}
+	for _, f := range report.Findings {
+		if f.Severity == scrapeError || f.Severity == scrapeWarning {
+			add(f.Severity, "scrape_config", "job %q: %s", f.Job, f.Text)
+		}
+	}
+}
+
+// checkDir reports a file whose directory does not exist, so the file could
+// not be written.
+func checkDir(section, file string, add addFinding) {
+	if info, err := os.Stat(filepath.Dir(file)); err != nil || !info.IsDir() {
+		add("error", section, "directory of %s does not exist", file)
+	}
+}
+
+// checkJobNormalizationReachable flags rules that an earlier rule with the
+// same suffix takes precedence over. The first matching rule rewrites the
+// job whatever its label, so a later rule only applies to pushes whose
+// grouping key already has the earlier rule's label.
+func checkJobNormalizationReachable(rules []JobNormalization, add addFinding) {
+	for i, r := range rules {
+		for j, earlier := range rules[:i] {
+			if earlier.Suffix != r.Suffix || earlier.Job != "" && earlier.Job != r.Job {
+				continue
+			}
+			if earlier.Label == r.Label {
+				add("warning", "job_normalization", "rule %d is unreachable: rule %d matches the same jobs first", i+1, j+1)
+			} else {
+				add("warning", "job_normalization", "rule %d is shadowed by rule %d, which matches the same jobs first; it only applies to pushes whose grouping key already has %s", i+1, j+1, earlier.Label)
+			}
+			break
+		}
+	}
+}
+
+// checkDeprecationsReachable flags deprecations shadowed by an earlier one,
+// since the first matching deprecation applies.
+func checkDeprecationsReachable(deps []lint.Deprecation, add addFinding) {
+	for i, d := range deps {
+		literal := !strings.ContainsAny(d.Metric, `*?[\`)
+		for _, earlier := range deps[:i] {
+			matched, _ := path.Match(earlier.Metric, d.Metric)
+			if earlier.Metric == d.Metric || (literal && matched) {
+				add("warning", "deprecations", "deprecation of %s is unreachable: %s matches it first", d.Metric, earlier.Metric)
+				break
+			}
+		}
+	}
+}
+
+// checkLayoutsAfterRenames flags histogram layouts configured for the old
+// name of a renamed metric only. Layouts apply after renames, so they stop
+// applying at the cutover.
+func checkLayoutsAfterRenames(cfg *Config, add addFinding) {
+	layouts := map[string]bool{}
+	for _, l := range cfg.HistogramLayouts {
+		layouts[l.Metric] = true
+	}
+	for _, r := range cfg.Renames {
+		if layouts[r.From] && !layouts[r.To] {
+			add("warning", "histogram_layouts", "layout of %s stops applying when it is renamed to %s; add a layout for %s", r.From, r.To, r.To)
+		}
+	}
+}
+
+// checkCanaryEffective flags rules in canary rollout whose configuration
+// never rejects or rewrites anything, so the rollout has no effect.
+func checkCanaryEffective(cfg *Config, add addFinding) {
+	rules := make([]string, 0, len(cfg.Canary.Rules))
+	for rule := range cfg.Canary.Rules {
+		rules = append(rules, rule)
+	}
+	for _, profile := range cfg.Canary.Profiles {
+		rules = append(rules, profile.Rules...)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		enforcing := true
+		switch rule {
+		case ruleUntypedMetrics:
+			enforcing = cfg.UntypedMetrics != "" && cfg.UntypedMetrics != "warn"
+		case ruleUTF8Names:
+			enforcing = cfg.UTF8Names.Policy == "reject" || cfg.UTF8Names.Policy == "escape"
+		case ruleHistogramLayouts:
+			enforcing = len(cfg.HistogramLayouts) > 0
+		case ruleDeprecations:
+			enforcing = false
+			for _, d := range cfg.Deprecations {
+				enforcing = enforcing || !d.Sunset.IsZero()
+			}
+		case ruleAnomalies:
+			enforcing = cfg.AnomalyDetection != nil && cfg.AnomalyDetection.Action == "reject"
+		}
+		if !enforcing {
+			add("warning", "canary", "rolling out %s has no effect: the rule only warns as configured", rule)
+		}
+	}
+}
+
+func finishConfigCheck(report *ConfigCheckReport) *ConfigCheckReport {
+	errs := 0
+	for _, f := range report.Findings {
+		if f.Severity == "error" {
+			errs++
+		}
+	}
+	switch {
+	case errs > 0:
+		report.Status = "error"
+		report.Message = fmt.Sprintf("Found %d errors and %d warnings", errs, len(report.Findings)-errs)
+	case len(report.Findings) > 0:
+		report.Status = "warning"
+		report.Message = fmt.Sprintf("Config is valid but has %d warnings", len(report.Findings))
+	default:
+		report.Status = "success"
+		report.Message = "Config is valid."
+	}
+	return report
+}
+
+// runCheckConfig exits non-zero when the config would keep the server from
+// starting.
+func runCheckConfig(args []string) int {
+	fs := flag.NewFlagSet("check config", flag.ExitOnError)
+	scrapeConfig := fs.String("scrape-config", "", "Prometheus config whose gateway scrape jobs and their credentials are checked too.")
+	output := fs.String("output", "text", "Output format: text or json.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: metriclint_server check config [flags] <config file>")
+		return 2
+	}
+
+	report, err := checkConfig(fs.Arg(0), *scrapeConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, f := range report.Findings {
+			fmt.Printf("%-8s %s: %s\n", strings.ToUpper(f.Severity), f.Section, f.Text)
+		}
+		fmt.Println(report.Message)
+	}
+
+	if report.Status == "error" {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		scrape string   // Prometheus config checked along
+		want   []string // severity section: text
+	}{
+		{
+			name:   "valid",
+			config: "untyped_metrics: warn\n",
+		},
+		{
+			name:   "misspelt key",
+			config: "untyped_metric: warn\n",
+			want:   []string{"error config: line 1: field untyped_metric not found in type main.Config"},
+		},
+		{
+			name:   "invalid pattern",
+			config: "job_normalization: [{suffix: '(', label: run}]\n",
+			want:   []string{"error job_normalization: job normalization 1: invalid suffix: error parsing regexp: missing closing ): `^(?:()$`"},
+		},
+		{
+			name: "job normalization shadowed with the same label",
+			config: `job_normalization:
+  - {suffix: timestamp, label: run}
+  - {job: batch, suffix: timestamp, label: run}
+`,
+			want: []string{"warning job_normalization: rule 2 is unreachable: rule 1 matches the same jobs first"},
+		},
+		{
+			name: "job normalization shadowed with another label",
+			config: `job_normalization:
+  - {job: batch, suffix: timestamp, label: run}
+  - {job: batch, suffix: timestamp, label: started}
+`,
+			want: []string{"warning job_normalization: rule 2 is shadowed by rule 1, which matches the same jobs first; it only applies to pushes whose grouping key already has run"},
+		},
+		{
+			name: "job normalization for other jobs or suffixes",
+			config: `job_normalization:
+  - {job: batch, suffix: timestamp, label: run}
+  - {job: nightly, suffix: timestamp, label: run}
+  - {job: batch, suffix: uuid, label: run}
+`,
+		},
+		{
+			name: "deprecation shadowed",
+			config: `deprecations:
+  - {metric: 'legacy_*'}
+  - {metric: legacy_total}
+`,
+			want: []string{"warning deprecations: deprecation of legacy_total is unreachable: legacy_* matches it first"},
+		},
+		{
+			name: "rename to a deprecated metric",
+			config: `renames: [{from: a_total, to: legacy_total}]
+deprecations: [{metric: 'legacy_*'}]
+`,
+			want: []string{"warning renames: a_total is renamed to legacy_total, which is deprecated by legacy_*"},
+		},
+		{
+			name: "layout of the old name",
+			config: `renames: [{from: a_seconds, to: b_seconds}]
+histogram_layouts: [{metric: a_seconds, buckets: [1, 2]}]
+`,
+			want: []string{"warning histogram_layouts: layout of a_seconds stops applying when it is renamed to b_seconds; add a layout for b_seconds"},
+		},
+		{
+			name: "canary of a warning rule",
+			config: `canary:
+  identity_label: userid
+  rules: {untyped_metrics: 10}
+`,
+			want: []string{"warning canary: rolling out untyped_metrics has no effect: the rule only warns as configured"},
+		},
+		{
+			name:   "missing directory",
+			config: "delta_push: {jobs: [s], state_file: missing/deltas.json}\n",
+			want:   []string{"error delta_push: directory of DIR/missing/deltas.json does not exist"},
+		},
+		{
+			name:   "gateway scrape job",
+			config: "gateways: [{address: 'gw:9091', auth: tls}]\n",
+			scrape: `
+scrape_configs:
+  - job_name: gateway
+    scheme: https
+    tls_config: {cert_file: client.crt, key_file: client.key}
+    static_configs: [{targets: ['gw:9091']}]
+`,
+			want: []string{
+				`error scrape_config: job "gateway": honor_labels is not true: pushed job and instance labels will be renamed to exported_job and exported_instance`,
+				`error scrape_config: job "gateway": open DIR/client.crt: no such file or directory`,
+				`error scrape_config: job "gateway": open DIR/client.key: no such file or directory`,
+			},
+		},
+		{
+			name:   "invalid scrape config",
+			scrape: "scrape_configs: [{job_name: a, honour_labels: true}]\n",
+			want:   []string{"error scrape_config: parsing YAML file DIR/prometheus.yml: yaml: unmarshal errors:\n  line 1: field honour_labels not found in type config.ScrapeConfig"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "metriclint.yml")
+			if err := os.WriteFile(file, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			scrape := ""
+			if tt.scrape != "" {
+				scrape = filepath.Join(dir, "prometheus.yml")
+				if err := os.WriteFile(scrape, []byte(tt.scrape), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			report, err := checkConfig(file, scrape)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range report.Findings {
+				got = append(got, f.Severity+" "+f.Section+": "+strings.ReplaceAll(f.Text, dir, "DIR"))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("findings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
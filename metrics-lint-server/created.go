@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// Policies for the _created companion series that prometheus_client exposes
+// next to counters, histograms and summaries.
+const (
+	createdKeep    = "keep"
+	createdDrop    = "drop"
+	createdConvert = "convert"
+)
+
+// createdPolicy applies the configured handling of _created series.
+type createdPolicy struct {
+	mode string
+}
+
+func newCreatedPolicy(mode string) (*createdPolicy, error) {
+	switch mode {
+	case "":
+		mode = createdKeep
+	case createdKeep, createdDrop, createdConvert:
+	default:
+		return nil, fmt.Errorf("unknown created_series policy %q, expected keep, drop or convert", mode)
+	}
+	return &createdPolicy{mode: mode}, nil
+}
+
+// Mode returns the effective policy: keep, drop or convert.
+func (p *createdPolicy) Mode() string {
+	return p.mode
+}
+
+// Apply drops or converts companion series according to the policy and
+// returns the remaining families in a new slice. convert moves each _created
+// value into the created timestamp of the matching parent series, which only
+// the protobuf format can carry; forceProto reports that the push must be
+// forwarded as protobuf. Converted parents are copies, so the caller's
+// families are left unchanged.
+func (p *createdPolicy) Apply(families []*dto.MetricFamily) (out []*dto.MetricFamily, changed, forceProto bool) {
+	if p.mode == createdKeep {
+		return families, false, false
+	}
+	companions, _ := lint.CreatedCompanions(families)
+	if len(companions) == 0 {
+		return families, false, false
+	}
+
+	created := map[string]*dto.MetricFamily{}
+	if p.mode == createdConvert {
+		for _, mf := range families {
+			if parent, ok := companions[mf.GetName()]; ok {
+				created[parent.GetName()] = mf
+			}
+		}
+	}
+	out = make([]*dto.MetricFamily, 0, len(families)-len(companions))
+	for _, mf := range families {
+		if _, ok := companions[mf.GetName()]; ok {
+			continue
+		}
+		if c, ok := created[mf.GetName()]; ok {
+			mf = proto.Clone(mf).(*dto.MetricFamily)
+			setCreatedTimestamps(mf, c)
+		}
+		out = append(out, mf)
+	}
+	return out, true, p.mode == createdConvert
+}
+
+func setCreatedTimestamps(parent, created *dto.MetricFamily) {
+	values := map[string]float64{}
+	for _, m := range created.GetMetric() {
+		v := m.GetGauge().GetValue()
+		if created.GetType() == dto.MetricType_UNTYPED {
+			v = m.GetUntyped().GetValue()
+		}
+		values[lint.SeriesKey(m)] = v
+	}
+	for _, m := range parent.GetMetric() {
+		v, ok := values[lint.SeriesKey(m)]
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		sec, frac := math.Modf(v)
+		ts := &timestamppb.Timestamp{Seconds: int64(sec), Nanos: int32(frac * 1e9)}
+		switch {
+		case m.Counter != nil:
+			m.Counter.CreatedTimestamp = ts
+		case m.Histogram != nil:
+			m.Histogram.CreatedTimestamp = ts
+		case m.Summary != nil:
+			m.Summary.CreatedTimestamp = ts
+		}
+	}
+}
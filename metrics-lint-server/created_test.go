@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCreatedPolicy(t *testing.T) {
+	const input = `
+# HELP jobs_total Jobs.
+# TYPE jobs_total counter
+jobs_total 3
+# HELP jobs_created Jobs.
+# TYPE jobs_created gauge
+jobs_created 1.7e+09
+# TYPE queue gauge
+queue 1
+`
+	tests := []struct {
+		mode          string
+		want          string
+		wantForce     bool
+		wantCreatedTS int64
+	}{
+		{mode: createdKeep, want: "jobs_created jobs_total queue"},
+		{mode: createdDrop, want: "jobs_total queue"},
+		{mode: createdConvert, want: "jobs_total queue", wantForce: true, wantCreatedTS: 1700000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			p, err := newCreatedPolicy(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			families := parseFamilies(t, input)
+			before := formatFamilies(t, families)
+
+			out, _, force := p.Apply(families)
+			var names string
+			for i, mf := range out {
+				if i > 0 {
+					names += " "
+				}
+				names += mf.GetName()
+			}
+			if names != tt.want || force != tt.wantForce {
+				t.Errorf("got %q, forceProto %v, want %q, %v", names, force, tt.want, tt.wantForce)
+			}
+			if got := out[len(out)-2].GetMetric()[0].GetCounter().GetCreatedTimestamp().GetSeconds(); got != tt.wantCreatedTS {
+				t.Errorf("created timestamp %d, want %d", got, tt.wantCreatedTS)
+			}
+
+			// The caller's families are left as they were.
+			if after := formatFamilies(t, families); after != before {
+				t.Errorf("caller's families changed to\n%s", after)
+			}
+			for _, mf := range families {
+				if mf.GetName() == "jobs_total" && mf.GetMetric()[0].GetCounter().GetCreatedTimestamp() != nil {
+					t.Error("caller's counter got a created timestamp")
+				}
+			}
+		})
+	}
+}
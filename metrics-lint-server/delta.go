@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// DeltaPush enables delta mode for short-lived clients: their counter and
+// histogram values are increments that the proxy adds up per group and
+// forwards as cumulative values.
+type DeltaPush struct {
+	// Jobs lists regular expressions matched against the whole job label
+	// of pushes in delta mode.
+	Jobs []string `yaml:"jobs"`
+	// StateFile is where the accumulated values are persisted, with a
+	// journal of recent pushes next to it. Relative paths are resolved
+	// against the directory of the config file.
+	StateFile string `yaml:"state_file"`
+}
+
+// deltaJournalCompaction is the number of journaled commits after which the
+// state file is rewritten and the journal truncated.
+const deltaJournalCompaction = 1000
+
+// deltaGroup is the accumulated state of one grouping key. It is also the
+// record format of the state file and its journal.
+type deltaGroup struct {
+	Labels model.LabelSet `json:"labels"`
+	// Families holds the accumulated families in the delimited protobuf
+	// format. It is guarded by the accumulator's fileMu; a journal record
+	// without families resets the group.
+	Families []byte `json:"families"`
+
+	mu       sync.Mutex
+	families []*dto.MetricFamily
+}
+
+// deltaAccumulator adds up delta pushes per grouping key. Each group has its
+// own lock, which a push holds from accumulating its increments through
+// forwarding the cumulative values to committing them, so pushes to a group
+// are forwarded one at a time and the gateway never sees a cumulative value
+// go down. A push's increments are committed once the gateway accepted the
+// cumulative push, so a retried push is not counted twice.
+//
+// Commits are appended to a journal next to the state file, which is only
+// rewritten every deltaJournalCompaction commits.
+type deltaAccumulator struct {
+	jobs      []*regexp.Regexp
+	stateFile string
+
+	mu     sync.Mutex
+	groups map[string]*deltaGroup
+
+	fileMu    sync.Mutex
+	journal   *os.File
+	journaled int
+}
+
+func newDeltaAccumulator(cfg DeltaPush) (*deltaAccumulator, error) {
+	a := &deltaAccumulator{stateFile: cfg.StateFile, groups: map[string]*deltaGroup{}}
+	for _, pattern := range cfg.Jobs {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("delta push: invalid job pattern %q: %v", pattern, err)
+		}
+		a.jobs = append(a.jobs, re)
+	}
+	if len(a.jobs) == 0 {
+		return a, nil
+	}
+	if a.stateFile == "" {
+		return nil, fmt.Errorf("delta push: state_file is required")
+	}
+	if err := a.load(); err != nil {
+		return nil, fmt.Errorf("delta push: loading %s: %v", a.stateFile, err)
+	}
+	return a, nil
+}
+
+// Enabled reports whether pushes to the grouping key are deltas.
+func (a *deltaAccumulator) Enabled(labels model.LabelSet) bool {
+	for _, re := range a.jobs {
+		if re.MatchString(string(labels[model.JobLabel])) {
+			return true
+		}
+	}
+	return false
+}
+
+// group returns the state of the grouping key, creating it if needed.
+func (a *deltaAccumulator) group(labels model.LabelSet) *deltaGroup {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.groups[labels.String()]
+	if !ok {
+		g = &deltaGroup{Labels: labels}
+		a.groups[labels.String()] = g
+	}
+	return g
+}
+
+// deltaTxn is an accumulation in progress. It holds its group's lock until
+// it is closed.
+type deltaTxn struct {
+	a          *deltaAccumulator
+	group      *deltaGroup
+	increments []*dto.MetricFamily
+	closed     bool
+}
+
+// Begin starts accumulating a push to the grouping key, waiting for pushes
+// to the group in progress to finish. The caller must Close the transaction.
+func (a *deltaAccumulator) Begin(labels model.LabelSet) *deltaTxn {
+	g := a.group(labels)
+	g.mu.Lock()
+	return &deltaTxn{a: a, group: g}
+}
+
+// Close ends the transaction and lets the next push to the group begin.
+// Increments not committed are dropped. Closing twice is a no-op.
+func (t *deltaTxn) Close() {
+	if !t.closed {
+		t.closed = true
+		t.group.mu.Unlock()
+	}
+}
+
+// Accumulate adds the counters and histograms of the push to the group's
+// state and returns the families to forward: the other families of the push
+// as they are, plus the cumulative value of every family accumulated for the
+// group so far, so a PUT does not drop families from earlier sessions. It
+// returns the names of the accumulated families of the push. The group's
+// state is not changed until Commit.
+func (t *deltaTxn) Accumulate(families []*dto.MetricFamily) ([]*dto.MetricFamily, []string, error) {
+	state := cloneDeltaState(t.group.families)
+
+	out, accumulated, err := addFamilies(state, families)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.increments = t.increments[:0]
+	for _, mf := range families {
+		if isDeltaType(mf) {
+			t.increments = append(t.increments, mf)
+		}
+	}
+	for _, acc := range state {
+		out = append(out, acc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out, accumulated, nil
+}
+
+// Commit adds the increments of the push to the group's state and persists
+// it.
+func (t *deltaTxn) Commit() error {
+	g := t.group
+	state := cloneDeltaState(g.families)
+	if _, _, err := addFamilies(state, t.increments); err != nil {
+		return err
+	}
+	families := make([]*dto.MetricFamily, 0, len(state))
+	for _, acc := range state {
+		families = append(families, acc)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	encoded, err := encodeFamilies(families, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	if err != nil {
+		return err
+	}
+	g.families = families
+	return t.a.persist(g, encoded)
+}
+
+// Reset forgets the accumulated state of a deleted group.
+func (t *deltaTxn) Reset() error {
+	g := t.group
+	if len(g.families) == 0 {
+		return nil
+	}
+	g.families = nil
+	return t.a.persist(g, nil)
+}
+
+func isDeltaType(mf *dto.MetricFamily) bool {
+	return mf.GetType() == dto.MetricType_COUNTER || mf.GetType() == dto.MetricType_HISTOGRAM
+}
+
+// cloneDeltaState returns a copy of accumulated families by name.
+func cloneDeltaState(families []*dto.MetricFamily) map[string]*dto.MetricFamily {
+	state := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		state[mf.GetName()] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return state
+}
+
+// addFamilies adds the counters and histograms among families to state. It
+// returns the other families and the names of the added ones.
+func addFamilies(state map[string]*dto.MetricFamily, families []*dto.MetricFamily) ([]*dto.MetricFamily, []string, error) {
+	var rest []*dto.MetricFamily
+	var added []string
+	for _, mf := range families {
+		acc, ok := state[mf.GetName()]
+		if ok && acc.GetType() != mf.GetType() {
+			return nil, nil, fmt.Errorf("%s: pushed as %s but accumulated as %s", mf.GetName(),
+				strings.ToLower(mf.GetType().String()), strings.ToLower(acc.GetType().String()))
+		}
+		if !isDeltaType(mf) {
+			rest = append(rest, mf)
+			continue
+		}
+		if !ok {
+			acc = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			state[mf.GetName()] = acc
+		}
+		if err := addDeltas(acc, mf); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", mf.GetName(), err)
+		}
+		added = append(added, mf.GetName())
+	}
+	return rest, added, nil
+}
+
+// addDeltas adds every series of delta to the matching series of acc.
+func addDeltas(acc, delta *dto.MetricFamily) error {
+	series := make(map[string]*dto.Metric, len(acc.GetMetric()))
+	for _, m := range acc.GetMetric() {
+		series[lint.SeriesKey(m)] = m
+	}
+	for _, m := range delta.GetMetric() {
+		if m.GetCounter().GetValue() < 0 {
+			return fmt.Errorf("negative counter delta %v for %s", m.GetCounter().GetValue(), lint.LabelPairsString(m.GetLabel()))
+		}
+		into, ok := series[lint.SeriesKey(m)]
+		if !ok {
+			into = &dto.Metric{Label: m.Label}
+			switch delta.GetType() {
+			case dto.MetricType_COUNTER:
+				into.Counter = &dto.Counter{Value: proto.Float64(0)}
+			case dto.MetricType_HISTOGRAM:
+				into.Histogram = emptyHistogram(m.GetHistogram())
+			}
+			series[lint.SeriesKey(m)] = into
+			acc.Metric = append(acc.Metric, into)
+		}
+		switch delta.GetType() {
+		case dto.MetricType_COUNTER:
+			into.Counter.Value = proto.Float64(into.GetCounter().GetValue() + m.GetCounter().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			if err := lint.MergeHistograms(into.GetHistogram(), m.GetHistogram()); err != nil {
+				return fmt.Errorf("%s: %v", lint.LabelPairsString(m.GetLabel()), err)
+			}
+		}
+	}
+	return nil
+}
+
+// emptyHistogram returns a histogram with the bucket layout of h and no
+// observations.
+func emptyHistogram(h *dto.Histogram) *dto.Histogram {
+	empty := &dto.Histogram{SampleCount: proto.Uint64(0), SampleSum: proto.Float64(0)}
+	for _, b := range h.GetBucket() {
+		empty.Bucket = append(empty.Bucket, &dto.Bucket{UpperBound: b.UpperBound, CumulativeCount: proto.Uint64(0)})
+	}
+	return empty
+}
+
+func (a *deltaAccumulator) journalFile() string {
+	return a.stateFile + ".journal"
+}
+
+// load reads the state file and replays the journal over it. The last record
+// of a group wins. A line that does not decode is what a crash in the middle
+// of a write leaves behind and is skipped.
+func (a *deltaAccumulator) load() error {
+	var groups []*deltaGroup
+	data, err := os.ReadFile(a.stateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &groups); err != nil {
+			return err
+		}
+	}
+
+	journal, err := os.ReadFile(a.journalFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, line := range bytes.Split(journal, []byte("\n")) {
+		g := &deltaGroup{}
+		if len(line) == 0 || json.Unmarshal(line, g) != nil {
+			continue
+		}
+		groups = append(groups, g)
+		a.journaled++
+	}
+
+	for _, g := range groups {
+		if len(g.Families) == 0 {
+			delete(a.groups, g.Labels.String())
+			continue
+		}
+		if g.families, err = lint.DecodeFamilies(bytes.NewReader(g.Families), expfmt.NewFormat(expfmt.TypeProtoDelim)); err != nil {
+			return fmt.Errorf("group %s: %v", g.Labels, err)
+		}
+		a.groups[g.Labels.String()] = g
+	}
+	return nil
+}
+
+// persist appends the group's new state to the journal, compacting the
+// journal into the state file when it has grown long enough.
+func (a *deltaAccumulator) persist(g *deltaGroup, encoded []byte) error {
+	a.fileMu.Lock()
+	defer a.fileMu.Unlock()
+
+	g.Families = encoded
+	line, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	if a.journal == nil {
+		if a.journal, err = os.OpenFile(a.journalFile(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+			return err
+		}
+		// Terminate a record torn by a crash so it stays on its own line.
+		if info, err := a.journal.Stat(); err == nil && info.Size() > 0 {
+			line = append([]byte("\n"), line...)
+		}
+	}
+	if _, err := a.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if a.journaled++; a.journaled >= deltaJournalCompaction {
+		return a.compact()
+	}
+	return nil
+}
+
+// compact writes the state of every group to a temporary file, renames it
+// over the state file, so a crash never leaves a truncated state behind, and
+// then empties the journal. The caller holds fileMu.
+func (a *deltaAccumulator) compact() error {
+	a.mu.Lock()
+	keys := make([]string, 0, len(a.groups))
+	for k, g := range a.groups {
+		if len(g.Families) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	groups := make([]*deltaGroup, 0, len(keys))
+	for _, k := range keys {
+		groups = append(groups, a.groups[k])
+	}
+	a.mu.Unlock()
+
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.stateFile), filepath.Base(a.stateFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.stateFile); err != nil {
+		return err
+	}
+	// Replaying the journal over the new state file is harmless, so a crash
+	// before the truncation loses nothing.
+	if err := a.journal.Truncate(0); err != nil {
+		return err
+	}
+	a.journaled = 0
+	return nil
+}
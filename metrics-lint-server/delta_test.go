@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func newTestDeltas(t *testing.T, stateFile string) *deltaAccumulator {
+	t.Helper()
+	a, err := newDeltaAccumulator(DeltaPush{Jobs: []string{"session-.*"}, StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// pushDelta accumulates and commits one push and returns the forwarded
+// families in the text format.
+func pushDelta(t *testing.T, a *deltaAccumulator, labels model.LabelSet, text string) string {
+	t.Helper()
+	txn := a.Begin(labels)
+	defer txn.Close()
+	families, _, err := txn.Accumulate(parseFamilies(t, text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return formatFamilies(t, families)
+}
+
+func TestDeltaAccumulate(t *testing.T) {
+	tests := []struct {
+		name    string
+		pushes  []string
+		want    string // forwarded after the last push
+		wantErr string
+	}{
+		{
+			name: "counters are summed",
+			pushes: []string{
+				"# TYPE jobs_total counter\njobs_total{kind=\"a\"} 2\n",
+				"# TYPE jobs_total counter\njobs_total{kind=\"a\"} 3\njobs_total{kind=\"b\"} 1\n",
+			},
+			want: "# TYPE jobs_total counter\njobs_total{kind=\"a\"} 5\njobs_total{kind=\"b\"} 1\n",
+		},
+		{
+			name: "histograms are summed",
+			pushes: []string{
+				"# TYPE d_seconds histogram\nd_seconds_bucket{le=\"1\"} 1\nd_seconds_bucket{le=\"+Inf\"} 2\nd_seconds_sum 3\nd_seconds_count 2\n",
+				"# TYPE d_seconds histogram\nd_seconds_bucket{le=\"1\"} 2\nd_seconds_bucket{le=\"+Inf\"} 2\nd_seconds_sum 1\nd_seconds_count 2\n",
+			},
+			want: "# TYPE d_seconds histogram\nd_seconds_bucket{le=\"1\"} 3\nd_seconds_bucket{le=\"+Inf\"} 4\nd_seconds_sum 4\nd_seconds_count 4\n",
+		},
+		{
+			name: "gauges are forwarded as pushed and earlier families kept",
+			pushes: []string{
+				"# TYPE jobs_total counter\njobs_total 2\n",
+				"# TYPE temp gauge\ntemp 7\n",
+			},
+			want: "# TYPE jobs_total counter\njobs_total 2\n# TYPE temp gauge\ntemp 7\n",
+		},
+		{
+			name: "negative counter deltas",
+			pushes: []string{
+				"# TYPE jobs_total counter\njobs_total -1\n",
+			},
+			wantErr: "negative counter delta",
+		},
+		{
+			name: "type changes",
+			pushes: []string{
+				"# TYPE jobs_total counter\njobs_total 1\n",
+				"# TYPE jobs_total gauge\njobs_total 1\n",
+			},
+			wantErr: "pushed as gauge but accumulated as counter",
+		},
+		{
+			name: "bucket changes",
+			pushes: []string{
+				"# TYPE d_seconds histogram\nd_seconds_bucket{le=\"1\"} 1\nd_seconds_bucket{le=\"+Inf\"} 1\nd_seconds_sum 1\nd_seconds_count 1\n",
+				"# TYPE d_seconds histogram\nd_seconds_bucket{le=\"2\"} 1\nd_seconds_bucket{le=\"+Inf\"} 1\nd_seconds_sum 1\nd_seconds_count 1\n",
+			},
+			wantErr: "d_seconds",
+		},
+	}
+	labels := model.LabelSet{"job": "session-1"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestDeltas(t, filepath.Join(t.TempDir(), "deltas.json"))
+			var got string
+			for i, push := range tt.pushes {
+				txn := a.Begin(labels)
+				families, _, err := txn.Accumulate(parseFamilies(t, push))
+				if err != nil {
+					txn.Close()
+					if tt.wantErr == "" || i != len(tt.pushes)-1 || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("push %d: error %v, want %q", i+1, err, tt.wantErr)
+					}
+					return
+				}
+				if err := txn.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				txn.Close()
+				got = formatFamilies(t, families)
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("no error, want %q", tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeltaUncommittedPush(t *testing.T) {
+	a := newTestDeltas(t, filepath.Join(t.TempDir(), "deltas.json"))
+	labels := model.LabelSet{"job": "session-1"}
+	pushDelta(t, a, labels, "# TYPE jobs_total counter\njobs_total 2\n")
+
+	// The gateway refused this push, so it is not committed.
+	txn := a.Begin(labels)
+	if _, _, err := txn.Accumulate(parseFamilies(t, "# TYPE jobs_total counter\njobs_total 5\n")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Close()
+	got := pushDelta(t, a, labels, "# TYPE jobs_total counter\njobs_total 1\n")
+	if want := "# TYPE jobs_total counter\njobs_total 3\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDeltaConcurrentPushes(t *testing.T) {
+	a := newTestDeltas(t, filepath.Join(t.TempDir(), "deltas.json"))
+	labels := model.LabelSet{"job": "session-1"}
+
+	// Pushes with different increments race to the gateway, which records
+	// the cumulative values in the order it receives them. They must never
+	// go down, and no increment may be lost.
+	var mu sync.Mutex
+	var forwarded []float64
+	var wg sync.WaitGroup
+	const pushes = 50
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txn := a.Begin(labels)
+			defer txn.Close()
+			families, _, err := txn.Accumulate(parseFamilies(t, fmt.Sprintf("# TYPE jobs_total counter\njobs_total %d\n", pushes-i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			forwarded = append(forwarded, families[0].GetMetric()[0].GetCounter().GetValue())
+			mu.Unlock()
+			runtime.Gosched()
+			if err := txn.Commit(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 1; i < len(forwarded); i++ {
+		if forwarded[i] < forwarded[i-1] {
+			t.Fatalf("gateway saw the counter go from %g down to %g", forwarded[i-1], forwarded[i])
+		}
+	}
+	if want := float64(pushes * (pushes + 1) / 2); forwarded[len(forwarded)-1] != want {
+		t.Errorf("last forwarded value %g, want %g", forwarded[len(forwarded)-1], want)
+	}
+}
+
+func TestDeltaStatePersisted(t *testing.T) {
+	tests := []struct {
+		name    string
+		pushes  int
+		reset   bool
+		torn    bool
+		want    string
+		compact bool
+	}{
+		{name: "replayed from the journal", pushes: 3, want: "jobs_total 3"},
+		{name: "compacted into the state file", pushes: deltaJournalCompaction + 2, want: "jobs_total 1002", compact: true},
+		{name: "reset", pushes: 2, reset: true, want: ""},
+		{name: "torn journal record", pushes: 2, torn: true, want: "jobs_total 3"},
+	}
+	batch := model.LabelSet{"job": "session-1"}
+	other := model.LabelSet{"job": "session-2"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), "deltas.json")
+			a := newTestDeltas(t, stateFile)
+			pushDelta(t, a, other, "# TYPE other_total counter\nother_total 4\n")
+			for i := 0; i < tt.pushes; i++ {
+				pushDelta(t, a, batch, "# TYPE jobs_total counter\njobs_total 1\n")
+			}
+			if tt.reset {
+				txn := a.Begin(batch)
+				if err := txn.Reset(); err != nil {
+					t.Fatal(err)
+				}
+				txn.Close()
+			}
+			if tt.torn {
+				f, err := os.OpenFile(stateFile+".journal", os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(`{"labels":{"job":"session-1"},"fam`)
+				f.Close()
+			}
+
+			_, err := os.Stat(stateFile)
+			if compacted := err == nil; compacted != tt.compact {
+				t.Errorf("state file written = %v, want %v", compacted, tt.compact)
+			}
+
+			reloaded := newTestDeltas(t, stateFile)
+			if tt.torn {
+				// Records written after a torn one are still read.
+				pushDelta(t, reloaded, batch, "# TYPE jobs_total counter\njobs_total 1\n")
+				reloaded = newTestDeltas(t, stateFile)
+			}
+			got := pushDelta(t, reloaded, batch, "# TYPE jobs_total counter\njobs_total 0\n")
+			want := "# TYPE jobs_total counter\n" + tt.want + "\n"
+			if tt.want == "" {
+				want = "# TYPE jobs_total counter\njobs_total 0\n"
+			}
+			if got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+			if got := pushDelta(t, reloaded, other, "# TYPE other_total counter\nother_total 0\n"); got != "# TYPE other_total counter\nother_total 4\n" {
+				t.Errorf("other group got\n%s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// DeprecatedClient is a grouping key that pushed deprecated metrics.
+type DeprecatedClient struct {
+	GroupingKey string    `json:"grouping_key"`
+	Metrics     []string  `json:"metrics"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// DeprecationStatus reports which clients still emit a deprecated metric.
+type DeprecationStatus struct {
+	Metric      string             `json:"metric"`
+	Replacement string             `json:"replacement,omitempty"`
+	Sunset      *time.Time         `json:"sunset,omitempty"`
+	Sunsetted   bool               `json:"sunsetted"`
+	Clients     []DeprecatedClient `json:"clients"`
+}
+
+// DeprecationReport lists the deprecations and their remaining clients.
+type DeprecationReport struct {
+	Status       string              `json:"status"`
+	Message      string              `json:"message,omitempty"`
+	Deprecations []DeprecationStatus `json:"deprecations"`
+}
+
+type deprecatedClient struct {
+	labels   model.LabelSet
+	metrics  map[string]bool
+	lastSeen time.Time
+}
+
+// deprecationRegistry enforces the deprecations and remembers which clients
+// pushed deprecated metrics since the server started.
+type deprecationRegistry struct {
+	*lint.DeprecationPolicy
+
+	mu      sync.Mutex
+	clients map[*lint.Deprecation]map[string]*deprecatedClient
+}
+
+func newDeprecationRegistry(deprecations []lint.Deprecation) (*deprecationRegistry, error) {
+	policy, err := lint.NewDeprecationPolicy(deprecations)
+	if err != nil {
+		return nil, err
+	}
+	return &deprecationRegistry{DeprecationPolicy: policy, clients: map[*lint.Deprecation]map[string]*deprecatedClient{}}, nil
+}
+
+// Record remembers that the grouping key pushed the deprecated metrics
+// named. It is called once the push was accepted, so rejected pushes do not
+// count as clients.
+func (d *deprecationRegistry) Record(groupLabels model.LabelSet, names []string, now time.Time) {
+	if len(names) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := groupLabels.String()
+	for _, name := range names {
+		dep := d.Match(name)
+		if dep == nil {
+			continue
+		}
+		clients, ok := d.clients[dep]
+		if !ok {
+			clients = map[string]*deprecatedClient{}
+			d.clients[dep] = clients
+		}
+		c, ok := clients[key]
+		if !ok {
+			c = &deprecatedClient{labels: groupLabels, metrics: map[string]bool{}}
+			clients[key] = c
+		}
+		c.metrics[name] = true
+		c.lastSeen = now
+	}
+}
+
+// Status returns every deprecation with the clients that pushed matching
+// metrics, the most recently seen first.
+func (d *deprecationRegistry) Status(now time.Time) []DeprecationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deprecations := d.Deprecations()
+	statuses := make([]DeprecationStatus, 0, len(deprecations))
+	for _, dep := range deprecations {
+		s := DeprecationStatus{
+			Metric:      dep.Metric,
+			Replacement: dep.Replacement,
+			Sunsetted:   dep.Sunsetted(now),
+			Clients:     make([]DeprecatedClient, 0, len(d.clients[dep])),
+		}
+		if !dep.Sunset.IsZero() {
+			sunset := dep.Sunset
+			s.Sunset = &sunset
+		}
+		for _, c := range d.clients[dep] {
+			metrics := make([]string, 0, len(c.metrics))
+			for name := range c.metrics {
+				metrics = append(metrics, name)
+			}
+			sort.Strings(metrics)
+			s.Clients = append(s.Clients, DeprecatedClient{GroupingKey: c.labels.String(), Metrics: metrics, LastSeen: c.lastSeen})
+		}
+		sort.Slice(s.Clients, func(i, j int) bool {
+			if !s.Clients[i].LastSeen.Equal(s.Clients[j].LastSeen) {
+				return s.Clients[i].LastSeen.After(s.Clients[j].LastSeen)
+			}
+			return s.Clients[i].GroupingKey < s.Clients[j].GroupingKey
+		})
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+var deprecatedClientsDesc = prometheus.NewDesc(
+	"metriclint_deprecated_metric_clients",
+	"Number of grouping keys that pushed metrics matching a deprecation since the server started.",
+	[]string{"deprecation"}, nil,
+)
+
+// Describe implements prometheus.Collector.
+func (d *deprecationRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deprecatedClientsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (d *deprecationRegistry) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range d.Status(time.Now()) {
+		ch <- prometheus.MustNewConstMetric(deprecatedClientsDesc, prometheus.GaugeValue, float64(len(s.Clients)), s.Metric)
+	}
+}
+
+// handleDeprecations reports which clients still emit deprecated metrics.
+func handleDeprecations(deprecations *deprecationRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed. Use GET.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		statuses := deprecations.Status(time.Now())
+		clients := map[string]bool{}
+		for _, s := range statuses {
+			for _, c := range s.Clients {
+				clients[c.GroupingKey] = true
+			}
+		}
+		report := DeprecationReport{Status: "success", Message: "No client pushed deprecated metrics.", Deprecations: statuses}
+		if len(clients) > 0 {
+			report.Status = "warning"
+			report.Message = fmt.Sprintf("%d clients still push deprecated metrics", len(clients))
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
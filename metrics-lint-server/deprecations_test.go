@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+func TestDeprecationsRecord(t *testing.T) {
+	d, err := newDeprecationRegistry([]lint.Deprecation{{Metric: "legacy_*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	families := parseFamilies(t, "# TYPE legacy_total counter\nlegacy_total 1\n# TYPE up gauge\nup 1\n")
+	batch := model.LabelSet{"job": "batch"}
+	d.Record(batch, d.Deprecated(families), now)
+	d.Record(model.LabelSet{"job": "other"}, d.Deprecated(families[1:]), now)
+
+	clients := d.Status(now)[0].Clients
+	if len(clients) != 1 || clients[0].GroupingKey != batch.String() || strings.Join(clients[0].Metrics, ",") != "legacy_total" {
+		t.Errorf("clients %+v, want batch pushing legacy_total", clients)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// ExpectedPusher describes a client that should push at a regular cadence.
+type ExpectedPusher struct {
+	// Name identifies the entry in reports and metrics. Defaults to Job.
+	Name string `yaml:"name"`
+	// Job is a regular expression matched against the whole job label.
+	Job string `yaml:"job"`
+	// GroupingKey optionally restricts the entry to pushes whose other
+	// grouping labels match these regular expressions.
+	GroupingKey map[string]string `yaml:"grouping_key"`
+	// Cadence is how often the client is expected to push successfully.
+	Cadence model.Duration `yaml:"cadence"`
+	// Grace is added to the cadence before the client counts as overdue.
+	Grace model.Duration `yaml:"grace"`
+}
+
+// States of an expected pusher.
+const (
+	expectedOnTime  = "on_time"
+	expectedOverdue = "overdue"
+	expectedUnknown = "unknown"
+)
+
+// ExpectedPushStatus reports when an expected pusher last pushed and whether
+// it is overdue. State is unknown while the pusher has not pushed since the
+// server started and its cadence has not passed since then either.
+type ExpectedPushStatus struct {
+	Name           string            `json:"name"`
+	Job            string            `json:"job"`
+	GroupingKey    map[string]string `json:"grouping_key,omitempty"`
+	Cadence        string            `json:"cadence"`
+	LastPush       *time.Time        `json:"last_push,omitempty"`
+	LastPushKey    string            `json:"last_push_grouping_key,omitempty"`
+	State          string            `json:"state"`
+	Overdue        bool              `json:"overdue"`
+	OverdueSeconds float64           `json:"overdue_seconds"`
+}
+
+// ExpectedReport lists the expected pushers, overdue ones first.
+type ExpectedReport struct {
+	Status  string               `json:"status"`
+	Message string               `json:"message,omitempty"`
+	Pushers []ExpectedPushStatus `json:"pushers"`
+}
+
+type expectedEntry struct {
+	ExpectedPusher
+	job      *regexp.Regexp
+	key      map[model.LabelName]*regexp.Regexp
+	lastPush time.Time
+	lastKey  model.LabelSet
+}
+
+func (e *expectedEntry) matches(labels model.LabelSet) bool {
+	if !e.job.MatchString(string(labels[model.JobLabel])) {
+		return false
+	}
+	for ln, re := range e.key {
+		if !re.MatchString(string(labels[ln])) {
+			return false
+		}
+	}
+	return true
+}
+
+// pushTracker remembers the last successful push of every expected pusher.
+// Pushes are only remembered in memory, so after a restart an entry's state
+// is unknown until it pushes or its cadence and grace have passed since the
+// start, after which it is overdue.
+type pushTracker struct {
+	mu      sync.Mutex
+	started time.Time
+	entries []*expectedEntry
+}
+
+func newPushTracker(pushers []ExpectedPusher, started time.Time) (*pushTracker, error) {
+	t := &pushTracker{started: started}
+	names := map[string]bool{}
+	for i, p := range pushers {
+		if p.Name == "" {
+			p.Name = p.Job
+		}
+		if p.Job == "" {
+			return nil, fmt.Errorf("expected pusher %d: job pattern is required", i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("expected pusher %d: duplicate name %q", i+1, p.Name)
+		}
+		names[p.Name] = true
+		if p.Cadence <= 0 {
+			return nil, fmt.Errorf("expected pusher %q: cadence must be positive", p.Name)
+		}
+
+		e := &expectedEntry{ExpectedPusher: p, key: map[model.LabelName]*regexp.Regexp{}}
+		var err error
+		if e.job, err = regexp.Compile("^(?:" + p.Job + ")$"); err != nil {
+			return nil, fmt.Errorf("expected pusher %q: invalid job pattern: %v", p.Name, err)
+		}
+		for ln, pattern := range p.GroupingKey {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("expected pusher %q: invalid pattern for %s: %v", p.Name, ln, err)
+			}
+			e.key[model.LabelName(ln)] = re
+		}
+		t.entries = append(t.entries, e)
+	}
+	return t, nil
+}
+
+// Observe records a successful push for every entry matching the grouping key.
+func (t *pushTracker) Observe(labels model.LabelSet, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, e := range t.entries {
+		if e.matches(labels) && at.After(e.lastPush) {
+			e.lastPush = at
+			e.lastKey = labels
+		}
+	}
+}
+
+// Status returns the state of all entries at the given time, overdue entries
+// first and the longest overdue at the top.
+func (t *pushTracker) Status(now time.Time) []ExpectedPushStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]ExpectedPushStatus, 0, len(t.entries))
+	for _, e := range t.entries {
+		s := ExpectedPushStatus{
+			Name:        e.Name,
+			Job:         e.Job,
+			GroupingKey: e.GroupingKey,
+			Cadence:     e.Cadence.String(),
+		}
+		since := t.started
+		if !e.lastPush.IsZero() {
+			last := e.lastPush
+			s.LastPush = &last
+			s.LastPushKey = e.lastKey.String()
+			since = last
+		}
+		deadline := since.Add(time.Duration(e.Cadence) + time.Duration(e.Grace))
+		switch {
+		case now.After(deadline):
+			s.State = expectedOverdue
+			s.Overdue = true
+			s.OverdueSeconds = now.Sub(deadline).Seconds()
+		case s.LastPush == nil:
+			s.State = expectedUnknown
+		default:
+			s.State = expectedOnTime
+		}
+		statuses = append(statuses, s)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].OverdueSeconds != statuses[j].OverdueSeconds {
+			return statuses[i].OverdueSeconds > statuses[j].OverdueSeconds
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+var expectedOverdueDesc = prometheus.NewDesc(
+	"metriclint_expected_push_overdue_seconds",
+	"Seconds an expected pusher is past its cadence plus grace, 0 while on time. Absent while unknown after a restart.",
+	[]string{"expected"}, nil,
+)
+
+var expectedLastPushDesc = prometheus.NewDesc(
+	"metriclint_expected_push_last_success_timestamp_seconds",
+	"Unix time of the last successful push matching an expected pusher, 0 if none since start.",
+	[]string{"expected"}, nil,
+)
+
+// Describe implements prometheus.Collector.
+func (t *pushTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- expectedOverdueDesc
+	ch <- expectedLastPushDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *pushTracker) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range t.Status(time.Now()) {
+		var last float64
+		if s.LastPush != nil {
+			last = unixSeconds(*s.LastPush)
+		}
+		if s.State != expectedUnknown {
+			ch <- prometheus.MustNewConstMetric(expectedOverdueDesc, prometheus.GaugeValue, s.OverdueSeconds, s.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(expectedLastPushDesc, prometheus.GaugeValue, last, s.Name)
+	}
+}
+
+// handleExpected lists expected pushers; ?overdue=true limits the list to
+// overdue ones.
+func handleExpected(tracker *pushTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed. Use GET.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		statuses := tracker.Status(time.Now())
+		overdue, unknown := 0, 0
+		for _, s := range statuses {
+			switch s.State {
+			case expectedOverdue:
+				overdue++
+			case expectedUnknown:
+				unknown++
+			}
+		}
+		if r.URL.Query().Get("overdue") == "true" {
+			statuses = statuses[:overdue]
+		}
+
+		report := ExpectedReport{Status: "success", Message: "All expected clients pushed on time.", Pushers: statuses}
+		switch {
+		case overdue > 0:
+			report.Status = "warning"
+			report.Message = fmt.Sprintf("%d of %d expected clients are overdue", overdue, len(tracker.entries))
+		case unknown > 0:
+			report.Message = fmt.Sprintf("No expected client is overdue, but %d of %d have not pushed since the server started and are unknown until their cadence has passed", unknown, len(tracker.entries))
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
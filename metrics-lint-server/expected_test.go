@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestNewPushTracker(t *testing.T) {
+	tests := []struct {
+		name    string
+		pushers []ExpectedPusher
+		wantErr string
+	}{
+		{name: "valid", pushers: []ExpectedPusher{{Job: "backup", Cadence: model.Duration(time.Hour)}}},
+		{name: "missing job", pushers: []ExpectedPusher{{Name: "x", Cadence: model.Duration(time.Hour)}}, wantErr: "job pattern is required"},
+		{name: "missing cadence", pushers: []ExpectedPusher{{Job: "backup"}}, wantErr: "cadence must be positive"},
+		{name: "invalid job pattern", pushers: []ExpectedPusher{{Job: "(", Cadence: model.Duration(time.Hour)}}, wantErr: "invalid job pattern"},
+		{
+			name:    "invalid grouping key pattern",
+			pushers: []ExpectedPusher{{Job: "backup", GroupingKey: map[string]string{"instance": "["}, Cadence: model.Duration(time.Hour)}},
+			wantErr: "invalid pattern for instance",
+		},
+		{
+			name:    "duplicate name",
+			pushers: []ExpectedPusher{{Job: "backup", Cadence: model.Duration(time.Hour)}, {Job: "backup", Cadence: model.Duration(time.Minute)}},
+			wantErr: `duplicate name "backup"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newPushTracker(tt.pushers, t0)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPushTrackerStatus(t *testing.T) {
+	pushers := []ExpectedPusher{
+		{Name: "backup", Job: "backup-.*", Cadence: model.Duration(time.Hour), Grace: model.Duration(10 * time.Minute)},
+		{Name: "eu-report", Job: "report", GroupingKey: map[string]string{"region": "eu-.*"}, Cadence: model.Duration(time.Hour)},
+	}
+	job := func(name string, labels ...string) model.LabelSet {
+		ls := model.LabelSet{model.JobLabel: model.LabelValue(name)}
+		for i := 0; i < len(labels); i += 2 {
+			ls[model.LabelName(labels[i])] = model.LabelValue(labels[i+1])
+		}
+		return ls
+	}
+
+	tests := []struct {
+		name   string
+		pushes map[time.Duration]model.LabelSet // offset from start
+		at     time.Duration
+		want   map[string]string // name to state
+	}{
+		{
+			name: "unknown after start",
+			at:   30 * time.Minute,
+			want: map[string]string{"backup": expectedUnknown, "eu-report": expectedUnknown},
+		},
+		{
+			name: "overdue once a cadence passed without pushes",
+			at:   65 * time.Minute,
+			want: map[string]string{"backup": expectedUnknown, "eu-report": expectedOverdue},
+		},
+		{
+			name: "grace delays overdue",
+			at:   75 * time.Minute,
+			want: map[string]string{"backup": expectedOverdue, "eu-report": expectedOverdue},
+		},
+		{
+			name:   "on time after a push",
+			pushes: map[time.Duration]model.LabelSet{time.Minute: job("backup-2024"), 2 * time.Minute: job("report", "region", "eu-west")},
+			at:     30 * time.Minute,
+			want:   map[string]string{"backup": expectedOnTime, "eu-report": expectedOnTime},
+		},
+		{
+			name:   "overdue a cadence after the last push",
+			pushes: map[time.Duration]model.LabelSet{time.Minute: job("backup-2024"), 2 * time.Minute: job("report", "region", "eu-west")},
+			at:     3 * time.Hour,
+			want:   map[string]string{"backup": expectedOverdue, "eu-report": expectedOverdue},
+		},
+		{
+			name:   "pushes outside the grouping key don't count",
+			pushes: map[time.Duration]model.LabelSet{time.Minute: job("report", "region", "us-east"), 2 * time.Minute: job("reports")},
+			at:     30 * time.Minute,
+			want:   map[string]string{"backup": expectedUnknown, "eu-report": expectedUnknown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, err := newPushTracker(pushers, t0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for offset, labels := range tt.pushes {
+				tracker.Observe(labels, t0.Add(offset))
+			}
+
+			for _, s := range tracker.Status(t0.Add(tt.at)) {
+				if s.State != tt.want[s.Name] {
+					t.Errorf("%s is %s, want %s", s.Name, s.State, tt.want[s.Name])
+				}
+				if s.Overdue != (s.State == expectedOverdue) || s.Overdue != (s.OverdueSeconds > 0) {
+					t.Errorf("%s: overdue %t with %gs in state %s", s.Name, s.Overdue, s.OverdueSeconds, s.State)
+				}
+			}
+		})
+	}
+}
+
+func TestPushTrackerStatusOrder(t *testing.T) {
+	tracker, err := newPushTracker([]ExpectedPusher{
+		{Job: "a", Cadence: model.Duration(time.Hour)},
+		{Job: "b", Cadence: model.Duration(time.Minute)},
+		{Job: "c", Cadence: model.Duration(10 * time.Minute)},
+	}, t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Observe(model.LabelSet{model.JobLabel: "a"}, t0)
+
+	var names []string
+	for _, s := range tracker.Status(t0.Add(30 * time.Minute)) {
+		names = append(names, s.Name)
+	}
+	if got := strings.Join(names, ","); got != "b,c,a" {
+		t.Errorf("order %s, want the longest overdue first: b,c,a", got)
+	}
+}
+
+func TestPushTrackerCollect(t *testing.T) {
+	now := time.Now()
+	tracker, err := newPushTracker([]ExpectedPusher{
+		{Job: "fresh", Cadence: model.Duration(time.Hour)},
+		{Job: "pushed", Cadence: model.Duration(time.Hour)},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Observe(model.LabelSet{model.JobLabel: "pushed"}, now)
+
+	// The fresh entry is unknown, so it has no overdue series.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(tracker)
+	want := `
+# HELP metriclint_expected_push_overdue_seconds Seconds an expected pusher is past its cadence plus grace, 0 while on time. Absent while unknown after a restart.
+# TYPE metriclint_expected_push_overdue_seconds gauge
+metriclint_expected_push_overdue_seconds{expected="pushed"} 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "metriclint_expected_push_overdue_seconds"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(tracker, "metriclint_expected_push_last_success_timestamp_seconds"); n != 2 {
+		t.Errorf("%d last push series, want 2", n)
+	}
+}
+
+func TestHandleExpected(t *testing.T) {
+	started := time.Now().Add(-2 * time.Hour)
+	tracker, err := newPushTracker([]ExpectedPusher{
+		{Job: "late", Cadence: model.Duration(time.Hour)},
+		{Job: "ok", Cadence: model.Duration(time.Hour)},
+		{Job: "new", Cadence: model.Duration(24 * time.Hour)},
+	}, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Observe(model.LabelSet{model.JobLabel: "ok"}, time.Now())
+
+	tests := []struct {
+		query      string
+		wantStatus string
+		wantNames  string
+	}{
+		{query: "", wantStatus: "warning", wantNames: "late,new,ok"},
+		{query: "?overdue=true", wantStatus: "warning", wantNames: "late"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleExpected(tracker)(rec, httptest.NewRequest(http.MethodGet, "/expected"+tt.query, nil))
+		var report ExpectedReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, p := range report.Pushers {
+			names = append(names, p.Name)
+		}
+		if report.Status != tt.wantStatus || strings.Join(names, ",") != tt.wantNames {
+			t.Errorf("%q: status %s with %v, want %s with %s", tt.query, report.Status, names, tt.wantStatus, tt.wantNames)
+		}
+		if !strings.Contains(report.Message, "1 of 3") {
+			t.Errorf("%q: message %q", tt.query, report.Message)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"gopkg.in/yaml.v3"
+)
+
+// FreshnessSLO is the maximum time a group of jobs may go without a
+// successful push before Prometheus alerts.
+type FreshnessSLO struct {
+	// Job is a regular expression matched against the whole job label.
+	Job      string         `yaml:"job"`
+	MaxAge   model.Duration `yaml:"max_age"`
+	For      model.Duration `yaml:"for"`
+	Severity string         `yaml:"severity"`
+}
+
+// alertingRuleFile mirrors the Prometheus rule file format for the rules
+// generated here.
+type alertingRuleFile struct {
+	Groups []alertingRuleGroup `yaml:"groups"`
+}
+
+type alertingRuleGroup struct {
+	Name  string         `yaml:"name"`
+	Rules []alertingRule `yaml:"rules"`
+}
+
+type alertingRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// freshnessGroupPrefix starts the names of the generated rule groups.
+const freshnessGroupPrefix = "pushgateway_freshness"
+
+// freshnessRules builds alerting rules from the freshness SLOs. Each SLO gets
+// a rule group of its own, named after its job pattern and severity, with
+// one alert for groups whose last successful push is older than max_age and
+// one for groups whose latest push attempt failed. A group that never pushed
+// successfully has push_time_seconds of 0 and counts as stale.
+func freshnessRules(slos []FreshnessSLO) (*alertingRuleFile, error) {
+	rf := &alertingRuleFile{Groups: []alertingRuleGroup{}}
+	names := map[string]int{}
+	for i, slo := range slos {
+		if slo.Job == "" {
+			return nil, fmt.Errorf("freshness SLO %d: job pattern is required", i+1)
+		}
+		if _, err := regexp.Compile("^(?:" + slo.Job + ")$"); err != nil {
+			return nil, fmt.Errorf("freshness SLO %d: invalid job pattern %q: %v", i+1, slo.Job, err)
+		}
+		if slo.MaxAge <= 0 {
+			return nil, fmt.Errorf("freshness SLO %d (%s): max_age must be positive", i+1, slo.Job)
+		}
+		severity := slo.Severity
+		if severity == "" {
+			severity = "warning"
+		}
+
+		group := alertingRuleGroup{Name: freshnessGroupPrefix + ":" + slo.Job + ":" + severity}
+		if j, dup := names[group.Name]; dup {
+			return nil, fmt.Errorf("freshness SLO %d: same job pattern %q and severity %s as SLO %d", i+1, slo.Job, severity, j)
+		}
+		names[group.Name] = i + 1
+
+		selector := "{job=~" + strconv.Quote(slo.Job) + "}"
+		labels := map[string]string{"severity": severity, "freshness_slo": slo.Job}
+		group.Rules = append(group.Rules,
+			alertingRule{
+				Alert:  "PushgatewayJobStale",
+				Expr:   fmt.Sprintf("time() - push_time_seconds%s > %g", selector, time.Duration(slo.MaxAge).Seconds()),
+				For:    slo.For,
+				Labels: labels,
+				Annotations: map[string]string{
+					"summary":     "Job {{ $labels.job }} has not pushed successfully for {{ $value | humanizeDuration }}",
+					"description": fmt.Sprintf("The last successful push of {{ $labels.job }} ({{ $labels.instance }}) is older than the %s freshness SLO for jobs matching %q.", slo.MaxAge, slo.Job),
+				},
+			},
+			alertingRule{
+				Alert:  "PushgatewayJobPushFailing",
+				Expr:   fmt.Sprintf("push_failure_time_seconds%s > push_time_seconds%s", selector, selector),
+				For:    slo.For,
+				Labels: labels,
+				Annotations: map[string]string{
+					"summary":     "Latest push of job {{ $labels.job }} failed",
+					"description": "The gateway rejected the latest push of {{ $labels.job }} ({{ $labels.instance }}); the values Prometheus sees are from the last successful push.",
+				},
+			},
+		)
+		rf.Groups = append(rf.Groups, group)
+	}
+	return rf, nil
+}
+
+// validateAlertingRules checks a rule file with the Prometheus rule parser,
+// the way Prometheus does when loading it.
+func validateAlertingRules(data []byte) error {
+	if _, errs := rulefmt.Parse(data, false); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// renderFreshnessRules generates the rule file for the SLOs and validates it
+// before returning it.
+func renderFreshnessRules(slos []FreshnessSLO) ([]byte, error) {
+	rf, err := freshnessRules(slos)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString("# Generated by metriclint_server from the freshness SLOs. Do not edit.\n")
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(rf); err != nil {
+		return nil, err
+	}
+	if err := validateAlertingRules(b.Bytes()); err != nil {
+		return nil, fmt.Errorf("generated rules are invalid: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// handleFreshnessRules serves the pre-rendered rule file so Prometheus (or a
+// sidecar syncing its rule directory) can load it.
+func handleFreshnessRules(rules []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed. Use GET.", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(rules)
+	}
+}
+
+// runRules implements the "rules" subcommand, writing the freshness rule
+// file generated from the config.
+func runRules(cfg *Config, args []string) int {
+	fs := flag.NewFlagSet("rules", flag.ExitOnError)
+	output := fs.String("o", "-", "File to write the rules to, - for stdout.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: metriclint_server -config file rules [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	rules, err := renderFreshnessRules(cfg.Freshness)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output == "-" {
+		os.Stdout.Write(rules)
+		return 0
+	}
+	if err := os.WriteFile(*output, rules, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestRenderFreshnessRules(t *testing.T) {
+	slos := []FreshnessSLO{
+		{Job: "backup-.*", MaxAge: model.Duration(26 * time.Hour), For: model.Duration(10 * time.Minute), Severity: "page"},
+		{Job: "backup-.*", MaxAge: model.Duration(12 * time.Hour)},
+		{Job: "nightly", MaxAge: model.Duration(25 * time.Hour)},
+	}
+	if _, err := renderFreshnessRules(slos); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := freshnessRules(slos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"pushgateway_freshness:backup-.*:page",
+		"pushgateway_freshness:backup-.*:warning",
+		"pushgateway_freshness:nightly:warning",
+	}
+	if len(rf.Groups) != len(want) {
+		t.Fatalf("%d groups, want %d", len(rf.Groups), len(want))
+	}
+	for i, g := range rf.Groups {
+		if g.Name != want[i] {
+			t.Errorf("group %d is %q, want %q", i, g.Name, want[i])
+		}
+		if len(g.Rules) != 2 || g.Rules[0].Alert != "PushgatewayJobStale" || g.Rules[1].Alert != "PushgatewayJobPushFailing" {
+			t.Errorf("group %s has rules %+v", g.Name, g.Rules)
+		}
+	}
+	if got := rf.Groups[1].Rules[0].Expr; got != `time() - push_time_seconds{job=~"backup-.*"} > 43200` {
+		t.Errorf("stale expression %s", got)
+	}
+}
+
+func TestFreshnessRulesErrors(t *testing.T) {
+	day := model.Duration(24 * time.Hour)
+	tests := []struct {
+		name string
+		slos []FreshnessSLO
+		want string
+	}{
+		{name: "missing job", slos: []FreshnessSLO{{MaxAge: day}}, want: "job pattern is required"},
+		{name: "bad pattern", slos: []FreshnessSLO{{Job: "(", MaxAge: day}}, want: "invalid job pattern"},
+		{name: "no max age", slos: []FreshnessSLO{{Job: "a"}}, want: "max_age must be positive"},
+		{name: "duplicate", slos: []FreshnessSLO{{Job: "a", MaxAge: day}, {Job: "a", MaxAge: 2 * day, Severity: "warning"}}, want: "same job pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := renderFreshnessRules(tt.slos)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAlertingRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{
+			name: "valid",
+			rules: `
+groups:
+  - name: g
+    rules:
+      - alert: A
+        expr: up == 0
+        annotations:
+          summary: '{{ $labels.job }} down for {{ $value | humanizeDuration }}'
+`,
+		},
+		{
+			name:  "unknown field",
+			rules: "groups:\n  - name: g\n    rulez: []\n",
+			want:  "rulez",
+		},
+		{
+			name:  "bad expression",
+			rules: "groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: sum(up\n",
+			want:  "parse error",
+		},
+		{
+			name:  "unknown template function",
+			rules: "groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: up\n        annotations:\n          summary: '{{ nosuchfunc }}'\n",
+			want:  "nosuchfunc",
+		},
+		{
+			name:  "duplicate group",
+			rules: "groups:\n  - name: g\n    rules: []\n  - name: g\n    rules: []\n",
+			want:  "repeated in the same file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAlertingRules([]byte(tt.rules))
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
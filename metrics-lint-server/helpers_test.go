@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// parseFamilies decodes a text exposition.
+func parseFamilies(t *testing.T, text string) []*dto.MetricFamily {
+	t.Helper()
+	families, err := lint.DecodeFamilies(strings.NewReader(strings.TrimLeft(text, "\n")), expfmt.NewFormat(expfmt.TypeTextPlain))
+	if err != nil {
+		t.Fatalf("parsing families: %v", err)
+	}
+	return families
+}
+
+// formatFamilies encodes families in the text format, for comparing them
+// with an expected exposition.
+func formatFamilies(t *testing.T, families []*dto.MetricFamily) string {
+	t.Helper()
+	b, err := encodeFamilies(families, expfmt.NewFormat(expfmt.TypeTextPlain))
+	if err != nil {
+		t.Fatalf("encoding families: %v", err)
+	}
+	return string(b)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// PushHistory configures recording of incoming pushes so rule changes can be
+// replayed against real traffic.
+type PushHistory struct {
+	// File is the JSON Lines file pushes are appended to. Relative paths
+	// are resolved against the directory of the config file.
+	File string `yaml:"file"`
+	// MaxPushes is the number of most recent pushes kept. Defaults to
+	// 10000.
+	MaxPushes int `yaml:"max_pushes"`
+	// TokenFile holds the bearer token POST /impact requires. Without it
+	// impact analysis is only available as a subcommand. Relative paths
+	// are resolved against the directory of the config file.
+	TokenFile string `yaml:"token_file"`
+}
+
+// recordedPush is a push as received, before any rewriting.
+type recordedPush struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body"`
+	// Source is the payload file a push was read from.
+	Source string `json:"-"`
+}
+
+// historyFlushDelay bounds how long a recorded push stays buffered before it
+// is written to the history file.
+const historyFlushDelay = time.Second
+
+// pushHistory appends pushes to the history file, which it keeps open
+// behind a buffered writer. Buffered pushes are flushed within
+// historyFlushDelay and before the file is read. The file is compacted to
+// the most recent MaxPushes pushes once it holds twice as many.
+type pushHistory struct {
+	mu           sync.Mutex
+	file         string
+	max          int
+	count        int
+	f            *os.File
+	w            *bufio.Writer
+	flushPending bool
+}
+
+// openPushHistory returns nil if recording is not configured.
+func openPushHistory(cfg PushHistory) (*pushHistory, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	h := &pushHistory{file: cfg.File, max: cfg.MaxPushes}
+	if h.max == 0 {
+		h.max = 10000
+	}
+	if h.max < 0 {
+		return nil, fmt.Errorf("max_pushes must be positive")
+	}
+	pushes, err := readPushHistory(h.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	h.count = len(pushes)
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *pushHistory) open() error {
+	f, err := os.OpenFile(h.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	h.f, h.w = f, bufio.NewWriter(f)
+	return nil
+}
+
+// Record appends a push. Failures are logged, since they must not fail the
+// push itself.
+func (h *pushHistory) Record(r *http.Request, body []byte, now time.Time) {
+	if h == nil {
+		return
+	}
+	line, err := json.Marshal(recordedPush{
+		Time:        now,
+		Method:      r.Method,
+		Path:        r.URL.EscapedPath(),
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        body,
+	})
+	if err != nil {
+		log.Printf("Failed to record push: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.w == nil {
+		// Compaction failed to reopen the file.
+		if err := h.open(); err != nil {
+			log.Printf("Failed to record push: %v", err)
+			return
+		}
+	}
+	if _, err := h.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to record push: %v", err)
+		return
+	}
+	if !h.flushPending {
+		h.flushPending = true
+		time.AfterFunc(historyFlushDelay, func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if err := h.flush(); err != nil {
+				log.Printf("Failed to record push: %v", err)
+			}
+		})
+	}
+	if h.count++; h.count >= 2*h.max {
+		if err := h.compact(); err != nil {
+			log.Printf("Failed to compact push history: %v", err)
+		}
+	}
+}
+
+// flush writes buffered pushes to the file. h.mu must be held.
+func (h *pushHistory) flush() error {
+	h.flushPending = false
+	if h.w == nil {
+		return nil
+	}
+	return h.w.Flush()
+}
+
+// Recent returns the recorded pushes since the given time, oldest first, at
+// most limit of them if limit is positive.
+func (h *pushHistory) Recent(since time.Time, limit int) ([]recordedPush, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.flush(); err != nil {
+		return nil, err
+	}
+	return readRecentPushes(h.file, since, limit)
+}
+
+// compact rewrites the file with the most recent pushes. h.mu must be held.
+func (h *pushHistory) compact() error {
+	if err := h.flush(); err != nil {
+		return err
+	}
+	pushes, err := readRecentPushes(h.file, time.Time{}, h.max)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, p := range pushes {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.file), filepath.Base(h.file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), h.file); err != nil {
+		return err
+	}
+	h.count = len(pushes)
+
+	// The open file is the replaced one.
+	h.f.Close()
+	h.f, h.w = nil, nil
+	return h.open()
+}
+
+// readPushHistory reads the pushes recorded in a history file, oldest first.
+func readPushHistory(file string) ([]recordedPush, error) {
+	return readRecentPushes(file, time.Time{}, 0)
+}
+
+// readRecentPushes reads the pushes recorded in a history file since the
+// given time, oldest first. If limit is positive only the most recent limit
+// pushes are kept, so the whole file is never held in memory.
+func readRecentPushes(file string, since time.Time, limit int) ([]recordedPush, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pushes []recordedPush
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for n := 1; ; n++ {
+		var p recordedPush
+		if err := dec.Decode(&p); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%s: push %d: %v", file, n, err)
+		}
+		if p.Time.Before(since) {
+			continue
+		}
+		if limit > 0 && len(pushes) == limit {
+			copy(pushes, pushes[1:])
+			pushes = pushes[:limit-1]
+		}
+		pushes = append(pushes, p)
+	}
+	return pushes, nil
+}
+
+// readPayloadDir turns every file below dir into a PUT to the job named
+// after the file. The format follows the extension: .pb for delimited
+// protobuf, .om for OpenMetrics and text otherwise.
+func readPayloadDir(dir string) ([]recordedPush, error) {
+	var pushes []recordedPush
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		contentType := string(expfmt.NewFormat(expfmt.TypeTextPlain))
+		switch ext {
+		case ".pb":
+			contentType = string(expfmt.NewFormat(expfmt.TypeProtoDelim))
+		case ".om":
+			contentType = string(expfmt.NewFormat(expfmt.TypeOpenMetrics))
+		}
+		rel, _ := filepath.Rel(dir, path)
+		pushes = append(pushes, recordedPush{
+			Method:      http.MethodPut,
+			Path:        "/metrics" + groupingKeyPath(model.LabelSet{model.JobLabel: model.LabelValue(strings.TrimSuffix(filepath.Base(path), ext))}),
+			ContentType: contentType,
+			Body:        body,
+			Source:      rel,
+		})
+		return nil
+	})
+	return pushes, err
+}
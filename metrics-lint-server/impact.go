@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// ImpactFlip is a replayed push whose verdict differs between the current
+// and the candidate config.
+type ImpactFlip struct {
+	Time   *time.Time `json:"time,omitempty"`
+	Source string     `json:"source,omitempty"`
+	Path   string     `json:"path"`
+	// Current and Candidate are "accepted" or "rejected".
+	Current   string `json:"current"`
+	Candidate string `json:"candidate"`
+	// Error is the rejection message of the candidate, or of the current
+	// config if the candidate accepts the push.
+	Error string `json:"error,omitempty"`
+}
+
+// ImpactGroup collects the flipped verdicts of one rule and job. The rule is
+// the one rejecting the push under the candidate, or under the current
+// config for pushes the candidate accepts.
+type ImpactGroup struct {
+	Rule          string       `json:"rule"`
+	Job           string       `json:"job"`
+	NewlyRejected int          `json:"newly_rejected"`
+	NewlyAccepted int          `json:"newly_accepted"`
+	RuleChanged   int          `json:"rule_changed"`
+	Examples      []ImpactFlip `json:"examples"`
+}
+
+// ImpactReport summarizes how a candidate config would have changed the
+// verdicts of replayed pushes.
+type ImpactReport struct {
+	Status   string        `json:"status"`
+	Message  string        `json:"message,omitempty"`
+	Replayed int           `json:"replayed"`
+	Flipped  int           `json:"flipped"`
+	Groups   []ImpactGroup `json:"groups"`
+}
+
+// maxImpactExamples bounds the flips listed per group.
+const maxImpactExamples = 5
+
+// pushVerdict is the outcome of replaying one push.
+type pushVerdict struct {
+	rejected bool
+	rule     string
+	err      string
+}
+
+func (v pushVerdict) String() string {
+	if v.rejected {
+		return "rejected"
+	}
+	return "accepted"
+}
+
+// acceptingGateway stands in for the Pushgateway during replays.
+type acceptingGateway struct{}
+
+func (acceptingGateway) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+}
+
+// newReplayProxy builds a proxy from cfg whose pushes go to a stand-in
+// gateway and whose delta state is kept in a temporary file. The returned
+// function removes that file.
+func newReplayProxy(cfg *Config) (*pushProxy, func(), error) {
+	replayCfg := *cfg
+	cleanup := func() {}
+	if len(cfg.DeltaPush.Jobs) > 0 {
+		dir, err := os.MkdirTemp("", "metriclint-replay")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+		replayCfg.DeltaPush.StateFile = filepath.Join(dir, "deltas.json")
+	}
+	tracker, err := newPushTracker(nil, time.Now())
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	proxy, err := newPushProxy("http://replay", &replayCfg, newMetricStore(), tracker)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	proxy.client = &http.Client{Transport: acceptingGateway{}}
+	return proxy, cleanup, nil
+}
+
+// replayPush runs one push through the proxy. Requests rejected before the
+// payload is read get a plain text error, which is returned with the rule
+// "request".
+func replayPush(proxy *pushProxy, p recordedPush) (int, PushResponse) {
+	req := httptest.NewRequest(p.Method, p.Path, bytes.NewReader(p.Body))
+	if p.ContentType != "" {
+		req.Header.Set("Content-Type", p.ContentType)
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	var resp PushResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		resp = PushResponse{Status: "error", Rule: "request", ErrorText: strings.TrimSpace(rec.Body.String())}
+	}
+	return rec.Code, resp
+}
+
+// replayPushes runs the pushes in order through a proxy built from cfg, so
+// stateful rules such as anomaly detection see the same sequence of pushes.
+// Time-based rules such as sunsets and rename windows are evaluated at the
+// time a push was recorded, or at the time of the replay for payload files.
+// Nothing is forwarded or persisted.
+func replayPushes(cfg *Config, pushes []recordedPush) ([]pushVerdict, error) {
+	proxy, cleanup, err := newReplayProxy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	verdicts := make([]pushVerdict, 0, len(pushes))
+	for _, p := range pushes {
+		proxy.now = time.Now
+		if !p.Time.IsZero() {
+			proxy.now = func() time.Time { return p.Time }
+		}
+		v := pushVerdict{}
+		if code, resp := replayPush(proxy, p); code >= 400 {
+			v.rejected, v.rule, v.err = true, resp.Rule, resp.ErrorText
+		}
+		verdicts = append(verdicts, v)
+	}
+	return verdicts, nil
+}
+
+// analyzeImpact replays the pushes through both configs and groups the
+// flipped verdicts by rule and job.
+func analyzeImpact(current, candidate *Config, pushes []recordedPush) (ImpactReport, error) {
+	before, err := replayPushes(current, pushes)
+	if err != nil {
+		return ImpactReport{}, fmt.Errorf("current config: %v", err)
+	}
+	after, err := replayPushes(candidate, pushes)
+	if err != nil {
+		return ImpactReport{}, fmt.Errorf("candidate config: %v", err)
+	}
+
+	report := ImpactReport{Status: "success", Replayed: len(pushes), Groups: []ImpactGroup{}}
+	groups := map[string]*ImpactGroup{}
+	for i, p := range pushes {
+		b, a := before[i], after[i]
+		if b.rejected == a.rejected && b.rule == a.rule {
+			continue
+		}
+		report.Flipped++
+
+		rule, msg := a.rule, a.err
+		if !a.rejected {
+			rule, msg = b.rule, b.err
+		}
+		job := ""
+		if labels, err := parseGroupingKey(strings.TrimPrefix(p.Path, "/metrics/")); err == nil {
+			job = string(labels[model.JobLabel])
+		}
+		key := rule + "\xff" + job
+		g, ok := groups[key]
+		if !ok {
+			g = &ImpactGroup{Rule: rule, Job: job}
+			groups[key] = g
+		}
+		switch {
+		case !b.rejected:
+			g.NewlyRejected++
+		case !a.rejected:
+			g.NewlyAccepted++
+		default:
+			g.RuleChanged++
+		}
+		if len(g.Examples) < maxImpactExamples {
+			flip := ImpactFlip{Source: p.Source, Path: p.Path, Current: b.String(), Candidate: a.String(), Error: msg}
+			if !p.Time.IsZero() {
+				t := p.Time
+				flip.Time = &t
+			}
+			g.Examples = append(g.Examples, flip)
+		}
+	}
+
+	for _, g := range groups {
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		gi, gj := report.Groups[i], report.Groups[j]
+		ni, nj := gi.NewlyRejected+gi.NewlyAccepted+gi.RuleChanged, gj.NewlyRejected+gj.NewlyAccepted+gj.RuleChanged
+		if ni != nj {
+			return ni > nj
+		}
+		if gi.Rule != gj.Rule {
+			return gi.Rule < gj.Rule
+		}
+		return gi.Job < gj.Job
+	})
+
+	report.Message = fmt.Sprintf("No verdict changes across %d replayed pushes.", len(pushes))
+	if report.Flipped > 0 {
+		report.Status = "warning"
+		report.Message = fmt.Sprintf("%d of %d replayed pushes would get a different verdict", report.Flipped, len(pushes))
+	}
+	return report, nil
+}
+
+// loadImpactToken reads the bearer token of POST /impact, or returns "" if
+// none is configured.
+func loadImpactToken(cfg PushHistory) (string, error) {
+	if cfg.TokenFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(cfg.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("push history: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("push history: %s is empty", cfg.TokenFile)
+	}
+	return token, nil
+}
+
+// defaultImpactPushes is the number of recent pushes POST /impact replays
+// unless the request asks for another limit.
+const defaultImpactPushes = 1000
+
+// impactWindow reads the since and limit query parameters of POST /impact.
+// since is a duration before now, such as 6h, or an RFC 3339 time. limit
+// defaults to defaultImpactPushes and is capped at the history's size.
+func impactWindow(q url.Values, maxPushes int, now time.Time) (time.Time, int, error) {
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		if d, err := model.ParseDuration(s); err == nil {
+			since = now.Add(-time.Duration(d))
+		} else if since, err = time.Parse(time.RFC3339, s); err != nil {
+			return time.Time{}, 0, fmt.Errorf("since must be a duration such as 6h or an RFC 3339 time, got %q", s)
+		}
+	}
+	limit := defaultImpactPushes
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return time.Time{}, 0, fmt.Errorf("limit must be a positive number, got %q", s)
+		}
+		limit = n
+	}
+	return since, min(limit, maxPushes), nil
+}
+
+// handleImpact replays recent pushes from the history through the current
+// config and the candidate config in the request body. The since and limit
+// query parameters select the pushes, see impactWindow, and one analysis
+// runs at a time. Relative paths in the candidate are resolved against
+// configDir, as for the current config. Requests must carry token as bearer
+// token; without a token the endpoint is disabled.
+func handleImpact(cfg *Config, history *pushHistory, configDir, token string) http.HandlerFunc {
+	busy := make(chan struct{}, 1)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed. Use POST.", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" {
+			writeJSON(w, http.StatusNotFound, ImpactReport{Status: "error", Message: "Impact analysis over HTTP is not enabled; use the impact subcommand or set push_history.token_file."})
+			return
+		}
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(bearer)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, ImpactReport{Status: "error", Message: "A valid bearer token is required."})
+			return
+		}
+		if history == nil {
+			writeJSON(w, http.StatusNotFound, ImpactReport{Status: "error", Message: "Push history is not configured."})
+			return
+		}
+		since, limit, err := impactWindow(r.URL.Query(), history.max, time.Now())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ImpactReport{Status: "error", Message: err.Error()})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		candidate, err := parseConfig(body, configDir)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ImpactReport{Status: "error", Message: fmt.Sprintf("Invalid candidate config: %v", err)})
+			return
+		}
+
+		select {
+		case busy <- struct{}{}:
+			defer func() { <-busy }()
+		default:
+			writeJSON(w, http.StatusTooManyRequests, ImpactReport{Status: "error", Message: "Another impact analysis is running; try again later."})
+			return
+		}
+		pushes, err := history.Recent(since, limit)
+		if err != nil && !os.IsNotExist(err) {
+			writeJSON(w, http.StatusInternalServerError, ImpactReport{Status: "error", Message: err.Error()})
+			return
+		}
+
+		report, err := analyzeImpact(cfg, candidate, pushes)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ImpactReport{Status: "error", Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func runImpact(cfg *Config, args []string) int {
+	fs := flag.NewFlagSet("impact", flag.ExitOnError)
+	history := fs.String("history", cfg.PushHistory.File, "Push history file to replay.")
+	payloads := fs.String("payloads", "", "Directory of payload files to replay instead of the history, each pushed to the job named after the file.")
+	since := fs.Duration("since", 0, "Replay only pushes recorded within this duration.")
+	limit := fs.Int("limit", 0, "Replay at most this many of the most recent pushes; 0 replays all.")
+	output := fs.String("output", "text", "Output format: text or json.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: metriclint_server [-config file] impact [flags] <candidate config>")
+		return 2
+	}
+
+	candidate, err := loadConfig(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var pushes []recordedPush
+	switch {
+	case *payloads != "":
+		pushes, err = readPayloadDir(*payloads)
+	case *history != "":
+		var from time.Time
+		if *since > 0 {
+			from = time.Now().Add(-*since)
+		}
+		pushes, err = readRecentPushes(*history, from, *limit)
+	default:
+		err = fmt.Errorf("no push history configured; use -history or -payloads")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report, err := analyzeImpact(cfg, candidate, pushes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, g := range report.Groups {
+			fmt.Printf("%-20s job %q: %d newly rejected, %d newly accepted, %d rejected by another rule\n", g.Rule, g.Job, g.NewlyRejected, g.NewlyAccepted, g.RuleChanged)
+			for _, f := range g.Examples {
+				where := f.Path
+				if f.Source != "" {
+					where = f.Source
+				}
+				fmt.Printf("    %s: %s -> %s %s\n", where, f.Current, f.Candidate, f.Error)
+			}
+		}
+		fmt.Println(report.Message)
+	}
+
+	if report.Flipped > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+func textPush(method, path, body string, at time.Time) recordedPush {
+	return recordedPush{Time: at, Method: method, Path: path, ContentType: "text/plain; version=0.0.4", Body: []byte(body)}
+}
+
+func TestAnalyzeImpact(t *testing.T) {
+	sunset := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	legacy := "# TYPE legacy_total counter\nlegacy_total 1\n"
+
+	tests := []struct {
+		name      string
+		candidate Config
+		pushes    []recordedPush
+		want      []string // rule:job:newly rejected:newly accepted:rule changed
+	}{
+		{
+			name:      "sunset evaluated at push time",
+			candidate: Config{Config: lint.Config{Deprecations: []lint.Deprecation{{Metric: "legacy_*", Sunset: sunset, AfterSunset: "reject"}}}},
+			pushes: []recordedPush{
+				textPush(http.MethodPut, "/metrics/job/batch", legacy, sunset.Add(-24*time.Hour)),
+				textPush(http.MethodPut, "/metrics/job/batch", legacy, sunset.Add(24*time.Hour)),
+				textPush(http.MethodPut, "/metrics/job/other", legacy, sunset.Add(48*time.Hour)),
+			},
+			want: []string{"deprecations:batch:1:0:0", "deprecations:other:1:0:0"},
+		},
+		{
+			name:      "same rules",
+			candidate: Config{},
+			pushes: []recordedPush{
+				textPush(http.MethodPut, "/metrics/job/batch", "up 1\n", sunset),
+			},
+		},
+		{
+			name:      "state carried between pushes",
+			candidate: Config{DeltaPush: DeltaPush{Jobs: []string{"session"}}},
+			pushes: []recordedPush{
+				textPush(http.MethodPost, "/metrics/job/session", "# TYPE x counter\nx 1\n", sunset),
+				textPush(http.MethodPost, "/metrics/job/session", "# TYPE x gauge\nx 1\n", sunset),
+			},
+			want: []string{"delta_push:session:1:0:0"},
+		},
+		{
+			name:      "deletes are replayed",
+			candidate: Config{DeltaPush: DeltaPush{Jobs: []string{"session"}}},
+			pushes: []recordedPush{
+				textPush(http.MethodPost, "/metrics/job/session", "# TYPE x counter\nx 1\n", sunset),
+				textPush(http.MethodDelete, "/metrics/job/session", "", sunset),
+				textPush(http.MethodPost, "/metrics/job/session", "# TYPE x gauge\nx 1\n", sunset),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := analyzeImpact(&Config{}, &tt.candidate, tt.pushes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, g := range report.Groups {
+				got = append(got, fmt.Sprintf("%s:%s:%d:%d:%d", g.Rule, g.Job, g.NewlyRejected, g.NewlyAccepted, g.RuleChanged))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("groups %v, want %v", got, tt.want)
+			}
+			if report.Replayed != len(tt.pushes) {
+				t.Errorf("replayed %d pushes, want %d", report.Replayed, len(tt.pushes))
+			}
+		})
+	}
+}
+
+func TestPushHistoryRecordsDeletes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pushes.jsonl")
+	proxy, cleanup, err := newReplayProxy(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if proxy.history, err = openPushHistory(PushHistory{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	replayPush(proxy, textPush(http.MethodPut, "/metrics/job/batch", "# TYPE up gauge\nup 1\n", time.Time{}))
+	replayPush(proxy, textPush(http.MethodDelete, "/metrics/job/batch", "", time.Time{}))
+
+	pushes, err := proxy.history.Recent(time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, p := range pushes {
+		methods = append(methods, p.Method)
+	}
+	if strings.Join(methods, " ") != "PUT DELETE" {
+		t.Errorf("recorded %v, want PUT DELETE", methods)
+	}
+}
+
+func TestHandleImpact(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{PushHistory: PushHistory{File: filepath.Join(dir, "pushes.jsonl")}}
+	history, err := openPushHistory(cfg.PushHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		auth     string
+		query    string
+		body     string
+		wantCode int
+	}{
+		{name: "disabled without a token", auth: "Bearer secret", wantCode: http.StatusNotFound},
+		{name: "missing token", token: "secret", wantCode: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", auth: "Bearer nope", wantCode: http.StatusUnauthorized},
+		{name: "valid token", token: "secret", auth: "Bearer secret", body: "untyped_metrics: reject\n", wantCode: http.StatusOK},
+		{name: "invalid candidate", token: "secret", auth: "Bearer secret", body: "untyped_metrics: [\n", wantCode: http.StatusBadRequest},
+		{name: "window", token: "secret", auth: "Bearer secret", query: "?since=1h&limit=10", wantCode: http.StatusOK},
+		{name: "invalid limit", token: "secret", auth: "Bearer secret", query: "?limit=0", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/impact"+tt.query, strings.NewReader(tt.body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			handleImpact(cfg, history, dir, tt.token)(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestImpactWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query     string
+		wantSince time.Time
+		wantLimit int
+		wantErr   string
+	}{
+		{query: "", wantLimit: defaultImpactPushes},
+		{query: "since=6h", wantSince: now.Add(-6 * time.Hour), wantLimit: defaultImpactPushes},
+		{query: "since=2024-04-30T00:00:00Z&limit=50", wantSince: time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC), wantLimit: 50},
+		{query: "limit=99999", wantLimit: 5000},
+		{query: "since=yesterday", wantErr: "since must be"},
+		{query: "limit=-1", wantErr: "limit must be"},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		since, limit, err := impactWindow(q, 5000, now)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got error %v, want %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !since.Equal(tt.wantSince) || limit != tt.wantLimit {
+			t.Errorf("%q: got %v, %d, %v, want %v, %d", tt.query, since, limit, err, tt.wantSince, tt.wantLimit)
+		}
+	}
+}
+
+func TestPushHistoryRecent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pushes.jsonl")
+	h, err := openPushHistory(PushHistory{File: file, MaxPushes: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/metrics/job/batch", nil)
+	for i := range 7 {
+		h.Record(req, []byte(fmt.Sprint(i)), t0.Add(time.Duration(i)*time.Minute))
+	}
+	bodies := func(pushes []recordedPush) string {
+		var out []string
+		for _, p := range pushes {
+			out = append(out, string(p.Body))
+		}
+		return strings.Join(out, " ")
+	}
+
+	// The 6th push compacted the file to the last 3, and the 7th was
+	// appended to the reopened file.
+	pushes, err := h.Recent(time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(pushes); got != "3 4 5 6" {
+		t.Errorf("recorded %q, want 3 4 5 6", got)
+	}
+	if pushes, _ = h.Recent(t0.Add(5*time.Minute), 0); bodies(pushes) != "5 6" {
+		t.Errorf("since the 5th push: got %q", bodies(pushes))
+	}
+	if pushes, _ = h.Recent(time.Time{}, 2); bodies(pushes) != "5 6" {
+		t.Errorf("last 2 pushes: got %q", bodies(pushes))
+	}
+
+	// Reopening counts the 4 pushes already in the file, so the 2nd push
+	// after it compacts again.
+	if h, err = openPushHistory(PushHistory{File: file, MaxPushes: 3}); err != nil {
+		t.Fatal(err)
+	}
+	h.Record(req, []byte("7"), t0.Add(7*time.Minute))
+	h.Record(req, []byte("8"), t0.Add(8*time.Minute))
+	if pushes, _ = h.Recent(time.Time{}, 0); bodies(pushes) != "6 7 8" {
+		t.Errorf("after reopening: got %q", bodies(pushes))
+	}
+}
+
+func TestParseConfigResolvesPaths(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+schemas: [schema.yml, /abs/schema.yml]
+delta_push: {jobs: [s], state_file: deltas.json}
+push_history: {file: pushes.jsonl, token_file: impact.token}
+policy_endpoint: {clients: [{identity: a, token_file: a.token}]}
+`), "/etc/metriclint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{cfg.Schemas[0], cfg.Schemas[1], cfg.DeltaPush.StateFile, cfg.PushHistory.File, cfg.PushHistory.TokenFile, cfg.PolicyEndpoint.Clients[0].TokenFile}
+	want := []string{"/etc/metriclint/schema.yml", "/abs/schema.yml", "/etc/metriclint/deltas.json", "/etc/metriclint/pushes.jsonl", "/etc/metriclint/impact.token", "/etc/metriclint/a.token"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("paths %v, want %v", got, want)
+	}
+}
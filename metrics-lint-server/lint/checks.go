@@ -0,0 +1,60 @@
+package lint
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint/validations"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Check is a promlint validation with the code its problems are reported
+// under.
+type Check struct {
+	Code     string
+	Validate promlint.Validation
+}
+
+// promlintChecks are promlint's default validations.
+var promlintChecks = []Check{
+	{"help", validations.LintHelp},
+	{"metric_units", validations.LintMetricUnits},
+	{"counter", validations.LintCounter},
+	{"histogram_summary_reserved", validations.LintHistogramSummaryReserved},
+	{"metric_type_in_name", validations.LintMetricTypeInName},
+	{"reserved_chars", validations.LintReservedChars},
+	{"camel_case", validations.LintCamelCase},
+	{"unit_abbreviations", validations.LintUnitAbbreviations},
+	{"duplicate_metric", validations.LintDuplicateMetric},
+}
+
+// StaticChecks returns promlint's validations and the policy-independent
+// checks of the lint server for the families of one exposition.
+func StaticChecks(families []*dto.MetricFamily) []Check {
+	checks := append([]Check{}, promlintChecks...)
+	return append(checks,
+		Check{"created_collision", CreatedCollisions(families)},
+		Check{"suffix_collision", SuffixCollisions(families)},
+		Check{"reserved_label", ReservedLabels},
+	)
+}
+
+// Run applies the checks to every family. Problems are sorted by metric and
+// text, like promlint's.
+func Run(families []*dto.MetricFamily, checks []Check) []ProblemDetails {
+	var problems []ProblemDetails
+	for _, mf := range families {
+		for _, c := range checks {
+			for _, err := range c.Validate(mf) {
+				problems = append(problems, ProblemDetails{Metric: mf.GetName(), Text: err.Error(), Code: c.Code})
+			}
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Metric == problems[j].Metric {
+			return problems[i].Text < problems[j].Text
+		}
+		return problems[i].Metric < problems[j].Metric
+	})
+	return problems
+}
@@ -0,0 +1,180 @@
+package lint
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Deprecation retires the metrics matching a glob. Pushes get a warning
+// until the sunset date; afterwards the metrics are stripped or the push is
+// rejected.
+type Deprecation struct {
+	// Metric is a glob such as legacy_* matched against family names.
+	Metric string `yaml:"metric"`
+	// Replacement optionally names the metric to use instead.
+	Replacement string `yaml:"replacement"`
+	// Sunset is when the deprecation is enforced. Without a sunset pushes
+	// are only warned.
+	Sunset time.Time `yaml:"sunset"`
+	// AfterSunset is "strip" (default) to drop the metrics from pushes or
+	// "reject" to refuse such pushes.
+	AfterSunset string `yaml:"after_sunset"`
+}
+
+// Sunsetted reports whether the deprecation is enforced at now.
+func (d *Deprecation) Sunsetted(now time.Time) bool {
+	return !d.Sunset.IsZero() && !now.Before(d.Sunset)
+}
+
+// Action returns what happens to the metrics after the sunset: strip,
+// reject, or warn if there is no sunset or enforce is not set, as for
+// clients a canary rollout does not enforce deprecations for.
+func (d *Deprecation) Action(enforce bool) string {
+	if d.Sunset.IsZero() || !enforce {
+		return "warn"
+	}
+	return d.AfterSunset
+}
+
+func (d *Deprecation) advice() string {
+	if d.Replacement != "" {
+		return "use " + d.Replacement + " instead"
+	}
+	return "stop sending it"
+}
+
+// DeprecationPolicy enforces the deprecations. The first deprecation
+// matching a family applies.
+type DeprecationPolicy struct {
+	deprecations []*Deprecation
+}
+
+// NewDeprecationPolicy validates the deprecations and fills in defaults.
+func NewDeprecationPolicy(deprecations []Deprecation) (*DeprecationPolicy, error) {
+	d := &DeprecationPolicy{}
+	for i, dep := range deprecations {
+		if dep.Metric == "" {
+			return nil, fmt.Errorf("deprecation %d: metric is required", i+1)
+		}
+		if _, err := path.Match(dep.Metric, ""); err != nil {
+			return nil, fmt.Errorf("deprecation %d: invalid metric glob %q", i+1, dep.Metric)
+		}
+		switch dep.AfterSunset {
+		case "":
+			dep.AfterSunset = "strip"
+		case "strip", "reject":
+		default:
+			return nil, fmt.Errorf("deprecation %s: unknown after_sunset %q, expected strip or reject", dep.Metric, dep.AfterSunset)
+		}
+		d.deprecations = append(d.deprecations, &dep)
+	}
+	return d, nil
+}
+
+// Deprecations returns the deprecations in the order they were configured.
+func (d *DeprecationPolicy) Deprecations() []*Deprecation {
+	return d.deprecations
+}
+
+// Match returns the deprecation applying to the named family, or nil.
+func (d *DeprecationPolicy) Match(name string) *Deprecation {
+	for _, dep := range d.deprecations {
+		if ok, _ := path.Match(dep.Metric, name); ok {
+			return dep
+		}
+	}
+	return nil
+}
+
+// PastSunset returns the names of the families past their sunset.
+func (d *DeprecationPolicy) PastSunset(families []*dto.MetricFamily, now time.Time) []string {
+	var names []string
+	for _, mf := range families {
+		if dep := d.Match(mf.GetName()); dep != nil && dep.Sunsetted(now) {
+			names = append(names, mf.GetName())
+		}
+	}
+	return names
+}
+
+// Deprecated returns the names of the families matching a deprecation.
+func (d *DeprecationPolicy) Deprecated(families []*dto.MetricFamily) []string {
+	var names []string
+	for _, mf := range families {
+		if d.Match(mf.GetName()) != nil {
+			names = append(names, mf.GetName())
+		}
+	}
+	return names
+}
+
+// Apply enforces sunsets if enforce is set. Clients a canary rollout does
+// not enforce deprecations for only get warnings. It returns the remaining
+// families and the names of the stripped ones, or an error if the push must
+// be rejected.
+func (d *DeprecationPolicy) Apply(families []*dto.MetricFamily, now time.Time, enforce bool) ([]*dto.MetricFamily, []string, error) {
+	if len(d.deprecations) == 0 {
+		return families, nil, nil
+	}
+
+	var stripped, rejected []string
+	out := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		action := "warn"
+		if dep := d.Match(mf.GetName()); dep != nil && dep.Sunsetted(now) {
+			action = dep.Action(enforce)
+		}
+		switch action {
+		case "reject":
+			rejected = append(rejected, mf.GetName())
+		case "strip":
+			stripped = append(stripped, mf.GetName())
+		default:
+			out = append(out, mf)
+		}
+	}
+	if len(rejected) > 0 {
+		return families, nil, fmt.Errorf("metrics past their deprecation sunset: %s", strings.Join(rejected, ", "))
+	}
+	if len(stripped) == 0 {
+		return families, nil, nil
+	}
+	return out, stripped, nil
+}
+
+// LintDeprecated returns a promlint validation flagging deprecated metrics
+// that are still forwarded by a push at now.
+func (d *DeprecationPolicy) LintDeprecated(now time.Time) func(*dto.MetricFamily) []error {
+	return func(mf *dto.MetricFamily) []error {
+		dep := d.Match(mf.GetName())
+		if dep == nil {
+			return nil
+		}
+		if dep.Sunset.IsZero() {
+			return []error{fmt.Errorf("metric is deprecated; %s", dep.advice())}
+		}
+		if dep.Sunsetted(now) {
+			return []error{fmt.Errorf("metric is past its deprecation sunset on %s; %s", dep.Sunset.Format("2006-01-02"), dep.advice())}
+		}
+		return []error{fmt.Errorf("metric is deprecated and will be dropped from %s; %s", dep.Sunset.Format("2006-01-02"), dep.advice())}
+	}
+}
+
+// StrippedProblems returns lint problems for the families stripped from a
+// push, which are no longer there for a promlint validation to flag.
+func (d *DeprecationPolicy) StrippedProblems(stripped []string) []ProblemDetails {
+	var problems []ProblemDetails
+	for _, name := range stripped {
+		dep := d.Match(name)
+		problems = append(problems, ProblemDetails{
+			Metric: name,
+			Text:   fmt.Sprintf("metric was dropped because it is past its deprecation sunset on %s; %s", dep.Sunset.Format("2006-01-02"), dep.advice()),
+			Code:   RuleDeprecations,
+		})
+	}
+	return problems
+}
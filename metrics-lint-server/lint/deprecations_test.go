@@ -0,0 +1,81 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeprecationPolicyApply(t *testing.T) {
+	sunset := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	d, err := NewDeprecationPolicy([]Deprecation{
+		{Metric: "legacy_*", Replacement: "modern_total", Sunset: sunset},
+		{Metric: "old_gauge", Sunset: sunset, AfterSunset: "reject"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		input        string
+		now          time.Time
+		enforce      bool
+		wantNames    string
+		wantStripped string
+		wantErr      string
+	}{
+		{
+			name:      "before the sunset",
+			input:     "# TYPE legacy_total counter\nlegacy_total 1\n# TYPE up gauge\nup 1\n",
+			now:       sunset.Add(-time.Hour),
+			enforce:   true,
+			wantNames: "legacy_total up",
+		},
+		{
+			name:         "stripped after the sunset",
+			input:        "# TYPE legacy_total counter\nlegacy_total 1\n# TYPE up gauge\nup 1\n",
+			now:          sunset,
+			enforce:      true,
+			wantNames:    "up",
+			wantStripped: "legacy_total",
+		},
+		{
+			name:      "not enforced for the client",
+			input:     "# TYPE legacy_total counter\nlegacy_total 1\n",
+			now:       sunset,
+			wantNames: "legacy_total",
+		},
+		{
+			name:    "rejected after the sunset",
+			input:   "# TYPE old_gauge gauge\nold_gauge 1\n",
+			now:     sunset,
+			enforce: true,
+			wantErr: "metrics past their deprecation sunset: old_gauge",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families, stripped, err := d.Apply(parseFamilies(t, tt.input), tt.now, tt.enforce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, mf := range families {
+				names = append(names, mf.GetName())
+			}
+			if strings.Join(names, " ") != tt.wantNames {
+				t.Errorf("families %v, want %s", names, tt.wantNames)
+			}
+			if strings.Join(stripped, " ") != tt.wantStripped {
+				t.Errorf("stripped %v, want %s", stripped, tt.wantStripped)
+			}
+		})
+	}
+}
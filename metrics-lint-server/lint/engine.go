@@ -0,0 +1,263 @@
+// Package lint parses metric expositions and checks them against the rules
+// of the lint server, so programs can lint metrics in-process instead of
+// calling the server's /lint endpoint.
+package lint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Rules reported when a push or exposition is rejected, which are also the
+// codes of the problems they find.
+const (
+	RuleParse               = "parse"
+	RuleUntypedMetrics      = "untyped_metrics"
+	RuleUTF8Names           = "utf8_names"
+	RuleRenames             = "renames"
+	RuleDeprecations        = "deprecations"
+	RulePathNormalization   = "path_normalization"
+	RuleGroupingKeyConflict = "grouping_key_conflict"
+)
+
+// Config holds the policies the engine applies. It is read from the lint
+// server's config file, whose other sections are ignored.
+type Config struct {
+	// UTF8Names is the policy for names outside the legacy character set.
+	UTF8Names UTF8Names `yaml:"utf8_names"`
+
+	// UntypedMetrics is the policy for metrics pushed without a type: warn
+	// (default), reject, or infer the type from the metric's name and labels.
+	UntypedMetrics string `yaml:"untyped_metrics"`
+
+	// Renames lists metrics being migrated to a new name, with a window in
+	// which both names are forwarded.
+	Renames []MetricRename `yaml:"renames"`
+
+	// Deprecations lists metrics being retired, with the date after which
+	// they are no longer accepted.
+	Deprecations []Deprecation `yaml:"deprecations"`
+
+	// PathNormalization lists labels holding URL paths and the route
+	// templates their IDs are collapsed with.
+	PathNormalization []PathNormalizer `yaml:"path_normalization"`
+}
+
+// LoadConfig reads the engine's policies from a lint server config file. An
+// empty path yields the default configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Engine lints expositions. It is safe for concurrent use.
+type Engine struct {
+	names        *NamePolicy
+	untyped      *UntypedPolicy
+	renames      *RenameMap
+	deprecations *DeprecationPolicy
+	paths        *PathPolicy
+	// now is the clock rename windows and sunsets are evaluated at.
+	now func() time.Time
+}
+
+// New returns an engine applying the policies in cfg.
+func New(cfg Config) (*Engine, error) {
+	e := &Engine{now: time.Now}
+	var err error
+	if e.names, err = NewNamePolicy(cfg.UTF8Names); err != nil {
+		return nil, err
+	}
+	if e.untyped, err = NewUntypedPolicy(cfg.UntypedMetrics); err != nil {
+		return nil, err
+	}
+	if e.renames, err = NewRenameMap(cfg.Renames); err != nil {
+		return nil, err
+	}
+	if e.deprecations, err = NewDeprecationPolicy(cfg.Deprecations); err != nil {
+		return nil, err
+	}
+	if e.paths, err = NewPathPolicy(cfg.PathNormalization); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Lint parses the exposition read from r in the format of contentType, a
+// Content-Type header value, and lints it like LintFamilies does without a
+// grouping key. Names escaped by the content type's escaping= parameter are
+// unescaped first, as the push proxy does. Input that cannot be parsed or that a policy
+// rejects yields a report with status error; the returned error is only set
+// if r cannot be read or ctx is done.
+func (e *Engine) Lint(ctx context.Context, r io.Reader, contentType string) (Report, error) {
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Report{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return Report{Status: "error", Message: "No input provided. Please send metrics in the request body."}, nil
+	}
+
+	families, err := Decode(bytes.NewReader(data), ParseFormat(contentType))
+	if err == nil {
+		err = UnescapeNames(families, contentType)
+	}
+	if err != nil {
+		return Report{Status: "error", Message: "Failed to parse metrics", Rule: RuleParse, ErrorText: err.Error()}, nil
+	}
+	return e.LintFamilies(families, nil, nil).Report, nil
+}
+
+// Options adapt LintFamilies to a push proxy.
+type Options struct {
+	// Now is the time rename windows and sunsets are evaluated at, instead
+	// of the engine's clock.
+	Now time.Time
+	// Enforced reports whether a rule in canary rollout is enforced for the
+	// pushing client. Policies of rules it is not enforced for only warn.
+	// Without it every rule is enforced.
+	Enforced func(rule string) bool
+	// Stages run in order after the engine's policies.
+	Stages []Stage
+}
+
+// Stage is a step of a push pipeline that the engine does not implement,
+// such as rebucketing histograms.
+type Stage struct {
+	// Rule and Message are reported when the stage rejects the families.
+	Rule    string
+	Message string
+	// Apply returns the families, whether it changed them, and the
+	// problems it found, or an error rejecting the families.
+	Apply func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []ProblemDetails, error)
+}
+
+// Result is the outcome of LintFamilies. Besides the report it describes
+// what the policies changed, so a push proxy can forward the families.
+type Result struct {
+	Report
+	// Families are the families after the policies and stages applied.
+	Families []*dto.MetricFamily
+	// Changed is set when a policy or stage modified the families.
+	Changed bool
+	// Escaping is the escaping names must be forwarded with.
+	Escaping     model.EscapingScheme
+	EscapedNames map[string]string
+	Inferred     []TypeInference
+	Renamed      []RenameAction
+	// Deprecated are the deprecated metrics among the renamed families.
+	Deprecated []string
+	// Matched maps the canary rules the families were checked against to
+	// whether the families break them, whether or not they are enforced.
+	Matched map[string]bool
+}
+
+// LintFamilies applies the policies and stages to decoded families in the
+// order the push proxy does and lints the result, as if the families were
+// pushed under the grouping key groupLabels, which may be nil. A nil opts
+// enforces every rule at the engine's clock. The families may be modified.
+func (e *Engine) LintFamilies(families []*dto.MetricFamily, groupLabels model.LabelSet, opts *Options) Result {
+	if opts == nil {
+		opts = &Options{}
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = e.now()
+	}
+	enforced := func(rule string) bool { return opts.Enforced == nil || opts.Enforced(rule) }
+	untyped, names := e.untyped, e.names
+	if !enforced(RuleUntypedMetrics) {
+		untyped = untyped.Relaxed()
+	}
+	if !enforced(RuleUTF8Names) {
+		names = names.Relaxed()
+	}
+
+	res := Result{Matched: map[string]bool{}}
+	reject := func(rule, message string, err error) Result {
+		res.Report = Report{Status: "error", Message: message, Rule: rule, ErrorText: err.Error()}
+		return res
+	}
+	res.Matched[RuleUntypedMetrics] = len(UntypedNames(families)) > 0
+	families, inferred, err := untyped.Apply(families)
+	if err != nil {
+		return reject(RuleUntypedMetrics, "Untyped metrics rejected", err)
+	}
+	families, renamed, err := e.renames.Apply(families, now)
+	if err != nil {
+		return reject(RuleRenames, "Failed to rename metrics", err)
+	}
+	res.Matched[RuleDeprecations] = len(e.deprecations.PastSunset(families, now)) > 0
+	res.Deprecated = e.deprecations.Deprecated(families)
+	families, stripped, err := e.deprecations.Apply(families, now, enforced(RuleDeprecations))
+	if err != nil {
+		return reject(RuleDeprecations, "Deprecated metrics rejected", err)
+	}
+	res.Matched[RuleUTF8Names] = len(NonLegacyNames(families)) > 0
+	escapedNames, err := names.Apply(families)
+	if err != nil {
+		return reject(RuleUTF8Names, "UTF-8 names rejected", err)
+	}
+	changed, err := e.paths.Normalize(families)
+	if err != nil {
+		return reject(RulePathNormalization, "Failed to normalize path labels", err)
+	}
+	res.Changed = changed || len(inferred) > 0 || len(renamed) > 0 || len(stripped) > 0 || len(escapedNames) > 0
+	res.Escaping = names.ForwardEscaping()
+	res.EscapedNames, res.Inferred, res.Renamed = escapedNames, inferred, renamed
+
+	var stageProblems []ProblemDetails
+	for _, s := range opts.Stages {
+		var problems []ProblemDetails
+		families, changed, problems, err = s.Apply(families)
+		if err != nil {
+			return reject(s.Rule, s.Message, err)
+		}
+		res.Changed = res.Changed || changed
+		stageProblems = append(stageProblems, problems...)
+	}
+	res.Families = families
+
+	problems := Run(families, append(StaticChecks(families),
+		Check{RulePathNormalization, e.paths.LintUnnormalizedPaths},
+		Check{RuleGroupingKeyConflict, GroupingKeyConflicts(groupLabels)},
+		Check{RuleUTF8Names, names.LintUTF8Names},
+		Check{RuleUntypedMetrics, untyped.LintUntyped},
+		Check{RuleDeprecations, e.deprecations.LintDeprecated(now)},
+	))
+	problems = append(problems, CutoverProblems(renamed)...)
+	problems = append(problems, e.deprecations.StrippedProblems(stripped)...)
+	problems = append(problems, stageProblems...)
+
+	res.Report = Report{Status: "success", Message: "Input has been parsed successfully. No issues found."}
+	if len(problems) > 0 {
+		res.Status = "warning"
+		res.Message = "The input can be parsed but there are linting issues"
+		res.Problems = problems
+	}
+	return res
+}
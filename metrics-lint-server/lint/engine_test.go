@@ -0,0 +1,180 @@
+package lint
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+func TestEngineLintFamilies(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	e, err := New(Config{
+		UntypedMetrics:    "reject",
+		Renames:           []MetricRename{{From: "reqs_total", To: "requests_total", End: now}},
+		Deprecations:      []Deprecation{{Metric: "legacy_*", Sunset: now}, {Metric: "old_*", Sunset: now, AfterSunset: "reject"}},
+		PathNormalization: []PathNormalizer{{Labels: []string{"endpoint"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.now = func() time.Time { return now }
+
+	tests := []struct {
+		name        string
+		input       string
+		groupLabels model.LabelSet
+		wantStatus  string
+		wantRule    string
+		want        string // codes of the problems
+	}{
+		{
+			name:       "clean",
+			input:      "# HELP up Up.\n# TYPE up gauge\nup 1\n",
+			wantStatus: "success",
+		},
+		{
+			name:       "untyped metrics rejected",
+			input:      "up 1\n",
+			wantStatus: "error",
+			wantRule:   RuleUntypedMetrics,
+		},
+		{
+			name:       "renamed after the cutover",
+			input:      "# HELP reqs_total Requests.\n# TYPE reqs_total counter\nreqs_total 1\n",
+			wantStatus: "warning",
+			want:       "renames",
+		},
+		{
+			name:       "stripped after the sunset",
+			input:      "# HELP legacy_total Legacy.\n# TYPE legacy_total counter\nlegacy_total 1\n",
+			wantStatus: "warning",
+			want:       "deprecations",
+		},
+		{
+			name:       "rejected after the sunset",
+			input:      "# HELP old_total Old.\n# TYPE old_total counter\nold_total 1\n",
+			wantStatus: "error",
+			wantRule:   RuleDeprecations,
+		},
+		{
+			name:       "colliding paths",
+			input:      "# HELP in_flight In flight.\n# TYPE in_flight gauge\nin_flight{endpoint=\"/users/1\"} 1\nin_flight{endpoint=\"/users/2\"} 1\n",
+			wantStatus: "error",
+			wantRule:   RulePathNormalization,
+		},
+		{
+			name:       "unnormalized path label",
+			input:      "# HELP up Up.\n# TYPE up gauge\nup{path=\"/users/1\"} 1\n",
+			wantStatus: "warning",
+			want:       "path_normalization",
+		},
+		{
+			name:        "grouping key conflict",
+			input:       "# HELP up Up.\n# TYPE up gauge\nup{instance=\"b\"} 1\n",
+			groupLabels: model.LabelSet{"job": "batch", "instance": "a"},
+			wantStatus:  "warning",
+			want:        "grouping_key_conflict",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := e.LintFamilies(parseFamilies(t, tt.input), tt.groupLabels, nil)
+			var codes []string
+			for _, p := range report.Problems {
+				codes = append(codes, p.Code)
+			}
+			sort.Strings(codes)
+			if report.Status != tt.wantStatus || report.Rule != tt.wantRule || strings.Join(codes, " ") != tt.want {
+				t.Errorf("got %s %q %v (%s), want %s %q %s", report.Status, report.Rule, codes, report.ErrorText, tt.wantStatus, tt.wantRule, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineLintFamiliesOptions(t *testing.T) {
+	e, err := New(Config{UntypedMetrics: "reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relaxed := func(rule string) bool { return rule != RuleUntypedMetrics }
+	drop := Stage{Rule: "drop", Apply: func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []ProblemDetails, error) {
+		return families[:0], true, []ProblemDetails{{Metric: "up", Text: "dropped", Code: "drop"}}, nil
+	}}
+	refuse := Stage{Rule: "refuse", Message: "Refused", Apply: func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []ProblemDetails, error) {
+		return nil, false, nil, errors.New("no")
+	}}
+
+	tests := []struct {
+		name        string
+		opts        *Options
+		wantStatus  string
+		wantRule    string
+		want        string // codes of the problems
+		wantChanged bool
+	}{
+		{name: "enforced", opts: &Options{}, wantStatus: "error", wantRule: RuleUntypedMetrics},
+		{name: "relaxed", opts: &Options{Enforced: relaxed}, wantStatus: "warning", want: "help untyped_metrics"},
+		{name: "stage", opts: &Options{Enforced: relaxed, Stages: []Stage{drop}}, wantStatus: "warning", want: "drop", wantChanged: true},
+		{name: "rejecting stage", opts: &Options{Enforced: relaxed, Stages: []Stage{refuse, drop}}, wantStatus: "error", wantRule: "refuse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := e.LintFamilies(parseFamilies(t, "up 1\n"), nil, tt.opts)
+			var codes []string
+			for _, p := range result.Problems {
+				codes = append(codes, p.Code)
+			}
+			sort.Strings(codes)
+			if result.Status != tt.wantStatus || result.Rule != tt.wantRule || strings.Join(codes, " ") != tt.want || result.Changed != tt.wantChanged {
+				t.Errorf("got %s %q %v changed %v, want %s %q %s changed %v", result.Status, result.Rule, codes, result.Changed, tt.wantStatus, tt.wantRule, tt.want, tt.wantChanged)
+			}
+			// Rules are matched whether or not they are enforced.
+			if !result.Matched[RuleUntypedMetrics] {
+				t.Errorf("untyped metrics not matched: %v", result.Matched)
+			}
+		})
+	}
+}
+
+func TestEngineLint(t *testing.T) {
+	e, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		input       string
+		wantStatus  string
+		wantRule    string
+	}{
+		{name: "empty", input: " \n", wantStatus: "error"},
+		{name: "unparsable", input: "up{ 1\n", wantStatus: "error", wantRule: RuleParse},
+		{name: "problems", input: "# TYPE up gauge\nup 1\n", wantStatus: "warning"},
+		{name: "escaped names", contentType: "text/plain; version=0.0.4; escaping=dots", input: "# HELP up_dot_time Up.\n# TYPE up_dot_time gauge\nup_dot_time 1\n", wantStatus: "warning"},
+		{name: "unknown escaping", contentType: "text/plain; version=0.0.4; escaping=hex", input: "up 1\n", wantStatus: "error", wantRule: RuleParse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := e.Lint(context.Background(), strings.NewReader(tt.input), tt.contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != tt.wantStatus || report.Rule != tt.wantRule {
+				t.Errorf("got %s %q, want %s %q", report.Status, report.Rule, tt.wantStatus, tt.wantRule)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.Lint(ctx, strings.NewReader("up 1\n"), ""); err == nil {
+		t.Error("no error for a cancelled context")
+	}
+}
@@ -0,0 +1,93 @@
+package lint
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Format is an exposition format the engine can parse.
+type Format int
+
+const (
+	// FormatText is the Prometheus text format.
+	FormatText Format = iota
+	// FormatProtobuf is length-delimited protobuf MetricFamily messages.
+	FormatProtobuf
+	// FormatOpenMetrics is OpenMetrics text.
+	FormatOpenMetrics
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatProtobuf:
+		return "protobuf"
+	case FormatOpenMetrics:
+		return "openmetrics"
+	}
+	return "text"
+}
+
+// ParseFormat returns the format of a Content-Type header value. Anything
+// that is neither delimited protobuf nor OpenMetrics is read as text, as the
+// Pushgateway does.
+func ParseFormat(contentType string) Format {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return FormatText
+	}
+	switch {
+	case mediatype == expfmt.OpenMetricsType:
+		return FormatOpenMetrics
+	case mediatype == expfmt.ProtoType && params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited":
+		return FormatProtobuf
+	}
+	return FormatText
+}
+
+// Decode reads all metric families from r, sorted by name. OpenMetrics is
+// parsed with Prometheus' parser, see decodeOpenMetrics.
+func Decode(r io.Reader, f Format) ([]*dto.MetricFamily, error) {
+	if f == FormatProtobuf {
+		return DecodeFamilies(r, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if f == FormatOpenMetrics {
+		families, err := decodeOpenMetrics(data)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+		return families, nil
+	}
+	// The text parser requires the last line to be terminated.
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return DecodeFamilies(bytes.NewReader(data), expfmt.NewFormat(expfmt.TypeTextPlain))
+}
+
+// DecodeFamilies reads all metric families from r, sorted by name.
+func DecodeFamilies(r io.Reader, format expfmt.Format) ([]*dto.MetricFamily, error) {
+	dec := expfmt.NewDecoder(r, format)
+	var families []*dto.MetricFamily
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
@@ -0,0 +1,29 @@
+package lint
+
+import (
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// GroupingKeyConflicts returns a promlint validation flagging metric
+// labels that are also in the grouping key with a different value, which the
+// gateway rejects.
+func GroupingKeyConflicts(groupLabels model.LabelSet) func(*dto.MetricFamily) []error {
+	return func(mf *dto.MetricFamily) []error {
+		var errs []error
+		reported := map[string]bool{}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				gv, ok := groupLabels[model.LabelName(lp.GetName())]
+				if !ok || string(gv) == lp.GetValue() || reported[lp.GetName()] {
+					continue
+				}
+				reported[lp.GetName()] = true
+				errs = append(errs, fmt.Errorf("label %q=%q conflicts with the grouping key value %q", lp.GetName(), lp.GetValue(), gv))
+			}
+		}
+		return errs
+	}
+}
@@ -0,0 +1,34 @@
+package lint
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// parseFamilies decodes a text exposition.
+func parseFamilies(t *testing.T, text string) []*dto.MetricFamily {
+	t.Helper()
+	families, err := Decode(strings.NewReader(strings.TrimLeft(text, "\n")), FormatText)
+	if err != nil {
+		t.Fatalf("parsing families: %v", err)
+	}
+	return families
+}
+
+// formatFamilies encodes families in the text format, for comparing them
+// with an expected exposition.
+func formatFamilies(t *testing.T, families []*dto.MetricFamily) string {
+	t.Helper()
+	var b bytes.Buffer
+	enc := expfmt.NewEncoder(&b, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatalf("encoding families: %v", err)
+		}
+	}
+	return b.String()
+}
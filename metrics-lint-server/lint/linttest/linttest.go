@@ -0,0 +1,171 @@
+// Package linttest provides test assertions that fail when instrumentation
+// violates the lint server's rules, so policy violations are caught in unit
+// tests before metrics are ever pushed.
+package linttest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// LoadProfile reads the rules to assert from a lint server config file and
+// fails the test if it cannot be loaded.
+func LoadProfile(t testing.TB, path string) lint.Config {
+	t.Helper()
+	cfg, err := lint.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading lint profile: %v", err)
+	}
+	return *cfg
+}
+
+// AssertGathererClean gathers the metrics of g and fails the test for every
+// problem the profile's rules find. The gathered families are linted as
+// they are; positions are lines of their text exposition, in which names
+// outside the legacy character set are quoted rather than escaped.
+func AssertGathererClean(t testing.TB, g prometheus.Gatherer, profile lint.Config) {
+	t.Helper()
+	engine := newEngine(t, profile)
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	var b bytes.Buffer
+	enc := expfmt.NewEncoder(&b, expfmt.NewFormat(expfmt.TypeTextPlain).WithEscapingScheme(model.NoEscaping))
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatalf("encoding gathered metrics: %v", err)
+		}
+	}
+	report(t, "gathered metrics", b.Bytes(), engine.LintFamilies(families, nil, nil).Report)
+}
+
+// AssertExpositionClean reads a text or OpenMetrics exposition from r and
+// fails the test for every problem the profile's rules find, with the line
+// each problem's metric first appears on.
+func AssertExpositionClean(t testing.TB, r io.Reader, profile lint.Config) {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading exposition: %v", err)
+	}
+	format := expfmt.NewFormat(expfmt.TypeTextPlain)
+	if bytes.HasSuffix(bytes.TrimSpace(data), []byte("# EOF")) {
+		format = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	}
+	assertClean(t, "exposition", data, string(format), profile)
+}
+
+func newEngine(t testing.TB, profile lint.Config) *lint.Engine {
+	t.Helper()
+	engine, err := lint.New(profile)
+	if err != nil {
+		t.Fatalf("invalid lint profile: %v", err)
+	}
+	return engine
+}
+
+func assertClean(t testing.TB, source string, data []byte, contentType string, profile lint.Config) {
+	t.Helper()
+	engine := newEngine(t, profile)
+	r, err := engine.Lint(context.Background(), bytes.NewReader(data), contentType)
+	if err != nil {
+		t.Fatalf("linting %s: %v", source, err)
+	}
+	report(t, source, data, r)
+}
+
+// report fails the test for a rejected exposition or for each problem,
+// with the line of data the problem's metric first appears on.
+func report(t testing.TB, source string, data []byte, r lint.Report) {
+	t.Helper()
+	if r.Status == "error" {
+		if r.ErrorText == "" {
+			t.Errorf("%s: %s", source, r.Message)
+			return
+		}
+		t.Errorf("%s: %s (%s): %s", source, r.Message, r.Rule, r.ErrorText)
+		return
+	}
+
+	lines := metricLines(data)
+	for _, p := range r.Problems {
+		if line, ok := lines[p.Metric]; ok {
+			t.Errorf("%s:%d: %s: %s (%s)", source, line, p.Metric, p.Text, p.Code)
+		} else {
+			t.Errorf("%s: %s: %s (%s)", source, p.Metric, p.Text, p.Code)
+		}
+	}
+}
+
+// metricLines maps metric names to the first line they appear on, in a
+// HELP or TYPE comment or as a sample. Samples of histograms and summaries
+// are also recorded under the family name.
+func metricLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	record := func(name string, line int) {
+		if _, ok := lines[name]; !ok {
+			lines[name] = line
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(text, "#") {
+			if f := strings.Fields(text); len(f) >= 3 && (f[1] == "HELP" || f[1] == "TYPE") {
+				rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text[1:]), f[1]))
+				if name := leadingName(rest); name != "" {
+					record(name, line)
+					// OpenMetrics counter families are named without
+					// the _total suffix their samples and problems have.
+					if f[1] == "TYPE" && f[len(f)-1] == "counter" && !strings.HasSuffix(name, "_total") {
+						record(name+"_total", line)
+					}
+				}
+			}
+			continue
+		}
+		// Names outside the legacy character set are quoted inside the
+		// braces: {"my.metric",label="value"} 1
+		name := leadingName(strings.TrimPrefix(text, "{"))
+		if name == "" {
+			continue
+		}
+		record(name, line)
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); base != name {
+				record(base, line)
+			}
+		}
+	}
+	return lines
+}
+
+// leadingName returns the metric name at the start of s, either quoted or
+// up to the first brace or space.
+func leadingName(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return ""
+		}
+		name, _ := strconv.Unquote(quoted)
+		return name
+	}
+	if end := strings.IndexAny(s, "{ \t"); end >= 0 {
+		s = s[:end]
+	}
+	return s
+}
@@ -0,0 +1,159 @@
+package linttest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// recorder is a testing.TB collecting the failures of an assertion.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+// failures runs assert against a recorder and returns its failures.
+func failures(t *testing.T, assert func(testing.TB)) []string {
+	r := &recorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert(r)
+	}()
+	<-done
+	return r.failures
+}
+
+func TestAssertExpositionClean(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile lint.Config
+		input   string
+		want    []string
+	}{
+		{
+			name:  "clean",
+			input: "# HELP jobs_total Jobs processed.\n# TYPE jobs_total counter\njobs_total 3\n",
+		},
+		{
+			name:  "problem with its line",
+			input: "# HELP up Up.\n# TYPE up gauge\nup 1\n# TYPE jobs_total counter\njobs_total 3\n",
+			want:  []string{"exposition:4: jobs_total: no help text (help)"},
+		},
+		{
+			name:    "deprecated metric",
+			profile: lint.Config{Deprecations: []lint.Deprecation{{Metric: "legacy_*", Replacement: "jobs_total"}}},
+			input:   "# HELP legacy_total Legacy.\n# TYPE legacy_total counter\nlegacy_total 3\n",
+			want:    []string{"exposition:1: legacy_total: metric is deprecated; use jobs_total instead (deprecations)"},
+		},
+		{
+			name:    "rename past its cutover",
+			profile: lint.Config{Renames: []lint.MetricRename{{From: "reqs_total", To: "requests_total", End: time.Unix(1, 0)}}},
+			input:   "# HELP reqs_total Requests.\n# TYPE reqs_total counter\nreqs_total 3\n",
+			want:    []string{"exposition:1: reqs_total: metric was renamed to requests_total and is no longer forwarded under this name; update the client (renames)"},
+		},
+		{
+			name:    "unnormalized path",
+			profile: lint.Config{PathNormalization: []lint.PathNormalizer{{Labels: []string{"endpoint"}}}},
+			input:   "# HELP up Up.\n# TYPE up gauge\nup{path=\"/users/1\"} 1\n",
+			want:    []string{`exposition:1: up: label "path" contains unnormalized IDs in paths like "/users/1"; add it to path_normalization (path_normalization)`},
+		},
+		{
+			name:    "rejected",
+			profile: lint.Config{UntypedMetrics: "reject"},
+			input:   "up 1\n",
+			want:    []string{"exposition: Untyped metrics rejected (untyped_metrics): metrics without a type are not accepted: up"},
+		},
+		{
+			name:  "OpenMetrics",
+			input: "# HELP up Up.\n# TYPE up gauge\nup 1\n# TYPE jobs counter\njobs_total 3\n# EOF\n",
+			want:  []string{"exposition:4: jobs_total: no help text (help)"},
+		},
+		{
+			name:    "invalid profile",
+			profile: lint.Config{UntypedMetrics: "drop"},
+			input:   "up 1\n",
+			want:    []string{`invalid lint profile: unknown untyped_metrics policy "drop", expected warn, reject or infer`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := failures(t, func(t testing.TB) {
+				AssertExpositionClean(t, strings.NewReader(tt.input), tt.profile)
+			})
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("failures\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestAssertGathererClean(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile lint.Config
+		want    []string
+	}{
+		{
+			name: "UTF-8 names are linted unescaped",
+			want: []string{
+				`gathered metrics:4: my.requests_total: label name "status.code" needs the quoted UTF-8 syntax, which legacy gateways and scrapers reject (utf8_names)`,
+				"gathered metrics:4: my.requests_total: metric name needs the quoted UTF-8 syntax, which legacy gateways and scrapers reject (utf8_names)",
+			},
+		},
+		{
+			name:    "UTF-8 names allowed",
+			profile: lint.Config{UTF8Names: lint.UTF8Names{Policy: "allow"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			queue := prometheus.NewGauge(prometheus.GaugeOpts{Name: "jobs_queued", Help: "Jobs waiting to run."})
+			requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "my.requests_total", Help: "Requests handled."}, []string{"status.code"})
+			requests.WithLabelValues("200").Inc()
+			reg.MustRegister(queue, requests)
+
+			got := failures(t, func(t testing.TB) {
+				AssertGathererClean(t, reg, tt.profile)
+			})
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("failures\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestMetricLines(t *testing.T) {
+	data := []byte(`# HELP "my.latency_seconds" Latency.
+# TYPE "my.latency_seconds" histogram
+{"my.latency_seconds_bucket",le="+Inf"} 1
+{"my.latency_seconds_sum"} 1
+{"my.latency_seconds_count"} 1
+
+up{job="a"} 1
+`)
+	lines := metricLines(data)
+	for name, want := range map[string]int{"my.latency_seconds": 1, "my.latency_seconds_sum": 4, "up": 7} {
+		if lines[name] != want {
+			t.Errorf("line of %s is %d, want %d", name, lines[name], want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package lint
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// UTF8Names configures how metric and label names outside the legacy
+// [a-zA-Z_:][a-zA-Z0-9_:]* character set are handled before forwarding.
+type UTF8Names struct {
+	// Policy is "warn" (default) to forward names unchanged with a lint
+	// warning, "reject" to refuse such pushes, "escape" to escape names for
+	// a legacy gateway, or "allow" to forward them silently.
+	Policy string `yaml:"policy"`
+	// Escaping is the scheme used by the escape policy: underscores
+	// (default), dots or values.
+	Escaping string `yaml:"escaping"`
+}
+
+// NamePolicy applies the UTF-8 name policy to pushed families.
+type NamePolicy struct {
+	mode   string
+	scheme model.EscapingScheme
+}
+
+// NewNamePolicy returns the policy configured by cfg.
+func NewNamePolicy(cfg UTF8Names) (*NamePolicy, error) {
+	p := &NamePolicy{mode: cfg.Policy, scheme: model.UnderscoreEscaping}
+	switch p.mode {
+	case "":
+		p.mode = "warn"
+	case "warn", "reject", "escape", "allow":
+	default:
+		return nil, fmt.Errorf("unknown utf8_names policy %q, expected warn, reject, escape or allow", cfg.Policy)
+	}
+	if cfg.Escaping != "" {
+		scheme, err := model.ToEscapingScheme(cfg.Escaping)
+		if err != nil || scheme == model.NoEscaping {
+			return nil, fmt.Errorf("invalid utf8_names escaping %q, expected underscores, dots or values", cfg.Escaping)
+		}
+		p.scheme = scheme
+	}
+	return p, nil
+}
+
+// Relaxed returns the policy for clients a canary rollout does not enforce
+// it for: reject and escape only warn.
+func (p *NamePolicy) Relaxed() *NamePolicy {
+	if p.mode == "reject" || p.mode == "escape" {
+		return &NamePolicy{mode: "warn", scheme: p.scheme}
+	}
+	return p
+}
+
+// Mode returns the effective policy: warn, reject, escape or allow.
+func (p *NamePolicy) Mode() string {
+	return p.mode
+}
+
+// NonLegacyNames returns the sorted metric and label names in families that
+// need the UTF-8 syntax.
+func NonLegacyNames(families []*dto.MetricFamily) []string {
+	seen := map[string]bool{}
+	for _, mf := range families {
+		if !model.IsValidLegacyMetricName(mf.GetName()) {
+			seen[mf.GetName()] = true
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if !model.LabelName(lp.GetName()).IsValidLegacy() {
+					seen[lp.GetName()] = true
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply enforces the policy. It returns the escaped form of every UTF-8
+// name when the names will be escaped on forwarding, and an error when the
+// push must be rejected.
+func (p *NamePolicy) Apply(families []*dto.MetricFamily) (map[string]string, error) {
+	names := NonLegacyNames(families)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	switch p.mode {
+	case "reject":
+		return nil, fmt.Errorf("names outside the legacy character set are not accepted: %s", strings.Join(names, ", "))
+	case "escape":
+		escaped := make(map[string]string, len(names))
+		for _, n := range names {
+			escaped[n] = model.EscapeName(n, p.scheme)
+		}
+		return escaped, nil
+	}
+	return nil, nil
+}
+
+// ForwardEscaping is the escaping applied when re-encoding a push for the
+// gateway. Without the escape policy names are forwarded unchanged.
+func (p *NamePolicy) ForwardEscaping() model.EscapingScheme {
+	if p.mode == "escape" {
+		return p.scheme
+	}
+	return model.NoEscaping
+}
+
+// LintUTF8Names is a promlint validation flagging names that need the UTF-8
+// syntax when the policy is warn.
+func (p *NamePolicy) LintUTF8Names(mf *dto.MetricFamily) []error {
+	if p.mode != "warn" {
+		return nil
+	}
+	var errs []error
+	if !model.IsValidLegacyMetricName(mf.GetName()) {
+		errs = append(errs, fmt.Errorf("metric name needs the quoted UTF-8 syntax, which legacy gateways and scrapers reject"))
+	}
+	reported := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if !model.LabelName(lp.GetName()).IsValidLegacy() && !reported[lp.GetName()] {
+				reported[lp.GetName()] = true
+				errs = append(errs, fmt.Errorf("label name %q needs the quoted UTF-8 syntax, which legacy gateways and scrapers reject", lp.GetName()))
+			}
+		}
+	}
+	return errs
+}
+
+// UnescapeNames restores the original names of families escaped with the
+// reversible scheme (dots or values) declared by the escaping= parameter of
+// contentType. Underscore escaping loses information and is left as is. An
+// unknown scheme is an error.
+func UnescapeNames(families []*dto.MetricFamily, contentType string) error {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params[model.EscapingKey] == "" {
+		return nil
+	}
+	scheme, err := model.ToEscapingScheme(params[model.EscapingKey])
+	if err != nil {
+		return err
+	}
+	if scheme != model.DotsEscaping && scheme != model.ValueEncodingEscaping {
+		return nil
+	}
+	for _, mf := range families {
+		mf.Name = proto.String(model.UnescapeName(mf.GetName(), scheme))
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				lp.Name = proto.String(model.UnescapeName(lp.GetName(), scheme))
+			}
+		}
+	}
+	return nil
+}
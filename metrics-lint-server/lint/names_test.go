@@ -0,0 +1,158 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+)
+
+const utf8Exposition = `# TYPE "http.requests" counter
+{"http.requests","service.name"="api",code="200"} 1
+# TYPE queue_size gauge
+queue_size 2
+`
+
+func TestNamePolicyApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         UTF8Names
+		relaxed     bool
+		wantEscaped string // name=escaped pairs
+		wantErr     bool
+		wantLint    int
+		wantForward string
+	}{
+		{name: "warn by default", wantLint: 2, wantForward: "allow-utf-8"},
+		{name: "allow", cfg: UTF8Names{Policy: "allow"}, wantForward: "allow-utf-8"},
+		{name: "reject", cfg: UTF8Names{Policy: "reject"}, wantErr: true, wantForward: "allow-utf-8"},
+		{name: "relaxed reject warns", cfg: UTF8Names{Policy: "reject"}, relaxed: true, wantLint: 2, wantForward: "allow-utf-8"},
+		{
+			name:        "escape with underscores",
+			cfg:         UTF8Names{Policy: "escape"},
+			wantEscaped: "http.requests=http_requests service.name=service_name",
+			wantForward: "underscores",
+		},
+		{
+			name:        "escape with dots",
+			cfg:         UTF8Names{Policy: "escape", Escaping: "dots"},
+			wantEscaped: "http.requests=http_dot_requests service.name=service_dot_name",
+			wantForward: "dots",
+		},
+		{name: "relaxed escape warns", cfg: UTF8Names{Policy: "escape"}, relaxed: true, wantLint: 2, wantForward: "allow-utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewNamePolicy(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.relaxed {
+				p = p.Relaxed()
+			}
+			families, err := Decode(strings.NewReader(utf8Exposition), FormatText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			escaped, err := p.Apply(families)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range NonLegacyNames(families) {
+				if e, ok := escaped[n]; ok {
+					got = append(got, n+"="+e)
+				}
+			}
+			if strings.Join(got, " ") != tt.wantEscaped {
+				t.Errorf("escaped %v, want %s", got, tt.wantEscaped)
+			}
+			lint := 0
+			for _, mf := range families {
+				lint += len(p.LintUTF8Names(mf))
+			}
+			if lint != tt.wantLint {
+				t.Errorf("%d lint problems, want %d", lint, tt.wantLint)
+			}
+			if got := p.ForwardEscaping().String(); got != tt.wantForward {
+				t.Errorf("forward escaping %s, want %s", got, tt.wantForward)
+			}
+		})
+	}
+}
+
+func TestNewNamePolicyErrors(t *testing.T) {
+	tests := []struct {
+		cfg  UTF8Names
+		want string
+	}{
+		{UTF8Names{Policy: "drop"}, "unknown utf8_names policy"},
+		{UTF8Names{Escaping: "hex"}, "invalid utf8_names escaping"},
+		{UTF8Names{Escaping: "allow-utf-8"}, "invalid utf8_names escaping"},
+	}
+	for _, tt := range tests {
+		if _, err := NewNamePolicy(tt.cfg); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewNamePolicy(%+v) error %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+}
+
+func TestUnescapeNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		input       string
+		want        string // metric name and label name
+		wantErr     bool
+	}{
+		{
+			name:        "dots",
+			contentType: "text/plain; version=0.0.4; escaping=dots",
+			input:       "http_dot_requests{service_dot_name=\"api\"} 1\n",
+			want:        "http.requests service.name",
+		},
+		{
+			name:        "values",
+			contentType: "text/plain; version=0.0.4; escaping=values",
+			input:       "U__http_2e_requests{U__service_2e_name=\"api\"} 1\n",
+			want:        "http.requests service.name",
+		},
+		{
+			name:        "underscores cannot be reversed",
+			contentType: "text/plain; version=0.0.4; escaping=underscores",
+			input:       "http_requests{service_name=\"api\"} 1\n",
+			want:        "http_requests service_name",
+		},
+		{
+			name:        "no escaping",
+			contentType: "text/plain; version=0.0.4",
+			input:       "http_dot_requests{service_dot_name=\"api\"} 1\n",
+			want:        "http_dot_requests service_dot_name",
+		},
+		{
+			name:  "no content type",
+			input: "http_dot_requests{service_dot_name=\"api\"} 1\n",
+			want:  "http_dot_requests service_dot_name",
+		},
+		{
+			name:        "unknown scheme",
+			contentType: "text/plain; version=0.0.4; escaping=hex",
+			input:       "up{job=\"a\"} 1\n",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families := parseFamilies(t, tt.input)
+			err := UnescapeNames(families, tt.contentType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := families[0].GetName() + " " + families[0].GetMetric()[0].GetLabel()[0].GetName()
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package lint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"google.golang.org/protobuf/proto"
+)
+
+// openMetricsFamily is an OpenMetrics family as declared by its metadata.
+type openMetricsFamily struct {
+	name string
+	typ  model.MetricType
+	help *string
+	unit string
+}
+
+// seriesSuffixes are the suffixes of the samples of each OpenMetrics type.
+var seriesSuffixes = map[model.MetricType][]string{
+	model.MetricTypeCounter:        {"_total", "_created"},
+	model.MetricTypeHistogram:      {"_bucket", "_count", "_sum", "_created"},
+	model.MetricTypeGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	model.MetricTypeSummary:        {"", "_count", "_sum", "_created"},
+	model.MetricTypeInfo:           {"_info"},
+}
+
+// owns reports whether a sample of the given name belongs to the family.
+func (f *openMetricsFamily) owns(name string) bool {
+	suffixes, ok := seriesSuffixes[f.typ]
+	if !ok {
+		return name == f.name
+	}
+	for _, s := range suffixes {
+		if name == f.name+s {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeOpenMetrics parses OpenMetrics text with Prometheus' parser into
+// metric families named the way prometheus_client exposes them in the text
+// format:
+//
+//   - counter families are named after their _total samples, and _created
+//     samples of counters, histograms and summaries get their own gauge
+//     family with the parent's help text;
+//   - info families become gauges named <name>_info, stateset families
+//     become gauges and unknown families become untyped;
+//   - gaugehistogram families are decoded as gauge histograms, which only
+//     the protobuf format can carry.
+//
+// Units are set on the families, timestamps are converted to milliseconds and
+// exemplars are dropped. A missing "# EOF" is tolerated, since a push body is
+// delimited by the request.
+func decodeOpenMetrics(data []byte) ([]*dto.MetricFamily, error) {
+	if !bytes.HasSuffix(bytes.TrimRight(data, "\n"), []byte("# EOF")) {
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		data = append(data, "# EOF\n"...)
+	}
+
+	var (
+		parser   = textparse.NewOpenMetricsParser(data, labels.NewSymbolTable())
+		metadata = map[string]*openMetricsFamily{}
+		current  *openMetricsFamily
+		b        = newFamilyBuilder()
+		lset     labels.Labels
+	)
+	family := func(name string) *openMetricsFamily {
+		f, ok := metadata[name]
+		if !ok {
+			f = &openMetricsFamily{name: name, typ: model.MetricTypeUnknown}
+			metadata[name] = f
+		}
+		current = f
+		return f
+	}
+	for {
+		entry, err := parser.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		switch entry {
+		case textparse.EntryType:
+			name, typ := parser.Type()
+			family(string(name)).typ = typ
+		case textparse.EntryHelp:
+			name, help := parser.Help()
+			family(string(name)).help = proto.String(string(help))
+		case textparse.EntryUnit:
+			name, unit := parser.Unit()
+			family(string(name)).unit = string(unit)
+		case textparse.EntrySeries:
+			_, ts, v := parser.Series()
+			parser.Metric(&lset)
+			name := lset.Get(model.MetricNameLabel)
+			f := current
+			if f == nil || !f.owns(name) {
+				f = family(name)
+			}
+			if err := b.add(f, name, lset, ts, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.families, nil
+}
+
+// familyBuilder collects OpenMetrics samples into metric families.
+type familyBuilder struct {
+	families []*dto.MetricFamily
+	byName   map[string]*dto.MetricFamily
+	// series maps a family and label set to the metric of a histogram or
+	// summary, whose samples are spread over several lines.
+	series map[string]*dto.Metric
+}
+
+func newFamilyBuilder() *familyBuilder {
+	return &familyBuilder{byName: map[string]*dto.MetricFamily{}, series: map[string]*dto.Metric{}}
+}
+
+// get returns the family of the given name, creating it with the help and
+// unit of f.
+func (b *familyBuilder) get(name string, typ dto.MetricType, f *openMetricsFamily, unit string) *dto.MetricFamily {
+	mf, ok := b.byName[name]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum(), Help: f.help}
+		if unit != "" {
+			mf.Unit = proto.String(unit)
+		}
+		b.byName[name] = mf
+		b.families = append(b.families, mf)
+	}
+	return mf
+}
+
+// add adds one sample of family f.
+func (b *familyBuilder) add(f *openMetricsFamily, name string, lset labels.Labels, ts *int64, v float64) error {
+	var pairs []*dto.LabelPair
+	var le, quantile string
+	lset.Range(func(l labels.Label) {
+		switch {
+		case l.Name == model.MetricNameLabel:
+		case l.Name == model.BucketLabel && (f.typ == model.MetricTypeHistogram || f.typ == model.MetricTypeGaugeHistogram) && name == f.name+"_bucket":
+			le = l.Value
+		case l.Name == model.QuantileLabel && f.typ == model.MetricTypeSummary && name == f.name:
+			quantile = l.Value
+		default:
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+		}
+	})
+	metric := func(mf *dto.MetricFamily) *dto.Metric {
+		m := &dto.Metric{Label: pairs}
+		if ts != nil {
+			m.TimestampMs = proto.Int64(*ts)
+		}
+		mf.Metric = append(mf.Metric, m)
+		return m
+	}
+
+	if name == f.name+"_created" {
+		metric(b.get(name, dto.MetricType_GAUGE, f, "")).Gauge = &dto.Gauge{Value: proto.Float64(v)}
+		return nil
+	}
+	switch f.typ {
+	case model.MetricTypeCounter:
+		metric(b.get(name, dto.MetricType_COUNTER, f, f.unit)).Counter = &dto.Counter{Value: proto.Float64(v)}
+	case model.MetricTypeGauge, model.MetricTypeStateset, model.MetricTypeInfo:
+		metric(b.get(name, dto.MetricType_GAUGE, f, f.unit)).Gauge = &dto.Gauge{Value: proto.Float64(v)}
+	case model.MetricTypeHistogram, model.MetricTypeGaugeHistogram:
+		typ := dto.MetricType_HISTOGRAM
+		if f.typ == model.MetricTypeGaugeHistogram {
+			typ = dto.MetricType_GAUGE_HISTOGRAM
+		}
+		h := b.compound(b.get(f.name, typ, f, f.unit), pairs, metric).Histogram
+		switch strings.TrimPrefix(name, f.name) {
+		case "_bucket":
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid le %q", name, le)
+			}
+			h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(bound), CumulativeCount: proto.Uint64(uint64(v))})
+		case "_count", "_gcount":
+			h.SampleCount = proto.Uint64(uint64(v))
+		case "_sum", "_gsum":
+			h.SampleSum = proto.Float64(v)
+		}
+	case model.MetricTypeSummary:
+		s := b.compound(b.get(f.name, dto.MetricType_SUMMARY, f, f.unit), pairs, metric).Summary
+		switch strings.TrimPrefix(name, f.name) {
+		case "":
+			q, err := strconv.ParseFloat(quantile, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid quantile %q", name, quantile)
+			}
+			s.Quantile = append(s.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(v)})
+		case "_count":
+			s.SampleCount = proto.Uint64(uint64(v))
+		case "_sum":
+			s.SampleSum = proto.Float64(v)
+		}
+	default:
+		metric(b.get(name, dto.MetricType_UNTYPED, f, f.unit)).Untyped = &dto.Untyped{Value: proto.Float64(v)}
+	}
+	return nil
+}
+
+// compound returns the histogram or summary metric of a label set, adding it
+// to mf on first use.
+func (b *familyBuilder) compound(mf *dto.MetricFamily, pairs []*dto.LabelPair, metric func(*dto.MetricFamily) *dto.Metric) *dto.Metric {
+	key := mf.GetName()
+	for _, p := range pairs {
+		key += "\xff" + p.GetName() + "\xff" + p.GetValue()
+	}
+	if m, ok := b.series[key]; ok {
+		return m
+	}
+	m := metric(mf)
+	if mf.GetType() == dto.MetricType_SUMMARY {
+		m.Summary = &dto.Summary{}
+	} else {
+		m.Histogram = &dto.Histogram{}
+	}
+	b.series[key] = m
+	return m
+}
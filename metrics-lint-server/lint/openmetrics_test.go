@@ -0,0 +1,188 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDecodeOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "counter with created sample",
+			input: `# TYPE requests counter
+# HELP requests Requests served.
+requests_total{code="200"} 3 1700000000.5 # {trace_id="a"} 1
+requests_created{code="200"} 1699999999
+# EOF
+`,
+			want: `# HELP requests_created Requests served.
+# TYPE requests_created gauge
+requests_created{code="200"} 1.699999999e+09
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 3 1700000000500
+`,
+		},
+		{
+			name: "counter without created sample",
+			input: `# TYPE requests counter
+# HELP requests Requests served.
+requests_total 3
+# EOF
+`,
+			want: `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total 3
+`,
+		},
+		{
+			name: "histogram and summary",
+			input: `# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{path="/",le="0.1"} 0
+latency_seconds_bucket{path="/",le="1"} 1
+latency_seconds_bucket{path="/",le="+Inf"} 1
+latency_seconds_count{path="/"} 1
+latency_seconds_sum{path="/"} 0.5
+latency_seconds_created{path="/"} 1699999999
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.2
+rpc_seconds_count 4
+rpc_seconds_sum 1
+# EOF
+`,
+			want: `# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/",le="0.1"} 0
+latency_seconds_bucket{path="/",le="1"} 1
+latency_seconds_bucket{path="/",le="+Inf"} 1
+latency_seconds_sum{path="/"} 0.5
+latency_seconds_count{path="/"} 1
+# TYPE latency_seconds_created gauge
+latency_seconds_created{path="/"} 1.699999999e+09
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.2
+rpc_seconds_sum 1
+rpc_seconds_count 4
+`,
+		},
+		{
+			name: "info, stateset and unknown families",
+			input: `# TYPE build info
+build_info{version="1.0"} 1
+# TYPE state stateset
+state{state="a"} 1
+state{state="b"} 0
+# TYPE misc unknown
+misc 2
+undeclared 3
+# EOF
+`,
+			want: `# TYPE build_info gauge
+build_info{version="1.0"} 1
+# TYPE misc untyped
+misc 2
+# TYPE state gauge
+state{state="a"} 1
+state{state="b"} 0
+# TYPE undeclared untyped
+undeclared 3
+`,
+		},
+		{
+			name:  "missing EOF",
+			input: "# TYPE queue gauge\nqueue 4",
+			want:  "# TYPE queue gauge\nqueue 4\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families, err := Decode(strings.NewReader(tt.input), FormatOpenMetrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatFamilies(t, families); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeOpenMetricsGaugeHistogram(t *testing.T) {
+	families, err := Decode(strings.NewReader(`# TYPE queue_seconds gaugehistogram
+# HELP queue_seconds Time spent queued.
+queue_seconds_bucket{le="1"} 2
+queue_seconds_bucket{le="+Inf"} 3
+queue_seconds_gcount 3
+queue_seconds_gsum 4.5
+# EOF
+`), FormatOpenMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("got %d families, want 1", len(families))
+	}
+	mf := families[0]
+	h := mf.GetMetric()[0].GetHistogram()
+	var buckets []string
+	for _, b := range h.GetBucket() {
+		buckets = append(buckets, fmt.Sprintf("%g:%d", b.GetUpperBound(), b.GetCumulativeCount()))
+	}
+	got := fmt.Sprintf("%s %s %q count=%d sum=%g buckets=%s", mf.GetName(), mf.GetType(), mf.GetHelp(), h.GetSampleCount(), h.GetSampleSum(), strings.Join(buckets, ","))
+	want := `queue_seconds GAUGE_HISTOGRAM "Time spent queued." count=3 sum=4.5 buckets=1:2,+Inf:3`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestDecodeOpenMetricsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "invalid type", input: "# TYPE a bogus\n# EOF\n", wantErr: `invalid metric type "bogus"`},
+		{name: "data after EOF", input: "# EOF\na 1\n", wantErr: "unexpected data after # EOF"},
+		{name: "unit not a suffix", input: "# TYPE a gauge\n# UNIT a seconds\na 1\n# EOF\n", wantErr: `unit "seconds" not a suffix of metric "a"`},
+		{name: "invalid value", input: "a one\n# EOF\n", wantErr: `while parsing: "a one"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(tt.input), FormatOpenMetrics)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeOpenMetricsUnits(t *testing.T) {
+	families, err := Decode(strings.NewReader(`# TYPE request_seconds counter
+# UNIT request_seconds seconds
+request_seconds_total 1.5
+# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_count 1
+latency_seconds_sum 0.5
+# TYPE queue_size gauge
+queue_size 4
+# EOF
+`), FormatOpenMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, mf := range families {
+		got = append(got, mf.GetName()+"="+mf.GetUnit())
+	}
+	want := "latency_seconds=seconds queue_size= request_seconds_total=seconds"
+	if strings.Join(got, " ") != want {
+		t.Errorf("units %s, want %s", strings.Join(got, " "), want)
+	}
+}
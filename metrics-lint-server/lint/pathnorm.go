@@ -0,0 +1,241 @@
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// PathNormalizer collapses IDs in URL path label values into placeholders.
+type PathNormalizer struct {
+	// Labels are the label names holding paths, such as endpoint or path.
+	Labels []string `yaml:"labels"`
+	// Templates are route templates like /api/users/:id, tried in order.
+	// Paths matching no template have numeric IDs, UUIDs and hashes
+	// replaced by :id, :uuid and :hash.
+	Templates []string `yaml:"templates"`
+}
+
+var (
+	numericSegment = regexp.MustCompile(`^\d+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegment    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// idPlaceholder returns the placeholder for an ID-like path segment, or "".
+func idPlaceholder(segment string) string {
+	switch {
+	case numericSegment.MatchString(segment):
+		return ":id"
+	case uuidSegment.MatchString(segment):
+		return ":uuid"
+	case hashSegment.MatchString(segment) && strings.ContainsAny(segment, "0123456789"):
+		return ":hash"
+	}
+	return ""
+}
+
+// splitPath separates a label value into the part before the path (scheme
+// and host of full URLs) and the path itself without query or fragment.
+// ok is false for values that are not paths.
+func splitPath(value string) (prefix, path string, ok bool) {
+	if i := strings.Index(value, "://"); i >= 0 {
+		slash := strings.Index(value[i+3:], "/")
+		if slash < 0 {
+			return "", "", false
+		}
+		prefix, value = value[:i+3+slash], value[i+3+slash:]
+	}
+	if !strings.HasPrefix(value, "/") {
+		return "", "", false
+	}
+	if i := strings.IndexAny(value, "?#"); i >= 0 {
+		value = value[:i]
+	}
+	return prefix, value, true
+}
+
+type pathRule struct {
+	templates [][]string
+}
+
+// normalize returns the templated form of a path label value.
+func (r pathRule) normalize(value string) string {
+	prefix, path, ok := splitPath(value)
+	if !ok {
+		return value
+	}
+	segments := strings.Split(path, "/")
+
+	for _, tmpl := range r.templates {
+		if matchesTemplate(tmpl, segments) {
+			return prefix + strings.Join(tmpl, "/")
+		}
+	}
+	for i, s := range segments {
+		if p := idPlaceholder(s); p != "" {
+			segments[i] = p
+		}
+	}
+	return prefix + strings.Join(segments, "/")
+}
+
+func matchesTemplate(tmpl, segments []string) bool {
+	if len(tmpl) != len(segments) {
+		return false
+	}
+	for i, t := range tmpl {
+		if strings.HasPrefix(t, ":") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PathPolicy applies the configured normalizers to pushed families.
+type PathPolicy struct {
+	rules map[string]pathRule
+}
+
+// NewPathPolicy validates the normalizers.
+func NewPathPolicy(normalizers []PathNormalizer) (*PathPolicy, error) {
+	n := &PathPolicy{rules: map[string]pathRule{}}
+	for i, pn := range normalizers {
+		if len(pn.Labels) == 0 {
+			return nil, fmt.Errorf("path normalizer %d: no labels", i+1)
+		}
+		var rule pathRule
+		for _, t := range pn.Templates {
+			if !strings.HasPrefix(t, "/") {
+				return nil, fmt.Errorf("path normalizer %d: template %q must start with /", i+1, t)
+			}
+			rule.templates = append(rule.templates, strings.Split(t, "/"))
+		}
+		for _, l := range pn.Labels {
+			if _, dup := n.rules[l]; dup {
+				return nil, fmt.Errorf("path normalizer %d: label %q is already normalized", i+1, l)
+			}
+			n.rules[l] = rule
+		}
+	}
+	return n, nil
+}
+
+// Normalize rewrites the designated labels of all families in place. Series
+// that collapse into the same label set are merged: counters and histograms
+// are summed, while colliding gauges, summaries and untyped series are an
+// error since they cannot be combined. It reports whether anything changed.
+func (n *PathPolicy) Normalize(families []*dto.MetricFamily) (bool, error) {
+	if len(n.rules) == 0 {
+		return false, nil
+	}
+	changed := false
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				rule, ok := n.rules[lp.GetName()]
+				if !ok {
+					continue
+				}
+				if v := rule.normalize(lp.GetValue()); v != lp.GetValue() {
+					lp.Value = proto.String(v)
+					changed = true
+				}
+			}
+		}
+		if err := mergeDuplicateSeries(mf); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func mergeDuplicateSeries(mf *dto.MetricFamily) error {
+	seen := make(map[string]*dto.Metric, len(mf.GetMetric()))
+	merged := mf.Metric[:0]
+	for _, m := range mf.GetMetric() {
+		key := SeriesKey(m)
+		first, ok := seen[key]
+		if !ok {
+			seen[key] = m
+			merged = append(merged, m)
+			continue
+		}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			first.Counter.Value = proto.Float64(first.GetCounter().GetValue() + m.GetCounter().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			if err := MergeHistograms(first.GetHistogram(), m.GetHistogram()); err != nil {
+				return fmt.Errorf("%s: %v", mf.GetName(), err)
+			}
+		default:
+			return fmt.Errorf("%s: normalized path labels make %s series collide (%s) and they cannot be merged",
+				mf.GetName(), strings.ToLower(mf.GetType().String()), LabelPairsString(m.GetLabel()))
+		}
+	}
+	mf.Metric = merged
+	return nil
+}
+
+// MergeHistograms adds the counts of h to into. Both must have the same
+// bucket bounds.
+func MergeHistograms(into, h *dto.Histogram) error {
+	if len(into.GetBucket()) != len(h.GetBucket()) {
+		return fmt.Errorf("cannot merge histograms with different buckets")
+	}
+	for i, b := range h.GetBucket() {
+		ib := into.Bucket[i]
+		if ib.GetUpperBound() != b.GetUpperBound() {
+			return fmt.Errorf("cannot merge histograms with different buckets")
+		}
+		ib.CumulativeCount = proto.Uint64(ib.GetCumulativeCount() + b.GetCumulativeCount())
+	}
+	into.SampleCount = proto.Uint64(into.GetSampleCount() + h.GetSampleCount())
+	into.SampleSum = proto.Float64(into.GetSampleSum() + h.GetSampleSum())
+	return nil
+}
+
+// LabelPairsString formats label pairs like a label set, e.g. {a="b"}.
+func LabelPairsString(pairs []*dto.LabelPair) string {
+	ls := model.LabelSet{}
+	for _, lp := range pairs {
+		ls[model.LabelName(lp.GetName())] = model.LabelValue(lp.GetValue())
+	}
+	return ls.String()
+}
+
+// LintUnnormalizedPaths is a promlint validation flagging path-like label
+// values with ID segments in labels no normalizer covers.
+func (n *PathPolicy) LintUnnormalizedPaths(mf *dto.MetricFamily) []error {
+	var errs []error
+	reported := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if _, ok := n.rules[lp.GetName()]; ok || reported[lp.GetName()] {
+				continue
+			}
+			_, path, ok := splitPath(lp.GetValue())
+			if !ok {
+				continue
+			}
+			for _, s := range strings.Split(path, "/") {
+				if idPlaceholder(s) != "" {
+					reported[lp.GetName()] = true
+					errs = append(errs, fmt.Errorf("label %q contains unnormalized IDs in paths like %q; add it to path_normalization", lp.GetName(), lp.GetValue()))
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,180 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathRuleNormalize(t *testing.T) {
+	n, err := NewPathPolicy([]PathNormalizer{{
+		Labels:    []string{"endpoint"},
+		Templates: []string{"/api/users/:user_id/orders/:order_id", "/static/:file"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := n.rules["endpoint"]
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/api/users/12345/orders/987", "/api/users/:user_id/orders/:order_id"},
+		{"/api/users/alice/orders/abc", "/api/users/:user_id/orders/:order_id"},
+		{"/static/app.js", "/static/:file"},
+		{"/api/users/12345", "/api/users/:id"},
+		{"/api/items/0b9f5a6e-2c1d-4e8f-9a7b-3c2d1e0f4a5b/parts/7", "/api/items/:uuid/parts/:id"},
+		{"/blobs/3f786850e387550fdab836ed7e6dc881de23001b", "/blobs/:hash"},
+		{"/blobs/deadbeefdeadbeefdeadbeef", "/blobs/deadbeefdeadbeefdeadbeef"},
+		{"/api/users/12345?expand=orders#top", "/api/users/:id"},
+		{"https://example.com/api/users/42", "https://example.com/api/users/:id"},
+		{"https://example.com", "https://example.com"},
+		{"/api/users//orders/1", "/api/users//orders/:id"},
+		{"/", "/"},
+		{"GET", "GET"},
+		{"12345", "12345"},
+	}
+	for _, tt := range tests {
+		if got := rule.normalize(tt.value); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewPathPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		normalizers []PathNormalizer
+		want        string
+	}{
+		{name: "no labels", normalizers: []PathNormalizer{{}}, want: "no labels"},
+		{name: "relative template", normalizers: []PathNormalizer{{Labels: []string{"path"}, Templates: []string{"api/:id"}}}, want: "must start with /"},
+		{name: "label twice", normalizers: []PathNormalizer{{Labels: []string{"path"}}, {Labels: []string{"path"}}}, want: "already normalized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPathPolicy(tt.normalizers)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathPolicyMergesSeries(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "counters are summed",
+			input: `
+# TYPE requests_total counter
+requests_total{endpoint="/users/1",method="GET"} 2
+requests_total{endpoint="/users/2",method="GET"} 3
+requests_total{endpoint="/users/3",method="POST"} 1
+`,
+			want: `# TYPE requests_total counter
+requests_total{endpoint="/users/:id",method="GET"} 5
+requests_total{endpoint="/users/:id",method="POST"} 1
+`,
+		},
+		{
+			name: "histograms are summed",
+			input: `
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="/users/1",le="0.1"} 1
+latency_seconds_bucket{endpoint="/users/1",le="+Inf"} 2
+latency_seconds_sum{endpoint="/users/1"} 0.5
+latency_seconds_count{endpoint="/users/1"} 2
+latency_seconds_bucket{endpoint="/users/2",le="0.1"} 3
+latency_seconds_bucket{endpoint="/users/2",le="+Inf"} 3
+latency_seconds_sum{endpoint="/users/2"} 0.2
+latency_seconds_count{endpoint="/users/2"} 3
+`,
+			want: `# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="/users/:id",le="0.1"} 4
+latency_seconds_bucket{endpoint="/users/:id",le="+Inf"} 5
+latency_seconds_sum{endpoint="/users/:id"} 0.7
+latency_seconds_count{endpoint="/users/:id"} 5
+`,
+		},
+		{
+			name: "unchanged series are kept",
+			input: `
+# TYPE queue_size gauge
+queue_size{endpoint="/health"} 1
+`,
+			want: `# TYPE queue_size gauge
+queue_size{endpoint="/health"} 1
+`,
+		},
+		{
+			name: "gauges cannot be merged",
+			input: `
+# TYPE in_flight gauge
+in_flight{endpoint="/users/1"} 1
+in_flight{endpoint="/users/2"} 2
+`,
+			wantErr: `in_flight: normalized path labels make gauge series collide ({endpoint="/users/:id"})`,
+		},
+		{
+			name: "histograms with different buckets cannot be merged",
+			input: `
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="/users/1",le="0.1"} 1
+latency_seconds_bucket{endpoint="/users/1",le="+Inf"} 1
+latency_seconds_sum{endpoint="/users/1"} 0.05
+latency_seconds_count{endpoint="/users/1"} 1
+latency_seconds_bucket{endpoint="/users/2",le="0.5"} 1
+latency_seconds_bucket{endpoint="/users/2",le="+Inf"} 1
+latency_seconds_sum{endpoint="/users/2"} 0.3
+latency_seconds_count{endpoint="/users/2"} 1
+`,
+			wantErr: "latency_seconds: cannot merge histograms with different buckets",
+		},
+	}
+	n, err := NewPathPolicy([]PathNormalizer{{Labels: []string{"endpoint"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families := parseFamilies(t, tt.input)
+			changed, err := n.Normalize(families)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatFamilies(t, families); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if wantChanged := !strings.Contains(tt.input, "/health"); changed != wantChanged {
+				t.Errorf("changed = %v, want %v", changed, wantChanged)
+			}
+		})
+	}
+}
+
+func TestLintUnnormalizedPaths(t *testing.T) {
+	n, err := NewPathPolicy([]PathNormalizer{{Labels: []string{"endpoint"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := parseFamilies(t, `
+# TYPE requests_total counter
+requests_total{endpoint="/users/1",path="/users/1",referer="/home"} 1
+requests_total{endpoint="/users/2",path="/users/2",referer="/home"} 1
+`)
+	errs := n.LintUnnormalizedPaths(families[0])
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `label "path" contains unnormalized IDs`) {
+		t.Errorf("got %v, want one problem for label path", errs)
+	}
+}
@@ -0,0 +1,157 @@
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// MetricRename migrates a metric to a new name. Between Start and End both
+// names are forwarded so dashboards can move over; from End on only the new
+// name is.
+type MetricRename struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Labels renames label names of the new metric, old name to new name.
+	Labels map[string]string `yaml:"labels"`
+	// Start is when dual-writing begins. Defaults to immediately.
+	Start time.Time `yaml:"start"`
+	// End is the cutover after which the old name is no longer forwarded.
+	// Without an end both names are written indefinitely.
+	End time.Time `yaml:"end"`
+}
+
+// RenameAction reports a rename applied to a push.
+type RenameAction struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Action is "dual-written" during the window or "renamed" after the
+	// cutover.
+	Action string `json:"action"`
+}
+
+// RenameMap applies the configured renames by old metric name.
+type RenameMap struct {
+	renames map[string]MetricRename
+}
+
+// NewRenameMap validates the renames.
+func NewRenameMap(renames []MetricRename) (*RenameMap, error) {
+	m := &RenameMap{renames: map[string]MetricRename{}}
+	targets := map[string]bool{}
+	for i, r := range renames {
+		if !model.IsValidMetricName(model.LabelValue(r.From)) || !model.IsValidMetricName(model.LabelValue(r.To)) {
+			return nil, fmt.Errorf("rename %d: invalid metric names %q and %q", i+1, r.From, r.To)
+		}
+		if r.From == r.To {
+			return nil, fmt.Errorf("rename %d: %s is renamed to itself", i+1, r.From)
+		}
+		if _, dup := m.renames[r.From]; dup {
+			return nil, fmt.Errorf("rename %d: duplicate rename of %s", i+1, r.From)
+		}
+		if targets[r.To] {
+			return nil, fmt.Errorf("rename %d: more than one metric renamed to %s", i+1, r.To)
+		}
+		for from, to := range r.Labels {
+			if !model.LabelName(from).IsValid() || !model.LabelName(to).IsValid() {
+				return nil, fmt.Errorf("rename %s: invalid label rename %q to %q", r.From, from, to)
+			}
+		}
+		if !r.End.IsZero() && !r.End.After(r.Start) {
+			return nil, fmt.Errorf("rename %s: end must be after start", r.From)
+		}
+		m.renames[r.From] = r
+		targets[r.To] = true
+	}
+	for _, r := range renames {
+		if _, ok := m.renames[r.To]; ok {
+			return nil, fmt.Errorf("rename %s: %s is itself renamed", r.From, r.To)
+		}
+	}
+	return m, nil
+}
+
+// Apply renames the families configured at now. During the window a renamed
+// copy is added next to the old family; after the cutover the old family is
+// replaced. If the push already contains the new name it is left as is and
+// only the old family is dropped after the cutover.
+func (m *RenameMap) Apply(families []*dto.MetricFamily, now time.Time) ([]*dto.MetricFamily, []RenameAction, error) {
+	if len(m.renames) == 0 {
+		return families, nil, nil
+	}
+	present := make(map[string]bool, len(families))
+	for _, mf := range families {
+		present[mf.GetName()] = true
+	}
+
+	var actions []RenameAction
+	out := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		r, ok := m.renames[mf.GetName()]
+		if !ok || now.Before(r.Start) {
+			out = append(out, mf)
+			continue
+		}
+		cutover := !r.End.IsZero() && !now.Before(r.End)
+		if !cutover {
+			out = append(out, mf)
+		}
+		if !present[r.To] {
+			renamed, err := renameFamily(mf, r)
+			if err != nil {
+				return families, nil, err
+			}
+			out = append(out, renamed)
+		}
+		action := "dual-written"
+		if cutover {
+			action = "renamed"
+		}
+		actions = append(actions, RenameAction{From: r.From, To: r.To, Action: action})
+	}
+	if len(actions) == 0 {
+		return families, nil, nil
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out, actions, nil
+}
+
+// renameFamily returns a copy of mf under the new name and label names.
+func renameFamily(mf *dto.MetricFamily, r MetricRename) (*dto.MetricFamily, error) {
+	renamed := proto.Clone(mf).(*dto.MetricFamily)
+	renamed.Name = proto.String(r.To)
+	for _, m := range renamed.GetMetric() {
+		seen := make(map[string]bool, len(m.GetLabel()))
+		for _, lp := range m.GetLabel() {
+			if to, ok := r.Labels[lp.GetName()]; ok {
+				lp.Name = proto.String(to)
+			}
+			if seen[lp.GetName()] {
+				return nil, fmt.Errorf("renaming %s to %s: duplicate label %q", r.From, r.To, lp.GetName())
+			}
+			seen[lp.GetName()] = true
+		}
+	}
+	return renamed, nil
+}
+
+// CutoverProblems returns lint problems for old names still pushed after
+// their cutover. The old families are gone from the forwarded push by then,
+// so they cannot be flagged by a promlint validation.
+func CutoverProblems(actions []RenameAction) []ProblemDetails {
+	var problems []ProblemDetails
+	for _, a := range actions {
+		if a.Action == "renamed" {
+			problems = append(problems, ProblemDetails{
+				Metric: a.From,
+				Text:   fmt.Sprintf("metric was renamed to %s and is no longer forwarded under this name; update the client", a.To),
+				Code:   RuleRenames,
+			})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,135 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenameMapWindow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(30 * 24 * time.Hour)
+	m, err := NewRenameMap([]MetricRename{
+		{From: "reqs_total", To: "http_requests_total", Labels: map[string]string{"ep": "endpoint"}, Start: start, End: end},
+		{From: "old_queue", To: "queue_size"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const push = `
+# TYPE old_queue gauge
+old_queue 2
+# TYPE reqs_total counter
+reqs_total{ep="/a"} 1
+`
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		input       string
+		wantNames   string
+		wantActions string // from:action of each rename
+	}{
+		{
+			name:        "before the window",
+			now:         start.Add(-time.Hour),
+			input:       push,
+			wantNames:   "old_queue queue_size reqs_total",
+			wantActions: "old_queue:dual-written",
+		},
+		{
+			name:        "during the window",
+			now:         start,
+			input:       push,
+			wantNames:   "http_requests_total old_queue queue_size reqs_total",
+			wantActions: "old_queue:dual-written reqs_total:dual-written",
+		},
+		{
+			name:        "at the cutover",
+			now:         end,
+			input:       push,
+			wantNames:   "http_requests_total old_queue queue_size",
+			wantActions: "old_queue:dual-written reqs_total:renamed",
+		},
+		{
+			name: "new name already pushed",
+			now:  start.Add(time.Hour),
+			input: push + `# TYPE http_requests_total counter
+http_requests_total{endpoint="/a"} 5
+`,
+			wantNames:   "http_requests_total old_queue queue_size reqs_total",
+			wantActions: "old_queue:dual-written reqs_total:dual-written",
+		},
+		{
+			name:      "nothing to rename",
+			now:       start,
+			input:     "# TYPE up gauge\nup 1\n",
+			wantNames: "up",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families, actions, err := m.Apply(parseFamilies(t, tt.input), tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names, got []string
+			for _, mf := range families {
+				names = append(names, mf.GetName())
+			}
+			for _, a := range actions {
+				got = append(got, a.From+":"+a.Action)
+			}
+			if strings.Join(names, " ") != tt.wantNames {
+				t.Errorf("families %v, want %s", names, tt.wantNames)
+			}
+			if strings.Join(got, " ") != tt.wantActions {
+				t.Errorf("actions %v, want %s", got, tt.wantActions)
+			}
+			for _, mf := range families {
+				if mf.GetName() == "http_requests_total" {
+					if l := mf.GetMetric()[0].GetLabel()[0].GetName(); l != "endpoint" {
+						t.Errorf("renamed family has label %q, want endpoint", l)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRenameMapErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		renames []MetricRename
+		want    string
+	}{
+		{name: "to itself", renames: []MetricRename{{From: "a", To: "a"}}, want: "renamed to itself"},
+		{name: "duplicate", renames: []MetricRename{{From: "a", To: "b"}, {From: "a", To: "c"}}, want: "duplicate rename of a"},
+		{name: "same target", renames: []MetricRename{{From: "a", To: "c"}, {From: "b", To: "c"}}, want: "more than one metric renamed to c"},
+		{name: "chained", renames: []MetricRename{{From: "a", To: "b"}, {From: "b", To: "c"}}, want: "b is itself renamed"},
+		{name: "empty window", renames: []MetricRename{{From: "a", To: "b", Start: time.Unix(10, 0), End: time.Unix(10, 0)}}, want: "end must be after start"},
+		{name: "invalid name", renames: []MetricRename{{From: "", To: "b"}}, want: "invalid metric names"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRenameMap(tt.renames)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenameLabelCollision(t *testing.T) {
+	m, err := NewRenameMap([]MetricRename{{From: "a_total", To: "b_total", Labels: map[string]string{"ep": "endpoint"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := parseFamilies(t, `
+# TYPE a_total counter
+a_total{endpoint="/x",ep="/y"} 1
+`)
+	if _, _, err := m.Apply(families, time.Now()); err == nil || !strings.Contains(err.Error(), `duplicate label "endpoint"`) {
+		t.Errorf("error %v, want a duplicate label", err)
+	}
+}
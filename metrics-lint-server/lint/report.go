@@ -0,0 +1,22 @@
+package lint
+
+// Report is the outcome of linting an exposition with an Engine, and the
+// JSON body the lint server responds to /lint with.
+type Report struct {
+	// Status is success, warning if there are problems, or error if the
+	// input cannot be parsed or is rejected by a policy.
+	Status    string           `json:"status"`
+	Message   string           `json:"message,omitempty"`
+	Problems  []ProblemDetails `json:"problems,omitempty"`
+	ErrorText string           `json:"error,omitempty"`
+	// Rule is the rule that rejected the input.
+	Rule string `json:"rule,omitempty"`
+}
+
+// ProblemDetails is a lint problem of one metric.
+type ProblemDetails struct {
+	Metric string `json:"metric"`
+	Text   string `json:"text"`
+	// Code identifies the check that found the problem.
+	Code string `json:"code,omitempty"`
+}
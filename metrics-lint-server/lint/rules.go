@@ -0,0 +1,162 @@
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// exposedSeriesNames returns the series names a family occupies once
+// exposed, e.g. foo_bucket, foo_count and foo_sum for a histogram foo.
+func exposedSeriesNames(mf *dto.MetricFamily) []string {
+	name := mf.GetName()
+	switch mf.GetType() {
+	case dto.MetricType_HISTOGRAM:
+		return []string{name + "_bucket", name + "_count", name + "_sum"}
+	case dto.MetricType_SUMMARY:
+		return []string{name, name + "_count", name + "_sum"}
+	}
+	return []string{name}
+}
+
+// SuffixCollisions returns a promlint validation flagging families whose
+// name is also a series name of a histogram or summary in the same push, like
+// a gauge foo_count next to a histogram foo. Unlike promlint's suffix checks
+// this also covers untyped families. _created companions are handled by
+// CreatedCollisions.
+func SuffixCollisions(families []*dto.MetricFamily) func(*dto.MetricFamily) []error {
+	owners := map[string]string{}
+	for _, mf := range families {
+		if t := mf.GetType(); t != dto.MetricType_HISTOGRAM && t != dto.MetricType_SUMMARY {
+			continue
+		}
+		for _, series := range exposedSeriesNames(mf) {
+			if series != mf.GetName() {
+				owners[series] = fmt.Sprintf("%s %s", strings.ToLower(mf.GetType().String()), mf.GetName())
+			}
+		}
+	}
+	return func(mf *dto.MetricFamily) []error {
+		if owner, ok := owners[mf.GetName()]; ok {
+			return []error{fmt.Errorf("name collides with the series of %s", owner)}
+		}
+		return nil
+	}
+}
+
+// ReservedLabels is a promlint validation flagging labels reserved for
+// Prometheus internals or clashing with the labels histograms and summaries
+// add themselves. promlint only checks le and quantile on the other metric
+// types.
+func ReservedLabels(mf *dto.MetricFamily) []error {
+	var errs []error
+	reported := map[string]bool{}
+	report := func(ln, format string) {
+		if !reported[ln] {
+			reported[ln] = true
+			errs = append(errs, fmt.Errorf(format, ln))
+		}
+	}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			ln := lp.GetName()
+			switch {
+			case strings.HasPrefix(ln, model.ReservedLabelPrefix):
+				report(ln, "label %q uses the reserved \"__\" prefix")
+			case ln == model.BucketLabel && mf.GetType() == dto.MetricType_HISTOGRAM:
+				report(ln, "histogram has a %q label that clashes with its bucket label")
+			case ln == model.QuantileLabel && mf.GetType() == dto.MetricType_SUMMARY:
+				report(ln, "summary has a %q label that clashes with its quantile label")
+			}
+		}
+	}
+	return errs
+}
+
+// createdBaseName returns the name the _created companion of mf is derived
+// from, or "" if mf cannot have one.
+func createdBaseName(mf *dto.MetricFamily) string {
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		return strings.TrimSuffix(mf.GetName(), "_total")
+	case dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+		return mf.GetName()
+	}
+	return ""
+}
+
+// CreatedCompanions maps the names of _created families to their parent
+// family. A family is a companion when it is a gauge or untyped, shares the
+// parent's help text (or has none) and each of its series matches a parent
+// series. Families named like a companion that fail these checks are
+// returned as collisions.
+func CreatedCompanions(families []*dto.MetricFamily) (companions map[string]*dto.MetricFamily, collisions map[string]string) {
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+
+	companions = map[string]*dto.MetricFamily{}
+	collisions = map[string]string{}
+	for _, parent := range families {
+		base := createdBaseName(parent)
+		if base == "" {
+			continue
+		}
+		created, ok := byName[base+"_created"]
+		if !ok {
+			continue
+		}
+		if isCreatedCompanion(parent, created) {
+			companions[created.GetName()] = parent
+		} else {
+			collisions[created.GetName()] = parent.GetName()
+		}
+	}
+	return companions, collisions
+}
+
+func isCreatedCompanion(parent, created *dto.MetricFamily) bool {
+	if t := created.GetType(); t != dto.MetricType_GAUGE && t != dto.MetricType_UNTYPED {
+		return false
+	}
+	if created.GetHelp() != "" && created.GetHelp() != parent.GetHelp() {
+		return false
+	}
+	series := map[string]bool{}
+	for _, m := range parent.GetMetric() {
+		series[SeriesKey(m)] = true
+	}
+	for _, m := range created.GetMetric() {
+		if !series[SeriesKey(m)] {
+			return false
+		}
+	}
+	return true
+}
+
+// CreatedCollisions returns a promlint validation flagging metrics named
+// like the _created series of another family without being its companion.
+func CreatedCollisions(families []*dto.MetricFamily) func(*dto.MetricFamily) []error {
+	_, collisions := CreatedCompanions(families)
+	return func(mf *dto.MetricFamily) []error {
+		parent, ok := collisions[mf.GetName()]
+		if !ok {
+			return nil
+		}
+		return []error{fmt.Errorf("name collides with the _created series of %s", parent)}
+	}
+}
+
+// SeriesKey identifies a series of a family by its sorted label pairs.
+func SeriesKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		pairs = append(pairs, lp.GetName()+"\xff"+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
@@ -0,0 +1,220 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// family builds a family with one series per label set, each written as
+// alternating names and values.
+func family(name string, typ dto.MetricType, help string, series ...[]string) *dto.MetricFamily {
+	mf := &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+	if help != "" {
+		mf.Help = proto.String(help)
+	}
+	if len(series) == 0 {
+		series = [][]string{nil}
+	}
+	for _, labels := range series {
+		m := &dto.Metric{}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+	return mf
+}
+
+// validate runs a validation over every family and returns its findings as
+// "name: text" lines.
+func validate(families []*dto.MetricFamily, v func(*dto.MetricFamily) []error) []string {
+	var got []string
+	for _, mf := range families {
+		for _, err := range v(mf) {
+			got = append(got, fmt.Sprintf("%s: %v", mf.GetName(), err))
+		}
+	}
+	return got
+}
+
+func TestSuffixCollisions(t *testing.T) {
+	tests := []struct {
+		name     string
+		families []*dto.MetricFamily
+		want     []string
+	}{
+		{
+			name: "gauge named like a histogram count",
+			families: []*dto.MetricFamily{
+				family("latency_seconds", dto.MetricType_HISTOGRAM, ""),
+				family("latency_seconds_count", dto.MetricType_GAUGE, ""),
+			},
+			want: []string{"latency_seconds_count: name collides with the series of histogram latency_seconds"},
+		},
+		{
+			name: "untyped named like histogram buckets and sum",
+			families: []*dto.MetricFamily{
+				family("latency_seconds", dto.MetricType_HISTOGRAM, ""),
+				family("latency_seconds_bucket", dto.MetricType_UNTYPED, ""),
+				family("latency_seconds_sum", dto.MetricType_UNTYPED, ""),
+			},
+			want: []string{
+				"latency_seconds_bucket: name collides with the series of histogram latency_seconds",
+				"latency_seconds_sum: name collides with the series of histogram latency_seconds",
+			},
+		},
+		{
+			name: "counter named like a summary count",
+			families: []*dto.MetricFamily{
+				family("rpc_seconds", dto.MetricType_SUMMARY, ""),
+				family("rpc_seconds_count", dto.MetricType_COUNTER, ""),
+			},
+			want: []string{"rpc_seconds_count: name collides with the series of summary rpc_seconds"},
+		},
+		{
+			name: "summary buckets are not its series",
+			families: []*dto.MetricFamily{
+				family("rpc_seconds", dto.MetricType_SUMMARY, ""),
+				family("rpc_seconds_bucket", dto.MetricType_GAUGE, ""),
+			},
+		},
+		{
+			name: "counter total next to a gauge",
+			families: []*dto.MetricFamily{
+				family("requests", dto.MetricType_GAUGE, ""),
+				family("requests_total", dto.MetricType_COUNTER, ""),
+			},
+		},
+		{
+			name: "histogram named like another histogram's series",
+			families: []*dto.MetricFamily{
+				family("a", dto.MetricType_HISTOGRAM, ""),
+				family("a_count", dto.MetricType_HISTOGRAM, ""),
+			},
+			want: []string{"a_count: name collides with the series of histogram a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validate(tt.families, SuffixCollisions(tt.families))
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservedLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		family *dto.MetricFamily
+		want   []string
+	}{
+		{
+			name:   "reserved prefix",
+			family: family("up", dto.MetricType_GAUGE, "", []string{"__tenant", "a"}, []string{"__tenant", "b"}),
+			want:   []string{`up: label "__tenant" uses the reserved "__" prefix`},
+		},
+		{
+			name:   "reserved prefix on a histogram",
+			family: family("latency_seconds", dto.MetricType_HISTOGRAM, "", []string{"__name__", "x", "le_bound", "1"}),
+			want:   []string{`latency_seconds: label "__name__" uses the reserved "__" prefix`},
+		},
+		{
+			name:   "le on a histogram",
+			family: family("latency_seconds", dto.MetricType_HISTOGRAM, "", []string{"le", "1"}),
+			want:   []string{`latency_seconds: histogram has a "le" label that clashes with its bucket label`},
+		},
+		{
+			name:   "quantile on a summary",
+			family: family("rpc_seconds", dto.MetricType_SUMMARY, "", []string{"quantile", "0.5"}, []string{"quantile", "0.9"}),
+			want:   []string{`rpc_seconds: summary has a "quantile" label that clashes with its quantile label`},
+		},
+		{
+			name:   "quantile on a histogram",
+			family: family("latency_seconds", dto.MetricType_HISTOGRAM, "", []string{"quantile", "0.5"}),
+		},
+		{
+			name:   "le on a gauge is left to promlint",
+			family: family("threshold", dto.MetricType_GAUGE, "", []string{"le", "1"}),
+		},
+		{
+			name:   "single underscore",
+			family: family("up", dto.MetricType_GAUGE, "", []string{"_shard", "1"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validate([]*dto.MetricFamily{tt.family}, ReservedLabels)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatedCollisions(t *testing.T) {
+	tests := []struct {
+		name     string
+		families []*dto.MetricFamily
+		want     []string
+	}{
+		{
+			name: "companion of a counter",
+			families: []*dto.MetricFamily{
+				family("requests_total", dto.MetricType_COUNTER, "Requests.", []string{"code", "200"}),
+				family("requests_created", dto.MetricType_GAUGE, "Requests.", []string{"code", "200"}),
+			},
+		},
+		{
+			name: "companion of a histogram without help",
+			families: []*dto.MetricFamily{
+				family("latency_seconds", dto.MetricType_HISTOGRAM, "Latency."),
+				family("latency_seconds_created", dto.MetricType_UNTYPED, ""),
+			},
+		},
+		{
+			name: "different help",
+			families: []*dto.MetricFamily{
+				family("requests_total", dto.MetricType_COUNTER, "Requests."),
+				family("requests_created", dto.MetricType_GAUGE, "Requests created by users."),
+			},
+			want: []string{"requests_created: name collides with the _created series of requests_total"},
+		},
+		{
+			name: "counter type",
+			families: []*dto.MetricFamily{
+				family("rpc_seconds", dto.MetricType_SUMMARY, ""),
+				family("rpc_seconds_created", dto.MetricType_COUNTER, ""),
+			},
+			want: []string{"rpc_seconds_created: name collides with the _created series of rpc_seconds"},
+		},
+		{
+			name: "series the parent lacks",
+			families: []*dto.MetricFamily{
+				family("requests_total", dto.MetricType_COUNTER, "", []string{"code", "200"}),
+				family("requests_created", dto.MetricType_GAUGE, "", []string{"code", "200"}, []string{"code", "500"}),
+			},
+			want: []string{"requests_created: name collides with the _created series of requests_total"},
+		},
+		{
+			name: "gauges have no companions",
+			families: []*dto.MetricFamily{
+				family("queue", dto.MetricType_GAUGE, ""),
+				family("queue_created", dto.MetricType_COUNTER, ""),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validate(tt.families, CreatedCollisions(tt.families))
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
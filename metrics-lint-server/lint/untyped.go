@@ -0,0 +1,368 @@
+package lint
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// Policies for families pushed without a type, which is what the text
+// parser yields for samples that have no # TYPE line.
+const (
+	untypedWarn   = "warn"
+	untypedReject = "reject"
+	untypedInfer  = "infer"
+)
+
+// TypeInference reports a type inferred for untyped families.
+type TypeInference struct {
+	Metric string `json:"metric"`
+	Type   string `json:"type"`
+	// From lists the untyped families the metric was built from.
+	From []string `json:"from"`
+}
+
+// UntypedPolicy applies the configured handling of untyped families.
+type UntypedPolicy struct {
+	mode string
+}
+
+// NewUntypedPolicy returns the policy for mode: warn (the default for ""),
+// reject or infer.
+func NewUntypedPolicy(mode string) (*UntypedPolicy, error) {
+	switch mode {
+	case "":
+		mode = untypedWarn
+	case untypedWarn, untypedReject, untypedInfer:
+	default:
+		return nil, fmt.Errorf("unknown untyped_metrics policy %q, expected warn, reject or infer", mode)
+	}
+	return &UntypedPolicy{mode: mode}, nil
+}
+
+// Relaxed returns the warn policy, used for clients a canary rollout does
+// not enforce the policy for.
+func (p *UntypedPolicy) Relaxed() *UntypedPolicy {
+	return &UntypedPolicy{mode: untypedWarn}
+}
+
+// Mode returns the effective policy: warn, reject or infer.
+func (p *UntypedPolicy) Mode() string {
+	return p.mode
+}
+
+// UntypedNames returns the sorted names of the untyped families.
+func UntypedNames(families []*dto.MetricFamily) []string {
+	var names []string
+	for _, mf := range families {
+		if mf.GetType() == dto.MetricType_UNTYPED {
+			names = append(names, mf.GetName())
+		}
+	}
+	return names
+}
+
+// Apply enforces the policy and returns the resulting families. infer turns
+// untyped families into counters, histograms and summaries where their names
+// and labels make the type unambiguous:
+//
+//   - <name>_total becomes a counter;
+//   - <name>_bucket series with an le label, together with <name>_sum and
+//     <name>_count, become a histogram <name>;
+//   - <name> series with a quantile label, together with <name>_sum and
+//     <name>_count, become a summary <name>.
+//
+// Families that do not fit any of these are left untyped.
+func (p *UntypedPolicy) Apply(families []*dto.MetricFamily) ([]*dto.MetricFamily, []TypeInference, error) {
+	switch p.mode {
+	case untypedReject:
+		if names := UntypedNames(families); len(names) > 0 {
+			return families, nil, fmt.Errorf("metrics without a type are not accepted: %s", strings.Join(names, ", "))
+		}
+		return families, nil, nil
+	case untypedInfer:
+		families, inferred := inferTypes(families)
+		return families, inferred, nil
+	}
+	return families, nil, nil
+}
+
+func inferTypes(families []*dto.MetricFamily) ([]*dto.MetricFamily, []TypeInference) {
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	untyped := func(name string) *dto.MetricFamily {
+		if mf, ok := byName[name]; ok && mf.GetType() == dto.MetricType_UNTYPED {
+			return mf
+		}
+		return nil
+	}
+
+	var inferred []TypeInference
+	replaced := map[string]bool{}
+	counters := map[string]*dto.MetricFamily{}
+	var built []*dto.MetricFamily
+	for _, mf := range families {
+		name := mf.GetName()
+		if mf.GetType() != dto.MetricType_UNTYPED || replaced[name] {
+			continue
+		}
+
+		if strings.HasSuffix(name, "_total") {
+			if counter := inferCounter(mf); counter != nil {
+				counters[name] = counter
+				inferred = append(inferred, TypeInference{Metric: name, Type: "counter", From: []string{name}})
+			}
+			continue
+		}
+
+		var base string
+		var build func(parts, sum, count *dto.MetricFamily) *dto.MetricFamily
+		var kind string
+		switch {
+		case strings.HasSuffix(name, "_bucket") && allHaveLabel(mf, model.BucketLabel):
+			base, build, kind = strings.TrimSuffix(name, "_bucket"), buildHistogram, "histogram"
+		case allHaveLabel(mf, model.QuantileLabel):
+			base, build, kind = name, buildSummary, "summary"
+		default:
+			continue
+		}
+		sum, count := untyped(base+"_sum"), untyped(base+"_count")
+		if sum == nil || count == nil {
+			continue
+		}
+		if _, taken := byName[base]; taken && base != name {
+			continue
+		}
+		out := build(mf, sum, count)
+		if out == nil {
+			continue
+		}
+		out.Name = proto.String(base)
+		if help := firstHelp(mf, sum, count); help != "" {
+			out.Help = proto.String(help)
+		}
+		for _, part := range []*dto.MetricFamily{mf, sum, count} {
+			replaced[part.GetName()] = true
+		}
+		built = append(built, out)
+		inferred = append(inferred, TypeInference{Metric: base, Type: kind, From: []string{name, sum.GetName(), count.GetName()}})
+	}
+	if len(built) == 0 && len(counters) == 0 {
+		return families, inferred
+	}
+
+	// The caller may still use families, so neither the slice nor the
+	// families in it are changed: inferred families are new copies.
+	out := make([]*dto.MetricFamily, 0, len(families)+len(built))
+	for _, mf := range families {
+		if counter, ok := counters[mf.GetName()]; ok {
+			out = append(out, counter)
+		} else if !replaced[mf.GetName()] {
+			out = append(out, mf)
+		}
+	}
+	if len(built) > 0 {
+		out = append(out, built...)
+		sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	}
+	return out, inferred
+}
+
+// inferCounter returns a counter copy of an untyped _total family, or nil if
+// one of its values could not be a counter.
+func inferCounter(mf *dto.MetricFamily) *dto.MetricFamily {
+	for _, m := range mf.GetMetric() {
+		if v := m.GetUntyped().GetValue(); v < 0 || math.IsNaN(v) {
+			return nil
+		}
+	}
+	out := proto.Clone(mf).(*dto.MetricFamily)
+	for _, m := range out.GetMetric() {
+		m.Counter = &dto.Counter{Value: proto.Float64(m.GetUntyped().GetValue())}
+		m.Untyped = nil
+	}
+	out.Type = dto.MetricType_COUNTER.Enum()
+	return out
+}
+
+func allHaveLabel(mf *dto.MetricFamily, name string) bool {
+	for _, m := range mf.GetMetric() {
+		if labelValue(m, name) == nil {
+			return false
+		}
+	}
+	return len(mf.GetMetric()) > 0
+}
+
+func labelValue(m *dto.Metric, name string) *string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.Value
+		}
+	}
+	return nil
+}
+
+// withoutLabel returns the labels of m other than name.
+func withoutLabel(m *dto.Metric, name string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() != name {
+			pairs = append(pairs, lp)
+		}
+	}
+	return pairs
+}
+
+// sumAndCount indexes the _sum and _count series by label set.
+func sumAndCount(sum, count *dto.MetricFamily) (sums, counts map[string]*dto.Metric) {
+	sums, counts = map[string]*dto.Metric{}, map[string]*dto.Metric{}
+	for _, m := range sum.GetMetric() {
+		sums[SeriesKey(m)] = m
+	}
+	for _, m := range count.GetMetric() {
+		counts[SeriesKey(m)] = m
+	}
+	return sums, counts
+}
+
+// countValue returns v as a sample count if it is a non-negative integer.
+func countValue(v float64) (uint64, bool) {
+	if v < 0 || v != math.Trunc(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return uint64(v), true
+}
+
+// buildHistogram assembles a histogram from _bucket, _sum and _count series,
+// or returns nil if they do not line up.
+func buildHistogram(buckets, sum, count *dto.MetricFamily) *dto.MetricFamily {
+	sums, counts := sumAndCount(sum, count)
+	out := &dto.MetricFamily{Type: dto.MetricType_HISTOGRAM.Enum()}
+	series := map[string]*dto.Metric{}
+	infBucket := map[string]uint64{}
+	for _, m := range buckets.GetMetric() {
+		bound, err := strconv.ParseFloat(*labelValue(m, model.BucketLabel), 64)
+		if err != nil {
+			return nil
+		}
+		c, ok := countValue(m.GetUntyped().GetValue())
+		if !ok {
+			return nil
+		}
+		labels := withoutLabel(m, model.BucketLabel)
+		key := SeriesKey(&dto.Metric{Label: labels})
+		h, ok := series[key]
+		if !ok {
+			sm, cm := sums[key], counts[key]
+			if sm == nil || cm == nil {
+				return nil
+			}
+			n, ok := countValue(cm.GetUntyped().GetValue())
+			if !ok {
+				return nil
+			}
+			h = &dto.Metric{
+				Label:       labels,
+				TimestampMs: cm.TimestampMs,
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(n),
+					SampleSum:   proto.Float64(sm.GetUntyped().GetValue()),
+				},
+			}
+			series[key] = h
+			out.Metric = append(out.Metric, h)
+		}
+		if math.IsInf(bound, 1) {
+			infBucket[key] = c
+			continue
+		}
+		h.Histogram.Bucket = append(h.Histogram.Bucket, &dto.Bucket{UpperBound: proto.Float64(bound), CumulativeCount: proto.Uint64(c)})
+	}
+	if len(series) != len(sums) || len(series) != len(counts) {
+		return nil
+	}
+	for key, m := range series {
+		h := m.Histogram
+		if inf, ok := infBucket[key]; !ok || inf != h.GetSampleCount() {
+			return nil
+		}
+		sort.Slice(h.Bucket, func(i, j int) bool { return h.Bucket[i].GetUpperBound() < h.Bucket[j].GetUpperBound() })
+	}
+	return out
+}
+
+// buildSummary assembles a summary from quantile, _sum and _count series, or
+// returns nil if they do not line up.
+func buildSummary(quantiles, sum, count *dto.MetricFamily) *dto.MetricFamily {
+	sums, counts := sumAndCount(sum, count)
+	out := &dto.MetricFamily{Type: dto.MetricType_SUMMARY.Enum()}
+	series := map[string]*dto.Metric{}
+	for _, m := range quantiles.GetMetric() {
+		q, err := strconv.ParseFloat(*labelValue(m, model.QuantileLabel), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil
+		}
+		labels := withoutLabel(m, model.QuantileLabel)
+		key := SeriesKey(&dto.Metric{Label: labels})
+		s, ok := series[key]
+		if !ok {
+			sm, cm := sums[key], counts[key]
+			if sm == nil || cm == nil {
+				return nil
+			}
+			n, ok := countValue(cm.GetUntyped().GetValue())
+			if !ok {
+				return nil
+			}
+			s = &dto.Metric{
+				Label:       labels,
+				TimestampMs: cm.TimestampMs,
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(n),
+					SampleSum:   proto.Float64(sm.GetUntyped().GetValue()),
+				},
+			}
+			series[key] = s
+			out.Metric = append(out.Metric, s)
+		}
+		s.Summary.Quantile = append(s.Summary.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(m.GetUntyped().GetValue())})
+	}
+	if len(series) != len(sums) || len(series) != len(counts) {
+		return nil
+	}
+	for _, m := range series {
+		qs := m.Summary.Quantile
+		sort.Slice(qs, func(i, j int) bool { return qs[i].GetQuantile() < qs[j].GetQuantile() })
+	}
+	return out
+}
+
+func firstHelp(families ...*dto.MetricFamily) string {
+	for _, mf := range families {
+		if mf.GetHelp() != "" {
+			return mf.GetHelp()
+		}
+	}
+	return ""
+}
+
+// LintUntyped is a promlint validation flagging families left without a
+// type, which rate() and histogram_quantile() cannot be checked against.
+func (p *UntypedPolicy) LintUntyped(mf *dto.MetricFamily) []error {
+	if mf.GetType() != dto.MetricType_UNTYPED {
+		return nil
+	}
+	if p.mode == untypedInfer {
+		return []error{fmt.Errorf("metric has no type and none could be inferred; add a # TYPE line")}
+	}
+	return []error{fmt.Errorf("metric has no type; add a # TYPE line")}
+}
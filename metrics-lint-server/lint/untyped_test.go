@@ -0,0 +1,58 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestUntypedPolicyInfer(t *testing.T) {
+	families, err := Decode(strings.NewReader(`
+latency_seconds_bucket{le="0.5"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_count 2
+latency_seconds_sum 0.9
+queue_size 3
+requests_total 4
+`), FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pushed []string
+	for _, mf := range families {
+		pushed = append(pushed, mf.GetName())
+	}
+
+	p, err := NewUntypedPolicy("infer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, inferred, err := p.Apply(families)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, mf := range out {
+		got = append(got, mf.GetName()+":"+strings.ToLower(mf.GetType().String()))
+	}
+	want := "latency_seconds:histogram queue_size:untyped requests_total:counter"
+	if strings.Join(got, " ") != want {
+		t.Errorf("families %s, want %s", strings.Join(got, " "), want)
+	}
+	if len(inferred) != 2 {
+		t.Errorf("inferred %+v, want the histogram and the counter", inferred)
+	}
+
+	// The caller's slice still holds the pushed families, all untyped.
+	var after []string
+	for _, mf := range families {
+		after = append(after, mf.GetName())
+		if mf.GetType() != dto.MetricType_UNTYPED || mf.GetMetric()[0].GetUntyped() == nil {
+			t.Errorf("caller's family %s changed to %s", mf.GetName(), mf.GetType())
+		}
+	}
+	if strings.Join(after, " ") != strings.Join(pushed, " ") {
+		t.Errorf("caller's families changed from %v to %v", pushed, after)
+	}
+}
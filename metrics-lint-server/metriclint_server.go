@@ -1,107 +1,138 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
-)
-
-type LintResponse struct {
-	Status    string           `json:"status"`
-	Message   string           `json:"message,omitempty"`
-	Problems  []ProblemDetails `json:"problems,omitempty"`
-	ErrorText string           `json:"error,omitempty"`
-}
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-type ProblemDetails struct {
-	Metric string `json:"metric"`
-	Text   string `json:"text"`
-}
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
 
 func main() {
-	// Set up the server
-	http.HandleFunc("/lint", handleLint)
-	
-	port := 8080
-	fmt.Printf("Starting metrics linter server on port %d...\n", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	gatewayURL := flag.String("gateway", "http://localhost:9091", "Pushgateway URL that accepted pushes are forwarded to.")
+	configFile := flag.String("config", "", "Path to the YAML configuration file.")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.Gateways) == 0 {
+		cfg.Gateways = []GatewayBackend{{Address: *gatewayURL}}
 	}
-}
 
-func handleLint(w http.ResponseWriter, r *http.Request) {
-	// Only accept PUT method
-	if r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed. Use PUT.", http.StatusMethodNotAllowed)
-		return
+	// Subcommands run once and exit instead of starting the server
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(cfg, flag.Args()))
 	}
 
-	// Read the body
-	body, err := io.ReadAll(r.Body)
+	registry, err := loadSchemas(cfg.Schemas)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+		log.Fatalf("Failed to load schemas: %v", err)
 	}
-	defer r.Body.Close()
-
-	metricsText := string(body)
-	
-	// Set response headers
-	w.Header().Set("Content-Type", "application/json")
-	
-	// Create response object
-	response := LintResponse{}
-	
-	// Check for empty input
-	if strings.TrimSpace(metricsText) == "" {
-		response.Status = "error"
-		response.Message = "No input provided. Please send metrics in the request body."
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+	freshnessYAML, err := renderFreshnessRules(cfg.Freshness)
+	if err != nil {
+		log.Fatalf("Failed to generate freshness rules: %v", err)
 	}
 
-	// Run the linter
-	metrics := strings.NewReader(metricsText + "\n")
-	l := promlint.New(metrics)
-	problems, err := l.Lint()
-	
+	tracker, err := newPushTracker(cfg.ExpectedPushers, time.Now())
+	if err != nil {
+		log.Fatalf("Failed to load expected pushers: %v", err)
+	}
+	engine, err := lint.New(cfg.Config)
 	if err != nil {
-		// Handle parsing error
-		response.Status = "error"
-		response.ErrorText = err.Error()
-		response.Message = "Failed to parse metrics"
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+		log.Fatalf("Failed to load lint policies: %v", err)
 	}
+	store := newMetricStore()
+	proxy, err := newPushProxy(*gatewayURL, cfg, store, tracker)
+	if err != nil {
+		log.Fatalf("Failed to load push policies: %v", err)
+	}
+	if proxy.history, err = openPushHistory(cfg.PushHistory); err != nil {
+		log.Fatalf("Failed to open push history: %v", err)
+	}
+	policies, err := newPolicyServer(cfg, proxy.canary, registry)
+	if err != nil {
+		log.Fatalf("Failed to load policy clients: %v", err)
+	}
+	impactToken, err := loadImpactToken(cfg.PushHistory)
+	if err != nil {
+		log.Fatalf("Failed to load the impact token: %v", err)
+	}
+	metrics := prometheus.NewRegistry()
+	metrics.MustRegister(tracker, proxy.deprecations, proxy.canary)
+
+	// Set up the server
+	http.HandleFunc("/lint", handleLint(engine))
+	http.Handle("/metrics/", proxy)
+	http.HandleFunc("/api/v1/query", handleQuery(newQueryEngine(), store))
+	http.HandleFunc("/compat", handleCompat)
+	http.HandleFunc("/catalog", handleCatalog(store, registry))
+	http.HandleFunc("/validate", handleValidate(store, registry))
+	http.HandleFunc("/check/scrape-config", handleScrapeCheck(cfg.Gateways))
+	http.HandleFunc("/rules/freshness", handleFreshnessRules(freshnessYAML))
+	http.HandleFunc("/expected", handleExpected(tracker))
+	http.HandleFunc("/deprecations", handleDeprecations(proxy.deprecations))
+	http.HandleFunc("/anomalies", handleAnomalies(proxy.anomalies))
+	http.HandleFunc("/impact", handleImpact(cfg, proxy.history, filepath.Dir(*configFile), impactToken))
+	http.HandleFunc("/policy", handlePolicy(policies))
+	http.Handle("/metrics", promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
+
+	port := 8080
+	fmt.Printf("Starting metrics linter server on port %d...\n", port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
 
-	if len(problems) == 0 {
-		// No problems found
-		response.Status = "success"
-		response.Message = "Input has been parsed successfully. No issues found."
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
-		return
+func runCommand(cfg *Config, args []string) int {
+	switch args[0] {
+	case "compat":
+		return runCompat(args[1:])
+	case "catalog":
+		return runCatalog(cfg, args[1:])
+	case "validate":
+		return runValidate(cfg, args[1:])
+	case "rules":
+		return runRules(cfg, args[1:])
+	case "check":
+		return runCheck(cfg, args[1:])
+	case "impact":
+		return runImpact(cfg, args[1:])
+	case "test":
+		return runTest(cfg, args[1:])
 	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+	return 2
+}
 
-	// Problems found
-	response.Status = "warning"
-	response.Message = "The input can be parsed but there are linting issues"
-	response.Problems = make([]ProblemDetails, 0, len(problems))
-	
-	for _, p := range problems {
-		response.Problems = append(response.Problems, ProblemDetails{
-			Metric: p.Metric,
-			Text:   p.Text,
-		})
+// handleLint lints the pushed exposition without forwarding it. The format
+// follows the Content-Type header and defaults to text.
+func handleLint(engine *lint.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only accept PUT method
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed. Use PUT.", http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+
+		report, err := engine.Lint(r.Context(), r.Body, r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to lint metrics: %v", err), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusOK
+		if report.Status == "error" {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, report)
 	}
-	
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
+}
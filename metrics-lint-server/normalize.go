@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// JobNormalization moves a per-run suffix of job names, such as a timestamp
+// or UUID, into a grouping-key label so the job stays stable across runs.
+type JobNormalization struct {
+	// Job optionally restricts the rule to jobs matching this regular
+	// expression (whole name).
+	Job string `yaml:"job"`
+	// Suffix is "timestamp", "uuid" or a regular expression matching the
+	// end of the job name. The suffix starts after a "-", "_" or ".",
+	// which is dropped, or where letters turn into digits or back, so
+	// words and numbers are never split. The longest such suffix wins.
+	Suffix string `yaml:"suffix"`
+	// Label is the grouping-key label receiving the suffix.
+	Label string `yaml:"label"`
+}
+
+// suffixPatterns are the built-in suffix detectors.
+var suffixPatterns = map[string]string{
+	// 20250505120000, 20250505T120000Z, 2025-05-05T12:00:00, 20250505,
+	// or Unix seconds/milliseconds since 2001.
+	"timestamp": `(?:19|20)\d{2}-?(?:0[1-9]|1[0-2])-?(?:0[1-9]|[12]\d|3[01])(?:[T_-]?(?:[01]\d|2[0-3]):?[0-5]\d(?::?[0-5]\d)?Z?)?|1\d{9}(?:\d{3})?`,
+	"uuid":      `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+type jobRule struct {
+	job    *regexp.Regexp
+	suffix *regexp.Regexp
+	label  model.LabelName
+}
+
+// JobRewrite describes a normalized job name in the push response.
+type JobRewrite struct {
+	OriginalJob string `json:"original_job"`
+	Job         string `json:"job"`
+	Label       string `json:"label"`
+	Value       string `json:"value"`
+}
+
+// jobNormalizer applies the configured rules in order; the first rule that
+// matches rewrites the job.
+type jobNormalizer struct {
+	rules []jobRule
+}
+
+func newJobNormalizer(rules []JobNormalization) (*jobNormalizer, error) {
+	n := &jobNormalizer{}
+	for i, r := range rules {
+		if !model.LabelName(r.Label).IsValid() || r.Label == model.JobLabel {
+			return nil, fmt.Errorf("job normalization %d: invalid label %q", i+1, r.Label)
+		}
+		pattern, ok := suffixPatterns[r.Suffix]
+		if !ok {
+			pattern = r.Suffix
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("job normalization %d: suffix is required", i+1)
+		}
+
+		jr := jobRule{label: model.LabelName(r.Label)}
+		var err error
+		if jr.suffix, err = regexp.Compile(`^(?:` + pattern + `)$`); err != nil {
+			return nil, fmt.Errorf("job normalization %d: invalid suffix: %v", i+1, err)
+		}
+		if r.Job != "" {
+			if jr.job, err = regexp.Compile("^(?:" + r.Job + ")$"); err != nil {
+				return nil, fmt.Errorf("job normalization %d: invalid job pattern: %v", i+1, err)
+			}
+		}
+		n.rules = append(n.rules, jr)
+	}
+	return n, nil
+}
+
+// Normalize returns the grouping key with the job suffix moved into the
+// rule's label, and the rewrite applied, or the key unchanged and nil. Rules
+// whose label is already part of the grouping key are skipped.
+func (n *jobNormalizer) Normalize(labels model.LabelSet) (model.LabelSet, *JobRewrite) {
+	job := string(labels[model.JobLabel])
+	for _, r := range n.rules {
+		if _, ok := labels[r.label]; ok {
+			continue
+		}
+		if r.job != nil && !r.job.MatchString(job) {
+			continue
+		}
+		name, suffix, ok := r.split(job)
+		if !ok {
+			continue
+		}
+
+		out := labels.Clone()
+		out[model.JobLabel] = model.LabelValue(name)
+		out[r.label] = model.LabelValue(suffix)
+		return out, &JobRewrite{OriginalJob: job, Job: name, Label: string(r.label), Value: suffix}
+	}
+	return labels, nil
+}
+
+// split returns the job name without its longest suffix matching the rule.
+// The suffix must follow a separator, which is dropped, or start where
+// letters turn into digits or back. Jobs consisting of the suffix only are
+// not split.
+func (r jobRule) split(job string) (name, suffix string, ok bool) {
+	for i := 1; i < len(job); i++ {
+		name, suffix = job[:i], job[i:]
+		if !r.suffix.MatchString(suffix) {
+			continue
+		}
+		if last := name[len(name)-1]; strings.IndexByte("-_.", last) >= 0 {
+			name = name[:len(name)-1]
+		} else if isDigit(last) == isDigit(suffix[0]) {
+			continue
+		}
+		if name != "" {
+			return name, suffix, true
+		}
+	}
+	return "", "", false
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// groupingKeyPath renders a grouping key as a Pushgateway URL path suffix,
+// job first and the other labels sorted. Values that cannot appear in a path
+// segment are base64 encoded.
+func groupingKeyPath(labels model.LabelSet) string {
+	names := make([]string, 0, len(labels))
+	for ln := range labels {
+		if ln != model.JobLabel {
+			names = append(names, string(ln))
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{model.JobLabel}, names...)
+
+	var b strings.Builder
+	for _, name := range names {
+		value := string(labels[model.LabelName(name)])
+		if value == "" || strings.Contains(value, "/") {
+			fmt.Fprintf(&b, "/%s@base64/%s", name, base64.RawURLEncoding.EncodeToString([]byte(value)))
+			if value == "" {
+				b.WriteString("=")
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "/%s/%s", name, url.PathEscape(value))
+	}
+	return b.String()
+}
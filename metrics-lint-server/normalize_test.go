@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestJobNormalizer(t *testing.T) {
+	rules := []JobNormalization{
+		{Job: "build_.*", Suffix: "uuid", Label: "build_id"},
+		{Suffix: "timestamp", Label: "run_id"},
+		{Job: "exporter.*", Suffix: `(?:[a-z0-9-]+\.)+internal`, Label: "host"},
+		{Job: "worker.*", Suffix: `\d+`, Label: "shard"},
+	}
+	normalizer, err := newJobNormalizer(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		labels model.LabelSet
+		want   model.LabelSet // nil if unchanged
+	}{
+		{
+			name:   "readme timestamp",
+			labels: model.LabelSet{"job": "sample_python_batch_job20250505120000"},
+			want:   model.LabelSet{"job": "sample_python_batch_job", "run_id": "20250505120000"},
+		},
+		{
+			name:   "separated ISO timestamp",
+			labels: model.LabelSet{"job": "nightly-2025-05-05T12:00:00"},
+			want:   model.LabelSet{"job": "nightly", "run_id": "2025-05-05T12:00:00"},
+		},
+		{
+			name:   "date",
+			labels: model.LabelSet{"job": "report_20250505"},
+			want:   model.LabelSet{"job": "report", "run_id": "20250505"},
+		},
+		{
+			name:   "unix seconds",
+			labels: model.LabelSet{"job": "cleanup.1714900000"},
+			want:   model.LabelSet{"job": "cleanup", "run_id": "1714900000"},
+		},
+		{
+			name:   "unix milliseconds",
+			labels: model.LabelSet{"job": "cleanup-1714900000123"},
+			want:   model.LabelSet{"job": "cleanup", "run_id": "1714900000123"},
+		},
+		{
+			name:   "readme uuid",
+			labels: model.LabelSet{"job": "build_123e4567-e89b-12d3-a456-426614174000"},
+			want:   model.LabelSet{"job": "build", "build_id": "123e4567-e89b-12d3-a456-426614174000"},
+		},
+		{
+			name:   "uuid outside the rule's jobs",
+			labels: model.LabelSet{"job": "deploy_123e4567-e89b-12d3-a456-426614174000"},
+		},
+		{
+			name:   "hostname",
+			labels: model.LabelSet{"job": "exporter.web-1.prod.internal", "instance": "a"},
+			want:   model.LabelSet{"job": "exporter", "host": "web-1.prod.internal", "instance": "a"},
+		},
+		{
+			name:   "numeric",
+			labels: model.LabelSet{"job": "worker-42"},
+			want:   model.LabelSet{"job": "worker", "shard": "42"},
+		},
+		{
+			name:   "numeric without separator",
+			labels: model.LabelSet{"job": "worker42"},
+			want:   model.LabelSet{"job": "worker", "shard": "42"},
+		},
+		{
+			name:   "digits in the job name stay",
+			labels: model.LabelSet{"job": "worker2-17"},
+			want:   model.LabelSet{"job": "worker2", "shard": "17"},
+		},
+		{
+			name:   "numbers are not split",
+			labels: model.LabelSet{"job": "job120250505"},
+		},
+		{
+			name:   "job is entirely a timestamp",
+			labels: model.LabelSet{"job": "20250505120000"},
+		},
+		{
+			name:   "job is entirely a uuid",
+			labels: model.LabelSet{"job": "123e4567-e89b-12d3-a456-426614174000"},
+		},
+		{
+			name:   "no suffix",
+			labels: model.LabelSet{"job": "sample_python_batch_job"},
+		},
+		{
+			name:   "label already in the grouping key",
+			labels: model.LabelSet{"job": "nightly-20250505", "run_id": "manual"},
+		},
+		{
+			name:   "label of the only matching rule already set",
+			labels: model.LabelSet{"job": "build_123e4567-e89b-12d3-a456-426614174000", "build_id": "7"},
+		},
+		{
+			name:   "first matching rule wins",
+			labels: model.LabelSet{"job": "worker-20250505"},
+			want:   model.LabelSet{"job": "worker", "run_id": "20250505"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rewrite := normalizer.Normalize(tt.labels)
+			if tt.want == nil {
+				if rewrite != nil || !got.Equal(tt.labels) {
+					t.Fatalf("rewrote %s to %s", tt.labels, got)
+				}
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+			if rewrite == nil {
+				t.Fatal("no rewrite reported")
+			}
+			if rewrite.OriginalJob != string(tt.labels[model.JobLabel]) || rewrite.Job != string(tt.want[model.JobLabel]) ||
+				string(tt.want[model.LabelName(rewrite.Label)]) != rewrite.Value {
+				t.Errorf("rewrite %+v", rewrite)
+			}
+			if tt.labels[model.JobLabel] == got[model.JobLabel] {
+				t.Error("the caller's grouping key was modified")
+			}
+		})
+	}
+}
+
+func TestNewJobNormalizerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    JobNormalization
+		wantErr string
+	}{
+		{name: "missing label", rule: JobNormalization{Suffix: "uuid"}, wantErr: `invalid label ""`},
+		{name: "job label", rule: JobNormalization{Suffix: "uuid", Label: "job"}, wantErr: `invalid label "job"`},
+		{name: "missing suffix", rule: JobNormalization{Label: "run_id"}, wantErr: "suffix is required"},
+		{name: "invalid suffix", rule: JobNormalization{Suffix: "(", Label: "run_id"}, wantErr: "invalid suffix"},
+		{name: "invalid job pattern", rule: JobNormalization{Job: "[", Suffix: "uuid", Label: "run_id"}, wantErr: "invalid job pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newJobNormalizer([]JobNormalization{tt.rule})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGroupingKeyPath(t *testing.T) {
+	tests := []struct {
+		labels model.LabelSet
+		want   string
+	}{
+		{labels: model.LabelSet{"job": "batch"}, want: "/job/batch"},
+		{labels: model.LabelSet{"job": "batch", "run_id": "20250505120000", "instance": "a"}, want: "/job/batch/instance/a/run_id/20250505120000"},
+		{labels: model.LabelSet{"job": "batch", "path": "/a/b"}, want: "/job/batch/path@base64/L2EvYg"},
+		{labels: model.LabelSet{"job": "batch", "instance": ""}, want: "/job/batch/instance@base64/="},
+		{labels: model.LabelSet{"job": "a b"}, want: "/job/a%20b"},
+	}
+	for _, tt := range tests {
+		if got := groupingKeyPath(tt.labels); got != tt.want {
+			t.Errorf("groupingKeyPath(%s) = %s, want %s", tt.labels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// policyFormatVersion is the version of the /policy document. It changes
+// only when the document changes incompatibly.
+const policyFormatVersion = 1
+
+// PolicyEndpoint lists the clients allowed to fetch their effective policy
+// from /policy. Without clients the endpoint is disabled.
+type PolicyEndpoint struct {
+	Clients []PolicyClient `yaml:"clients"`
+}
+
+// PolicyClient is a client authenticating with a bearer token.
+type PolicyClient struct {
+	// Identity is the client's value of the canary identity label, which
+	// decides the cohorts its policy is resolved for.
+	Identity string `yaml:"identity"`
+	// TokenFile holds the bearer token. Relative paths are resolved against
+	// the directory of the config file.
+	TokenFile string `yaml:"token_file"`
+}
+
+// ClientPolicy is the effective policy of one client, for SDKs to lint
+// pushes offline. Rules in canary rollout are resolved for the client's
+// cohort, so a rule the client is not enforced for shows its warn mode.
+//
+// The server enforces no per-client limits, such as series or push rate
+// limits, and no required labels, so the format has no fields for them.
+// Adding them would change the format version.
+type ClientPolicy struct {
+	FormatVersion int    `json:"format_version"`
+	Identity      string `json:"identity"`
+	// IdentityLabel is the label the client must push with to be
+	// identified as Identity, either in the grouping key or on its
+	// series. The grouping key wins when both have it.
+	IdentityLabel string            `json:"identity_label,omitempty"`
+	Cohorts       map[string]string `json:"canary_cohorts,omitempty"`
+	Rules         PolicyRules       `json:"rules"`
+	Renames       []PolicyRename    `json:"renames"`
+	// Metrics are the registered metric families with the labels they
+	// may carry. None of the labels is required.
+	Metrics []MetricSchema `json:"metrics"`
+}
+
+// PolicyRules are the effective settings of the push rules.
+type PolicyRules struct {
+	UntypedMetrics string          `json:"untyped_metrics"`
+	UTF8Names      PolicyUTF8Names `json:"utf8_names"`
+	CreatedSeries  string          `json:"created_series"`
+	// ReservedLabelPrefix starts label names that are never accepted.
+	ReservedLabelPrefix string                `json:"reserved_label_prefix"`
+	JobNormalization    []PolicyJobRule       `json:"job_normalization"`
+	PathNormalization   []PolicyPathRule      `json:"path_normalization"`
+	HistogramLayouts    []PolicyLayout        `json:"histogram_layouts"`
+	Deprecations        []PolicyDeprecation   `json:"deprecations"`
+	AnomalyDetection    *PolicyAnomalyMetrics `json:"anomaly_detection,omitempty"`
+}
+
+// PolicyUTF8Names is the effective UTF-8 name policy.
+type PolicyUTF8Names struct {
+	Policy   string `json:"policy"`
+	Escaping string `json:"escaping,omitempty"`
+}
+
+// PolicyJobRule moves a job name suffix matching Suffix, a regular
+// expression, into Label.
+type PolicyJobRule struct {
+	Job    string `json:"job,omitempty"`
+	Suffix string `json:"suffix"`
+	Label  string `json:"label"`
+}
+
+// PolicyPathRule collapses IDs in the path values of Labels.
+type PolicyPathRule struct {
+	Labels    []string `json:"labels"`
+	Templates []string `json:"templates,omitempty"`
+}
+
+// PolicyLayout is the canonical bucket layout of a histogram. Mode is
+// rebucket, reject, or flag when the client is only warned.
+type PolicyLayout struct {
+	Metric  string    `json:"metric"`
+	Buckets []float64 `json:"buckets"`
+	Mode    string    `json:"mode"`
+}
+
+// PolicyDeprecation is a deprecated metric glob. AfterSunset is strip,
+// reject, or warn when the client is not enforced for deprecations.
+type PolicyDeprecation struct {
+	Metric      string     `json:"metric"`
+	Replacement string     `json:"replacement,omitempty"`
+	Sunset      *time.Time `json:"sunset,omitempty"`
+	AfterSunset string     `json:"after_sunset"`
+}
+
+// PolicyAnomalyMetrics lists the metrics checked for anomalous values. The
+// statistics live on the server, so clients can only know which metrics are
+// watched and whether anomalies are rejected.
+type PolicyAnomalyMetrics struct {
+	Metrics []string `json:"metrics"`
+	Action  string   `json:"action"`
+}
+
+// PolicyRename is a metric rename; from End on only To is forwarded.
+type PolicyRename struct {
+	From   string            `json:"from"`
+	To     string            `json:"to"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Start  *time.Time        `json:"start,omitempty"`
+	End    *time.Time        `json:"end,omitempty"`
+}
+
+// policyServer authenticates clients and renders their policies from the
+// policies the push proxy applies.
+type policyServer struct {
+	cfg          *Config
+	untyped      *lint.UntypedPolicy
+	names        *lint.NamePolicy
+	deprecations *lint.DeprecationPolicy
+	layouts      *histogramLayouts
+	created      *createdPolicy
+	anomalies    *anomalyDetector
+	canary       *canaryRollout
+	registry     *Schema
+	// tokens maps bearer tokens to client identities.
+	tokens map[string]string
+}
+
+// loadPolicyTokens reads the token files of the policy clients.
+func loadPolicyTokens(cfg PolicyEndpoint) (map[string]string, error) {
+	tokens := map[string]string{}
+	for i, c := range cfg.Clients {
+		if c.Identity == "" || c.TokenFile == "" {
+			return nil, fmt.Errorf("policy client %d: identity and token_file are required", i+1)
+		}
+		data, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("policy client %s: %v", c.Identity, err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return nil, fmt.Errorf("policy client %s: %s is empty", c.Identity, c.TokenFile)
+		}
+		if _, dup := tokens[token]; dup {
+			return nil, fmt.Errorf("policy client %s: token is shared with another client", c.Identity)
+		}
+		tokens[token] = c.Identity
+	}
+	return tokens, nil
+}
+
+func newPolicyServer(cfg *Config, canary *canaryRollout, registry *Schema) (*policyServer, error) {
+	tokens, err := loadPolicyTokens(cfg.PolicyEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	s := &policyServer{cfg: cfg, canary: canary, registry: registry, tokens: tokens}
+	if s.untyped, err = lint.NewUntypedPolicy(cfg.UntypedMetrics); err != nil {
+		return nil, err
+	}
+	if s.names, err = lint.NewNamePolicy(cfg.UTF8Names); err != nil {
+		return nil, err
+	}
+	if s.deprecations, err = lint.NewDeprecationPolicy(cfg.Deprecations); err != nil {
+		return nil, err
+	}
+	if s.layouts, err = newHistogramLayouts(cfg.HistogramLayouts); err != nil {
+		return nil, err
+	}
+	if s.created, err = newCreatedPolicy(cfg.CreatedSeries); err != nil {
+		return nil, err
+	}
+	if s.anomalies, err = newAnomalyDetector(cfg.AnomalyDetection); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// authenticate returns the identity of the bearer token of the request.
+func (s *policyServer) authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for t, identity := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(strings.TrimSpace(token))) == 1 {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+// Policy resolves the effective policy of a client.
+func (s *policyServer) Policy(identity string) ClientPolicy {
+	cfg := s.cfg
+	rollout := s.canary.Assign(model.LabelSet{s.canary.label: model.LabelValue(identity)}, nil)
+	p := ClientPolicy{
+		FormatVersion: policyFormatVersion,
+		Identity:      identity,
+		Cohorts:       rollout.cohorts,
+		Renames:       []PolicyRename{},
+		Metrics:       append([]MetricSchema{}, s.registry.Metrics...),
+	}
+	if len(rollout.cohorts) > 0 {
+		p.IdentityLabel = string(s.canary.label)
+	}
+
+	untyped, names, layouts := s.untyped, s.names, s.layouts
+	if !rollout.Enforced(ruleUntypedMetrics) {
+		untyped = untyped.Relaxed()
+	}
+	if !rollout.Enforced(ruleUTF8Names) {
+		names = names.Relaxed()
+	}
+	if !rollout.Enforced(ruleHistogramLayouts) {
+		layouts = layouts.Relaxed()
+	}
+
+	rules := &p.Rules
+	rules.UntypedMetrics = untyped.Mode()
+	rules.UTF8Names = PolicyUTF8Names{Policy: names.Mode()}
+	if escaping := names.ForwardEscaping(); escaping != model.NoEscaping {
+		rules.UTF8Names.Escaping = escaping.String()
+	}
+	rules.CreatedSeries = s.created.Mode()
+	rules.ReservedLabelPrefix = model.ReservedLabelPrefix
+
+	rules.JobNormalization = []PolicyJobRule{}
+	for _, r := range cfg.JobNormalization {
+		suffix, ok := suffixPatterns[r.Suffix]
+		if !ok {
+			suffix = r.Suffix
+		}
+		rules.JobNormalization = append(rules.JobNormalization, PolicyJobRule{Job: r.Job, Suffix: suffix, Label: r.Label})
+	}
+	rules.PathNormalization = []PolicyPathRule{}
+	for _, n := range cfg.PathNormalization {
+		rules.PathNormalization = append(rules.PathNormalization, PolicyPathRule{Labels: n.Labels, Templates: n.Templates})
+	}
+	rules.HistogramLayouts = []PolicyLayout{}
+	for _, l := range layouts.Layouts() {
+		rules.HistogramLayouts = append(rules.HistogramLayouts, PolicyLayout{Metric: l.Metric, Buckets: l.Buckets, Mode: l.Mode})
+	}
+	rules.Deprecations = []PolicyDeprecation{}
+	for _, d := range s.deprecations.Deprecations() {
+		pd := PolicyDeprecation{Metric: d.Metric, Replacement: d.Replacement, AfterSunset: d.Action(rollout.Enforced(ruleDeprecations))}
+		if !d.Sunset.IsZero() {
+			sunset := d.Sunset
+			pd.Sunset = &sunset
+		}
+		rules.Deprecations = append(rules.Deprecations, pd)
+	}
+	if a := cfg.AnomalyDetection; a != nil {
+		rules.AnomalyDetection = &PolicyAnomalyMetrics{Metrics: a.Metrics, Action: s.anomalies.Action(rollout.Enforced(ruleAnomalies))}
+	}
+
+	for _, r := range cfg.Renames {
+		pr := PolicyRename{From: r.From, To: r.To, Labels: r.Labels}
+		if !r.Start.IsZero() {
+			start := r.Start
+			pr.Start = &start
+		}
+		if !r.End.IsZero() {
+			end := r.End
+			pr.End = &end
+		}
+		p.Renames = append(p.Renames, pr)
+	}
+	sort.Slice(p.Renames, func(i, j int) bool { return p.Renames[i].From < p.Renames[j].From })
+	return p
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePolicy serves the effective policy of the authenticated client. The
+// ETag is a hash of the document, so clients can poll with If-None-Match
+// and only download it again when it changed.
+func handlePolicy(s *policyServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed. Use GET.", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(s.tokens) == 0 {
+			http.Error(w, "The policy endpoint is not configured.", http.StatusNotFound)
+			return
+		}
+		identity, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metriclint"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(s.Policy(identity)); err != nil {
+			http.Error(w, "Failed to render policy", http.StatusInternalServerError)
+			return
+		}
+		sum := sha256.Sum256(b.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("Vary", "Authorization")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b.Bytes())
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// newTestPolicyServer returns a policy server with one client per token,
+// identified by the token's name.
+func newTestPolicyServer(t *testing.T, cfg *Config, identities ...string) *policyServer {
+	t.Helper()
+	dir := t.TempDir()
+	for _, identity := range identities {
+		file := filepath.Join(dir, identity+".token")
+		if err := os.WriteFile(file, []byte(identity+"-token\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg.PolicyEndpoint.Clients = append(cfg.PolicyEndpoint.Clients, PolicyClient{Identity: identity, TokenFile: file})
+	}
+	rollout, err := newCanaryRollout(cfg.Canary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newPolicyServer(cfg, rollout, &Schema{Metrics: []MetricSchema{{Name: "jobs_total", Type: "counter", Labels: []string{"queue"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPolicy(t *testing.T) {
+	// Find identities on either side of 50, so the cases do not depend on
+	// the hash function's values.
+	var canary, control string
+	for i := 0; canary == "" || control == ""; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		if identityBucket(profileRollout("strict"), id) < 50 {
+			canary = id
+		} else {
+			control = id
+		}
+	}
+	sunset := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg := &Config{
+		JobNormalization: []JobNormalization{{Suffix: "uuid", Label: "run"}},
+		HistogramLayouts: []HistogramLayout{{Metric: "latency_seconds", Buckets: []float64{1, 2}}},
+		CreatedSeries:    createdDrop,
+		AnomalyDetection: &AnomalyDetection{Metrics: []string{"jobs_*"}, Action: "reject"},
+		Config: lint.Config{
+			UntypedMetrics: "reject",
+			UTF8Names:      lint.UTF8Names{Policy: "escape"},
+			Deprecations:   []lint.Deprecation{{Metric: "legacy_*", Sunset: sunset}, {Metric: "old_*"}},
+			Renames:        []lint.MetricRename{{From: "z_total", To: "y_total"}, {From: "a_total", To: "b_total", End: sunset}},
+		},
+		Canary: Canary{IdentityLabel: "userid", Profiles: map[string]CanaryProfile{
+			"strict": {Percent: 50, Rules: []string{ruleUntypedMetrics, ruleUTF8Names, ruleHistogramLayouts, ruleDeprecations, ruleAnomalies}},
+		}},
+	}
+	s := newTestPolicyServer(t, cfg)
+
+	tests := []struct {
+		identity string
+		want     string // untyped utf8 escaping layout deprecations anomalies
+	}{
+		{identity: canary, want: "reject escape underscores rebucket strip,warn reject"},
+		{identity: control, want: "warn warn  flag warn,warn warn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identity, func(t *testing.T) {
+			p := s.Policy(tt.identity)
+			r := p.Rules
+			got := fmt.Sprintf("%s %s %s %s %s,%s %s", r.UntypedMetrics, r.UTF8Names.Policy, r.UTF8Names.Escaping,
+				r.HistogramLayouts[0].Mode, r.Deprecations[0].AfterSunset, r.Deprecations[1].AfterSunset, r.AnomalyDetection.Action)
+			if got != tt.want {
+				t.Errorf("rules %s, want %s", got, tt.want)
+			}
+			if p.FormatVersion != policyFormatVersion || p.Identity != tt.identity || p.IdentityLabel != "userid" {
+				t.Errorf("header %d %s %s", p.FormatVersion, p.Identity, p.IdentityLabel)
+			}
+			if r.CreatedSeries != createdDrop {
+				t.Errorf("created series %s, want %s", r.CreatedSeries, createdDrop)
+			}
+			if p.Rules.JobNormalization[0].Suffix != suffixPatterns["uuid"] {
+				t.Errorf("job suffix %s, want the uuid pattern", p.Rules.JobNormalization[0].Suffix)
+			}
+			if len(p.Renames) != 2 || p.Renames[0].From != "a_total" || p.Renames[0].End == nil || p.Renames[1].End != nil {
+				t.Errorf("renames %+v, want a_total with its end first", p.Renames)
+			}
+			if len(p.Metrics) != 1 || p.Metrics[0].Name != "jobs_total" {
+				t.Errorf("metrics %+v", p.Metrics)
+			}
+		})
+	}
+
+	defaults := newTestPolicyServer(t, &Config{}).Policy("anyone")
+	if r := defaults.Rules; r.UntypedMetrics != "warn" || r.UTF8Names.Policy != "warn" || r.CreatedSeries != createdKeep || defaults.IdentityLabel != "" {
+		t.Errorf("default policy %+v", defaults)
+	}
+}
+
+func TestHandlePolicy(t *testing.T) {
+	s := newTestPolicyServer(t, &Config{}, "checkout", "billing")
+	etag := func(token string) string {
+		req := httptest.NewRequest(http.MethodGet, "/policy", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handlePolicy(s)(rec, req)
+		return rec.Header().Get("ETag")
+	}
+	checkout := etag("checkout-token")
+	if checkout == "" || checkout == etag("billing-token") {
+		t.Fatalf("ETags %q and %q, want distinct ETags per client", checkout, etag("billing-token"))
+	}
+
+	tests := []struct {
+		name        string
+		server      *policyServer
+		method      string
+		token       string
+		ifNoneMatch string
+		wantCode    int
+	}{
+		{name: "not configured", server: newTestPolicyServer(t, &Config{}), token: "checkout-token", wantCode: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodPost, token: "checkout-token", wantCode: http.StatusMethodNotAllowed},
+		{name: "missing token", wantCode: http.StatusUnauthorized},
+		{name: "unknown token", token: "nope", wantCode: http.StatusUnauthorized},
+		{name: "policy", token: "checkout-token", wantCode: http.StatusOK},
+		{name: "unchanged", token: "checkout-token", ifNoneMatch: checkout, wantCode: http.StatusNotModified},
+		{name: "weak and listed ETags", token: "checkout-token", ifNoneMatch: `"other", W/` + checkout, wantCode: http.StatusNotModified},
+		{name: "any ETag", token: "checkout-token", ifNoneMatch: "*", wantCode: http.StatusNotModified},
+		{name: "changed", token: "checkout-token", ifNoneMatch: `"other"`, wantCode: http.StatusOK},
+		{name: "ETag of another client", token: "billing-token", ifNoneMatch: checkout, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, method := tt.server, tt.method
+			if server == nil {
+				server = s
+			}
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/policy", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			handlePolicy(server)(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			switch rec.Code {
+			case http.StatusUnauthorized:
+				if rec.Header().Get("WWW-Authenticate") == "" {
+					t.Error("no WWW-Authenticate header")
+				}
+			case http.StatusOK:
+				if !strings.Contains(rec.Body.String(), `"format_version":1`) || rec.Header().Get("ETag") == "" {
+					t.Errorf("body %s, ETag %q", rec.Body.String(), rec.Header().Get("ETag"))
+				}
+			case http.StatusNotModified:
+				if rec.Body.Len() != 0 {
+					t.Errorf("304 with body %s", rec.Body.String())
+				}
+			}
+		})
+	}
+}
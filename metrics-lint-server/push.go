@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// PushResponse is the JSON body the push proxy responds to pushes with. The
+// fields after Rule describe what the proxy changed before forwarding.
+type PushResponse struct {
+	Status       string                `json:"status"`
+	Message      string                `json:"message,omitempty"`
+	Problems     []lint.ProblemDetails `json:"problems,omitempty"`
+	ErrorText    string                `json:"error,omitempty"`
+	Rule         string                `json:"rule,omitempty"`
+	Rewrite      *JobRewrite           `json:"rewrite,omitempty"`
+	Histograms   []HistogramAction     `json:"histograms,omitempty"`
+	EscapedNames map[string]string     `json:"escaped_names,omitempty"`
+	Inferred     []lint.TypeInference  `json:"inferred_types,omitempty"`
+	Renamed      []lint.RenameAction   `json:"renamed,omitempty"`
+	Accumulated  []string              `json:"accumulated,omitempty"`
+	Anomalies    []Anomaly             `json:"anomalies,omitempty"`
+	Canary       map[string]string     `json:"canary_cohorts,omitempty"`
+}
+
+// pushProxy accepts pushes using the Pushgateway API (/metrics/job/<job>/...),
+// lints the payload and forwards accepted pushes to the upstream gateway.
+// Accepted pushes are recorded in the store so they can be queried locally.
+type pushProxy struct {
+	gatewayURL   string
+	store        *metricStore
+	tracker      *pushTracker
+	normalizer   *jobNormalizer
+	engine       *lint.Engine
+	layouts      *histogramLayouts
+	created      *createdPolicy
+	deprecations *deprecationRegistry
+	deltas       *deltaAccumulator
+	anomalies    *anomalyDetector
+	canary       *canaryRollout
+	history      *pushHistory
+	client       *http.Client
+	// now is the clock pushes are checked at; replays set it to the time
+	// a push was recorded.
+	now func() time.Time
+}
+
+// newPushProxy builds the push policies from the config. Recording of
+// pushes for replay is off until history is set.
+func newPushProxy(gatewayURL string, cfg *Config, store *metricStore, tracker *pushTracker) (*pushProxy, error) {
+	p := &pushProxy{
+		gatewayURL: strings.TrimRight(gatewayURL, "/"),
+		store:      store,
+		tracker:    tracker,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+	var err error
+	if p.normalizer, err = newJobNormalizer(cfg.JobNormalization); err != nil {
+		return nil, err
+	}
+	if p.engine, err = lint.New(cfg.Config); err != nil {
+		return nil, err
+	}
+	if p.layouts, err = newHistogramLayouts(cfg.HistogramLayouts); err != nil {
+		return nil, err
+	}
+	if p.created, err = newCreatedPolicy(cfg.CreatedSeries); err != nil {
+		return nil, err
+	}
+	if p.deprecations, err = newDeprecationRegistry(cfg.Deprecations); err != nil {
+		return nil, err
+	}
+	if p.deltas, err = newDeltaAccumulator(cfg.DeltaPush); err != nil {
+		return nil, err
+	}
+	if p.anomalies, err = newAnomalyDetector(cfg.AnomalyDetection); err != nil {
+		return nil, err
+	}
+	if p.canary, err = newCanaryRollout(cfg.Canary); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pushProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed. Use PUT, POST or DELETE.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupLabels, err := parseGroupingKey(strings.TrimPrefix(r.URL.Path, "/metrics/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := r.URL.EscapedPath()
+	groupLabels, rewrite := p.normalizer.Normalize(groupLabels)
+	if rewrite != nil {
+		path = "/metrics" + groupingKeyPath(groupLabels)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	now := p.now()
+	p.history.Record(r, body, now)
+	if r.Method == http.MethodDelete {
+		// A delta group is reset under its lock, so no push forwards the
+		// old totals after the gateway deleted them.
+		var delta *deltaTxn
+		if p.deltas.Enabled(groupLabels) {
+			delta = p.deltas.Begin(groupLabels)
+			defer delta.Close()
+		}
+		status, err := p.forward(r, path, r.Header.Get("Content-Type"), body)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, PushResponse{Status: "error", Message: "Failed to forward to gateway", Rule: "gateway", ErrorText: err.Error()})
+			return
+		}
+		if status < 400 {
+			p.store.Delete(groupLabels, now)
+			if delta != nil {
+				if err := delta.Reset(); err != nil {
+					log.Printf("Failed to reset delta state of %s: %v", groupLabels, err)
+				}
+			}
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	format := expfmt.ResponseFormat(r.Header)
+	if format.FormatType() != expfmt.TypeProtoDelim && !bytes.HasSuffix(body, []byte("\n")) {
+		body = append(body, '\n')
+	}
+
+	// The gateway does not accept OpenMetrics, so such pushes are always
+	// re-encoded.
+	openMetrics := lint.ParseFormat(contentType) == lint.FormatOpenMetrics
+	var families []*dto.MetricFamily
+	if openMetrics {
+		format = expfmt.NewFormat(expfmt.TypeTextPlain)
+		families, err = lint.Decode(bytes.NewReader(body), lint.FormatOpenMetrics)
+	} else {
+		families, err = lint.DecodeFamilies(bytes.NewReader(body), format)
+	}
+	if err == nil {
+		err = lint.UnescapeNames(families, contentType)
+	}
+	if err != nil {
+		p.reject(w, groupLabels, now, http.StatusBadRequest, PushResponse{Status: "error", Message: "Failed to parse metrics", Rule: lint.RuleParse, ErrorText: err.Error()})
+		return
+	}
+
+	// Rules in canary rollout only warn clients outside the canary cohort.
+	rollout := p.canary.Assign(groupLabels, families)
+	var st pushStages
+	if p.deltas.Enabled(groupLabels) {
+		st.delta = p.deltas.Begin(groupLabels)
+		defer st.delta.Close()
+	}
+	result := p.engine.LintFamilies(families, groupLabels, &lint.Options{Now: now, Enforced: rollout.Enforced, Stages: p.stages(groupLabels, now, rollout, &st)})
+	for rule, hit := range result.Matched {
+		rollout.Record(rule, hit)
+	}
+	if result.Status == "error" {
+		p.reject(w, groupLabels, now, http.StatusBadRequest, PushResponse{Status: "error", Message: result.Message, Rule: result.Rule, ErrorText: result.ErrorText, Histograms: st.histograms, Anomalies: st.anomalies})
+		return
+	}
+	families = result.Families
+
+	// Only the protobuf format carries OpenMetrics units and gauge
+	// histograms to the gateway.
+	forceProto := st.forceProto
+	if openMetrics && needsProtobuf(families) {
+		forceProto = true
+	}
+	if openMetrics || result.Changed {
+		if forceProto {
+			format = expfmt.NewFormat(expfmt.TypeProtoDelim)
+		} else if format.FormatType() != expfmt.TypeProtoDelim {
+			format = expfmt.NewFormat(expfmt.TypeTextPlain)
+		}
+		// The encoder escapes names by the format's escaping parameter.
+		format = format.WithEscapingScheme(result.Escaping)
+		if body, err = encodeFamilies(families, format); err != nil {
+			p.reject(w, groupLabels, now, http.StatusInternalServerError, PushResponse{Status: "error", Message: "Failed to encode normalized metrics", Rule: "encode", ErrorText: err.Error()})
+			return
+		}
+		contentType = string(format)
+	}
+
+	status, err := p.forward(r, path, contentType, body)
+	if err != nil {
+		p.reject(w, groupLabels, now, http.StatusBadGateway, PushResponse{Status: "error", Message: "Failed to forward to gateway", Rule: "gateway", ErrorText: err.Error()})
+		return
+	}
+	if status >= 400 {
+		p.reject(w, groupLabels, now, status, PushResponse{Status: "error", Message: fmt.Sprintf("Gateway rejected the push with status %d", status), Rule: "gateway", Rewrite: rewrite})
+		return
+	}
+
+	if st.delta != nil {
+		if err := st.delta.Commit(); err != nil {
+			log.Printf("Failed to persist delta state of %s: %v", groupLabels, err)
+		}
+	}
+
+	if r.Method == http.MethodPut {
+		p.store.Replace(groupLabels, families, now)
+	} else {
+		p.store.Merge(groupLabels, families, now)
+	}
+	p.tracker.Observe(groupLabels, now)
+	p.anomalies.Observe(st.observations)
+	p.deprecations.Record(groupLabels, result.Deprecated, now)
+
+	response := PushResponse{Status: "success", Message: "Metrics accepted and forwarded to the gateway.", Rewrite: rewrite, Histograms: st.histograms, EscapedNames: result.EscapedNames, Inferred: result.Inferred, Renamed: result.Renamed, Accumulated: st.accumulated, Anomalies: st.anomalies, Canary: rollout.cohorts}
+	if len(result.Problems) > 0 {
+		response.Status = "warning"
+		response.Message = "Metrics forwarded to the gateway but there are linting issues"
+		response.Problems = result.Problems
+	}
+	writeJSON(w, status, response)
+}
+
+// pushStages holds what the proxy's own stages did to a push.
+type pushStages struct {
+	histograms []HistogramAction
+	forceProto bool
+	// delta is the locked delta group of the push, if it has one. Delta
+	// pushes are forwarded as the cumulative values of their group.
+	delta        *deltaTxn
+	accumulated  []string
+	observations []anomalyObservation
+	anomalies    []Anomaly
+}
+
+// stages returns the steps of the push pipeline the lint engine does not
+// implement, which record what they did in st.
+func (p *pushProxy) stages(groupLabels model.LabelSet, now time.Time, rollout *canaryAssignment, st *pushStages) []lint.Stage {
+	layouts := p.layouts
+	if !rollout.Enforced(ruleHistogramLayouts) {
+		layouts = layouts.Relaxed()
+	}
+	stages := []lint.Stage{
+		{Rule: ruleHistogramLayouts, Message: "Histogram bucket layout rejected", Apply: func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []lint.ProblemDetails, error) {
+			var err error
+			st.histograms, err = layouts.Apply(families)
+			rollout.Record(ruleHistogramLayouts, len(st.histograms) > 0)
+			return families, len(st.histograms) > 0, nil, err
+		}},
+		{Rule: "created_series", Apply: func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []lint.ProblemDetails, error) {
+			var changed bool
+			families, changed, st.forceProto = p.created.Apply(families)
+			return families, changed, nil, nil
+		}},
+	}
+	if st.delta != nil {
+		stages = append(stages, lint.Stage{Rule: "delta_push", Message: "Failed to accumulate delta push", Apply: func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []lint.ProblemDetails, error) {
+			var err error
+			families, st.accumulated, err = st.delta.Accumulate(families)
+			return families, true, nil, err
+		}})
+	}
+	return append(stages, lint.Stage{Rule: ruleAnomalies, Message: "Anomalous values rejected", Apply: func(families []*dto.MetricFamily) ([]*dto.MetricFamily, bool, []lint.ProblemDetails, error) {
+		st.observations, st.anomalies = p.anomalies.Check(groupLabels, families, now, rollout.Enforced(ruleAnomalies))
+		rollout.Record(ruleAnomalies, len(st.anomalies) > 0)
+		if p.anomalies.Rejects(st.anomalies) {
+			p.anomalies.ObserveRejected(st.observations)
+			return nil, false, nil, fmt.Errorf("%d values deviate from their series' statistics", len(st.anomalies))
+		}
+		return families, false, anomalyProblems(st.anomalies), nil
+	}})
+}
+
+// reject records a failed push of the group and responds with the reason.
+func (p *pushProxy) reject(w http.ResponseWriter, groupLabels model.LabelSet, now time.Time, status int, response PushResponse) {
+	p.store.RecordFailure(groupLabels, now)
+	writeJSON(w, status, response)
+}
+
+// forward sends the request body to the given path on the upstream gateway
+// and returns the gateway's status code.
+func (p *pushProxy) forward(r *http.Request, path, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, p.gatewayURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("Gateway returned %d for %s: %s", resp.StatusCode, r.URL.Path, strings.TrimSpace(string(msg)))
+	}
+	return resp.StatusCode, nil
+}
+
+// parseGroupingKey parses the "job/<job>/<label>/<value>..." part of a
+// Pushgateway URL. A label name suffixed with "@base64" carries a base64url
+// encoded value, which is how clients push values containing slashes.
+func parseGroupingKey(path string) (model.LabelSet, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "job" && segments[0] != "job@base64" {
+		return nil, fmt.Errorf("invalid push path %q, expected job/<job>[/<label>/<value>...]", path)
+	}
+	if len(segments)%2 != 0 {
+		return nil, fmt.Errorf("odd number of segments in grouping key %q", path)
+	}
+
+	labels := model.LabelSet{}
+	for i := 0; i < len(segments); i += 2 {
+		name, value := segments[i], segments[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for label %q: %v", name, err)
+			}
+			value = string(decoded)
+		}
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q in grouping key", name)
+		}
+		labels[model.LabelName(name)] = model.LabelValue(value)
+	}
+	if labels[model.JobLabel] == "" {
+		return nil, fmt.Errorf("job name must not be empty")
+	}
+	return labels, nil
+}
+
+// encodeFamilies serializes families so rewritten pushes can be forwarded.
+func encodeFamilies(families []*dto.MetricFamily, format expfmt.Format) ([]byte, error) {
+	var b bytes.Buffer
+	enc := expfmt.NewEncoder(&b, format)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// needsProtobuf reports whether any family declares a unit or is a gauge
+// histogram, which the text format cannot carry.
+func needsProtobuf(families []*dto.MetricFamily) bool {
+	for _, mf := range families {
+		if mf.GetUnit() != "" || mf.GetType() == dto.MetricType_GAUGE_HISTOGRAM {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
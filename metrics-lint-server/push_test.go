@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// recordingGateway stands in for the Pushgateway and keeps the last push.
+type recordingGateway struct {
+	contentType string
+	body        []byte
+}
+
+func (g *recordingGateway) RoundTrip(r *http.Request) (*http.Response, error) {
+	g.contentType = r.Header.Get("Content-Type")
+	g.body, _ = io.ReadAll(r.Body)
+	return acceptingGateway{}.RoundTrip(r)
+}
+
+func TestPushOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantProto bool
+		want      string // forwarded families as "name type unit" lines
+	}{
+		{
+			name: "counter",
+			body: "# TYPE jobs counter\n# HELP jobs Jobs.\njobs_total 3\n# EOF\n",
+			want: "jobs_total COUNTER ",
+		},
+		{
+			name:      "unit",
+			body:      "# TYPE run_seconds gauge\n# HELP run_seconds Run time.\n# UNIT run_seconds seconds\nrun_seconds 3\n# EOF\n",
+			wantProto: true,
+			want:      "run_seconds GAUGE seconds",
+		},
+		{
+			name:      "gauge histogram",
+			body:      "# TYPE queue_seconds gaugehistogram\n# HELP queue_seconds Queued.\nqueue_seconds_bucket{le=\"+Inf\"} 3\nqueue_seconds_gcount 3\nqueue_seconds_gsum 4.5\n# EOF\n",
+			wantProto: true,
+			want:      "queue_seconds GAUGE_HISTOGRAM ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, cleanup, err := newReplayProxy(&Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			gateway := &recordingGateway{}
+			proxy.client = &http.Client{Transport: gateway}
+
+			push := recordedPush{Time: time.Now(), Method: http.MethodPut, Path: "/metrics/job/batch", ContentType: "application/openmetrics-text; version=1.0.0", Body: []byte(tt.body)}
+			if code, resp := replayPush(proxy, push); code >= 400 {
+				t.Fatalf("push rejected: %s", resp.ErrorText)
+			}
+			format := lint.ParseFormat(gateway.contentType)
+			if (format == lint.FormatProtobuf) != tt.wantProto {
+				t.Fatalf("forwarded as %s", gateway.contentType)
+			}
+			families, err := lint.Decode(bytes.NewReader(gateway.body), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, mf := range families {
+				got = append(got, mf.GetName()+" "+mf.GetType().String()+" "+mf.GetUnit())
+			}
+			if strings.Join(got, "\n") != tt.want {
+				t.Errorf("forwarded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// QueryResponse follows the Prometheus HTTP API envelope so existing tools
+// can consume /api/v1/query results.
+type QueryResponse struct {
+	Status    string     `json:"status"`
+	Data      *QueryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	ErrorText string     `json:"error,omitempty"`
+	Warnings  []string   `json:"warnings,omitempty"`
+	Infos     []string   `json:"infos,omitempty"`
+}
+
+type QueryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+// newQueryEngine returns the PromQL engine queries are evaluated with, set
+// up like a Prometheus server with default flags.
+func newQueryEngine() *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		MaxSamples:           50000000,
+		Timeout:              2 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+}
+
+// handleQuery evaluates an instant PromQL query against the accepted pushes,
+// as Prometheus scraping the gateway would have seen them at the query time.
+func handleQuery(engine *promql.Engine, store *metricStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed. Use GET or POST.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.FormValue("query")
+		if query == "" {
+			writeJSON(w, http.StatusBadRequest, QueryResponse{Status: "error", ErrorType: "bad_data", ErrorText: "missing query parameter"})
+			return
+		}
+
+		ts := time.Now()
+		if t := r.FormValue("time"); t != "" {
+			var err error
+			if ts, err = parseQueryTime(t); err != nil {
+				writeJSON(w, http.StatusBadRequest, QueryResponse{Status: "error", ErrorType: "bad_data", ErrorText: err.Error()})
+				return
+			}
+		}
+
+		q, err := engine.NewInstantQuery(r.Context(), store, nil, query, ts)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, QueryResponse{Status: "error", ErrorType: "bad_data", ErrorText: err.Error()})
+			return
+		}
+		defer q.Close()
+
+		res := q.Exec(r.Context())
+		if res.Err != nil {
+			status, errType := queryErrorType(res.Err)
+			writeJSON(w, status, QueryResponse{Status: "error", ErrorType: errType, ErrorText: res.Err.Error()})
+			return
+		}
+		warnings, infos := res.Warnings.AsStrings(query, 10, 10)
+		writeJSON(w, http.StatusOK, QueryResponse{
+			Status:   "success",
+			Data:     &QueryData{ResultType: res.Value.Type(), Result: res.Value},
+			Warnings: warnings,
+			Infos:    infos,
+		})
+	}
+}
+
+// queryErrorType maps engine errors to status codes and error types the
+// way the Prometheus API does.
+func queryErrorType(err error) (int, string) {
+	switch err.(type) {
+	case promql.ErrQueryCanceled:
+		return http.StatusServiceUnavailable, "canceled"
+	case promql.ErrQueryTimeout:
+		return http.StatusServiceUnavailable, "timeout"
+	case promql.ErrStorage:
+		return http.StatusInternalServerError, "internal"
+	}
+	return http.StatusUnprocessableEntity, "execution"
+}
+
+// parseQueryTime accepts RFC3339 or Unix timestamps, as Prometheus does.
+func parseQueryTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// t0 is aligned to the assumed scrape interval.
+var t0 = time.Unix(1700000100, 0)
+
+// queryAt evaluates an instant query and returns the result as sorted
+// "labels value" lines.
+func queryAt(t *testing.T, store *metricStore, query string, ts time.Time) []string {
+	t.Helper()
+	q, err := newQueryEngine().NewInstantQuery(context.Background(), store, nil, query, ts)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", query, err)
+	}
+	defer q.Close()
+	res := q.Exec(context.Background())
+	if res.Err != nil {
+		t.Fatalf("evaluating %q: %v", query, res.Err)
+	}
+	var out []string
+	switch v := res.Value.(type) {
+	case promql.Vector:
+		for _, s := range v {
+			out = append(out, s.Metric.String()+" "+strconv.FormatFloat(s.F, 'f', -1, 64))
+		}
+	case promql.Scalar:
+		out = append(out, strconv.FormatFloat(v.V, 'f', -1, 64))
+	default:
+		t.Fatalf("unexpected result type %s", res.Value.Type())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestStoreQueries(t *testing.T) {
+	job := model.LabelSet{model.JobLabel: "batch"}
+	store := newMetricStore()
+	store.Replace(job, parseFamilies(t, `
+# TYPE requests_total counter
+requests_total{endpoint="/a"} 10
+requests_total{endpoint="/b"} 1
+# TYPE queue_size gauge
+queue_size 3
+`), t0)
+	store.Merge(job, parseFamilies(t, `
+# TYPE queue_size gauge
+queue_size 5
+`), t0.Add(30*time.Second))
+	store.Replace(job, parseFamilies(t, `
+# TYPE requests_total counter
+requests_total{endpoint="/a"} 70
+`), t0.Add(time.Minute))
+	store.Replace(model.LabelSet{model.JobLabel: "other", "instance": "x"}, parseFamilies(t, `
+# TYPE requests_total counter
+requests_total{endpoint="/a",instance="pushed"} 2
+`), t0)
+	store.Delete(model.LabelSet{model.JobLabel: "other", "instance": "x"}, t0.Add(2*time.Minute))
+
+	tests := []struct {
+		name  string
+		query string
+		at    time.Time
+		want  []string
+	}{
+		{
+			name:  "before the first push",
+			query: `{__name__="requests_total", job="batch"}`,
+			at:    t0.Add(-time.Second),
+		},
+		{
+			name:  "at the push",
+			query: `{__name__="requests_total", job="batch"}`,
+			at:    t0,
+			want: []string{
+				`{__name__="requests_total", endpoint="/a", job="batch"} 10`,
+				`{__name__="requests_total", endpoint="/b", job="batch"} 1`,
+			},
+		},
+		{
+			name:  "merge keeps other families",
+			query: `{__name__="requests_total", job="batch"} + on(job) group_left queue_size`,
+			at:    t0.Add(45 * time.Second),
+			want: []string{
+				`{endpoint="/a", job="batch"} 15`,
+				`{endpoint="/b", job="batch"} 6`,
+			},
+		},
+		{
+			name:  "replace drops series that were not pushed again",
+			query: `{__name__="requests_total", job="batch"}`,
+			at:    t0.Add(time.Minute),
+			want:  []string{`{__name__="requests_total", endpoint="/a", job="batch"} 70`},
+		},
+		{
+			name:  "replaced families are gone",
+			query: `queue_size`,
+			at:    t0.Add(time.Minute),
+		},
+		{
+			name:  "exposed values stay visible past the lookback delta",
+			query: `{__name__="requests_total", job="batch"}`,
+			at:    t0.Add(40 * time.Minute),
+			want:  []string{`{__name__="requests_total", endpoint="/a", job="batch"} 70`},
+		},
+		{
+			name:  "range over pushes and scrapes",
+			query: `count_over_time(requests_total{endpoint="/a",job="batch"}[1m])`,
+			at:    t0.Add(time.Minute),
+			want:  []string{`{endpoint="/a", job="batch"} 4`},
+		},
+		{
+			name:  "increase between pushes",
+			query: `max_over_time(requests_total{endpoint="/a",job="batch"}[2m]) - min_over_time(requests_total{endpoint="/a",job="batch"}[2m])`,
+			at:    t0.Add(time.Minute),
+			want:  []string{`{endpoint="/a", job="batch"} 60`},
+		},
+		{
+			name:  "grouping labels take precedence",
+			query: `{__name__="requests_total", job="other"}`,
+			at:    t0.Add(time.Minute),
+			want:  []string{`{__name__="requests_total", endpoint="/a", instance="x", job="other"} 2`},
+		},
+		{
+			name:  "deleted groups are gone",
+			query: `{__name__="requests_total", job="other"}`,
+			at:    t0.Add(2 * time.Minute),
+		},
+		{
+			name:  "push time of the group",
+			query: `{__name__="push_time_seconds", job="batch"}`,
+			at:    t0.Add(time.Minute),
+			want:  []string{`{__name__="push_time_seconds", job="batch"} 1700000160`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := queryAt(t, store, tt.query, tt.at)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStorePrunesEndedSeries(t *testing.T) {
+	store := newMetricStore()
+	job := model.LabelSet{model.JobLabel: "run-1"}
+	store.Replace(job, parseFamilies(t, "# TYPE up gauge\nup 1\n"), t0)
+	store.Delete(job, t0.Add(time.Minute))
+	store.Replace(model.LabelSet{model.JobLabel: "run-2"}, parseFamilies(t, "# TYPE up gauge\nup 1\n"), t0.Add(2*queryRetention))
+
+	for _, h := range store.series {
+		if h.labels.Get(model.JobLabel) == "run-1" {
+			t.Errorf("series %s of a deleted group outlived the retention", h.labels)
+		}
+	}
+}
+
+func TestHandleQuery(t *testing.T) {
+	store := newMetricStore()
+	store.Replace(model.LabelSet{model.JobLabel: "batch"}, parseFamilies(t, "# TYPE up gauge\nup 1\n"), t0)
+	handler := handleQuery(newQueryEngine(), store)
+
+	tests := []struct {
+		name       string
+		params     url.Values
+		wantStatus int
+		wantType   string
+		wantResult string
+	}{
+		{
+			name:       "vector at time",
+			params:     url.Values{"query": {"up"}, "time": {"1700000160"}},
+			wantStatus: http.StatusOK,
+			wantResult: `{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"batch"},"value":[1700000160,"1"]}]}`,
+		},
+		{
+			name:       "before the push",
+			params:     url.Values{"query": {"up"}, "time": {"2023-11-14T22:10:00Z"}},
+			wantStatus: http.StatusOK,
+			wantResult: `{"resultType":"vector","result":[]}`,
+		},
+		{
+			name:       "scalar",
+			params:     url.Values{"query": {"1 + 1"}, "time": {"1700000160"}},
+			wantStatus: http.StatusOK,
+			wantResult: `{"resultType":"scalar","result":[1700000160,"2"]}`,
+		},
+		{
+			name:       "missing query",
+			params:     url.Values{},
+			wantStatus: http.StatusBadRequest,
+			wantType:   "bad_data",
+		},
+		{
+			name:       "parse error",
+			params:     url.Values{"query": {"sum("}},
+			wantStatus: http.StatusBadRequest,
+			wantType:   "bad_data",
+		},
+		{
+			name:       "bad time",
+			params:     url.Values{"query": {"up"}, "time": {"yesterday"}},
+			wantStatus: http.StatusBadRequest,
+			wantType:   "bad_data",
+		},
+		{
+			name:       "execution error",
+			params:     url.Values{"query": {`label_replace(up, "x", "$1", "job", "(")`}},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantType:   "execution",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+tt.params.Encode(), nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var resp struct {
+				ErrorType string          `json:"errorType"`
+				Data      json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ErrorType != tt.wantType {
+				t.Errorf("error type %q, want %q", resp.ErrorType, tt.wantType)
+			}
+			if tt.wantResult != "" && string(resp.Data) != tt.wantResult {
+				t.Errorf("data %s, want %s", resp.Data, tt.wantResult)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// HistogramLayout is the canonical bucket layout for a classic histogram.
+type HistogramLayout struct {
+	Metric string `yaml:"metric"`
+	// Buckets are the finite upper bounds; +Inf is implied.
+	Buckets []float64 `yaml:"buckets"`
+	// Mode is "rebucket" (default) to convert other layouts, or "reject" to
+	// refuse pushes that do not use exactly these buckets.
+	Mode string `yaml:"mode"`
+}
+
+// HistogramAction reports what was done to a histogram with a non-canonical
+// layout.
+type HistogramAction struct {
+	Metric string `json:"metric"`
+	// Action is "rebucketed", "rejected", or "flagged" for clients a canary
+	// rollout does not enforce the layout for.
+	Action string `json:"action"`
+	// Interpolated is set when some canonical bounds were not present in
+	// the pushed layout and their counts had to be estimated.
+	Interpolated bool      `json:"interpolated,omitempty"`
+	From         []float64 `json:"from"`
+	To           []float64 `json:"to"`
+}
+
+// histogramLayouts enforces the configured layouts by metric name.
+type histogramLayouts struct {
+	layouts map[string]HistogramLayout
+}
+
+func newHistogramLayouts(layouts []HistogramLayout) (*histogramLayouts, error) {
+	h := &histogramLayouts{layouts: map[string]HistogramLayout{}}
+	for i, l := range layouts {
+		if l.Metric == "" {
+			return nil, fmt.Errorf("histogram layout %d: metric is required", i+1)
+		}
+		if _, dup := h.layouts[l.Metric]; dup {
+			return nil, fmt.Errorf("histogram layout %d: duplicate layout for %s", i+1, l.Metric)
+		}
+		if len(l.Buckets) == 0 {
+			return nil, fmt.Errorf("histogram layout %s: no buckets", l.Metric)
+		}
+		for j, b := range l.Buckets {
+			if math.IsInf(b, 0) || math.IsNaN(b) {
+				return nil, fmt.Errorf("histogram layout %s: buckets must be finite", l.Metric)
+			}
+			if j > 0 && b <= l.Buckets[j-1] {
+				return nil, fmt.Errorf("histogram layout %s: buckets must be strictly increasing", l.Metric)
+			}
+		}
+		switch l.Mode {
+		case "":
+			l.Mode = "rebucket"
+		case "rebucket", "reject":
+		default:
+			return nil, fmt.Errorf("histogram layout %s: unknown mode %q, expected rebucket or reject", l.Metric, l.Mode)
+		}
+		h.layouts[l.Metric] = l
+	}
+	return h, nil
+}
+
+// Layouts returns the layouts sorted by metric, with their effective mode:
+// rebucket, reject, or flag when relaxed.
+func (h *histogramLayouts) Layouts() []HistogramLayout {
+	layouts := make([]HistogramLayout, 0, len(h.layouts))
+	for _, l := range h.layouts {
+		layouts = append(layouts, l)
+	}
+	sort.Slice(layouts, func(i, j int) bool { return layouts[i].Metric < layouts[j].Metric })
+	return layouts
+}
+
+// Relaxed returns layouts that only flag non-canonical histograms, used for
+// clients a canary rollout does not enforce them for.
+func (h *histogramLayouts) Relaxed() *histogramLayouts {
+	relaxed := &histogramLayouts{layouts: make(map[string]HistogramLayout, len(h.layouts))}
+	for name, l := range h.layouts {
+		l.Mode = "flag"
+		relaxed.layouts[name] = l
+	}
+	return relaxed
+}
+
+// Apply converts or rejects histograms whose buckets differ from their
+// canonical layout. It returns one action per affected family, and an error
+// if any family was rejected; families are left untouched in that case.
+func (h *histogramLayouts) Apply(families []*dto.MetricFamily) ([]HistogramAction, error) {
+	var actions []HistogramAction
+	var rejected []string
+	for _, mf := range families {
+		layout, ok := h.layouts[mf.GetName()]
+		if !ok || mf.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		var action *HistogramAction
+		for _, m := range mf.GetMetric() {
+			bounds := finiteBounds(m.GetHistogram())
+			if len(m.GetHistogram().GetBucket()) == 0 || equalFloats(bounds, layout.Buckets) {
+				// Native histograms without classic buckets are left alone.
+				continue
+			}
+			if action == nil {
+				action = &HistogramAction{Metric: mf.GetName(), Action: "rebucketed", From: bounds, To: layout.Buckets}
+			}
+			if layout.Mode == "reject" {
+				action.Action = "rejected"
+				break
+			}
+			if layout.Mode == "flag" {
+				action.Action = "flagged"
+				break
+			}
+		}
+		if action == nil {
+			continue
+		}
+		if action.Action == "rejected" {
+			rejected = append(rejected, mf.GetName())
+		}
+		actions = append(actions, *action)
+	}
+	if len(rejected) > 0 {
+		return actions, fmt.Errorf("histograms do not use the canonical bucket layout: %s", strings.Join(rejected, ", "))
+	}
+
+	for i := range actions {
+		if actions[i].Action == "flagged" {
+			continue
+		}
+		for _, mf := range families {
+			if mf.GetName() != actions[i].Metric {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				if len(m.GetHistogram().GetBucket()) == 0 {
+					continue
+				}
+				if rebucket(m.GetHistogram(), actions[i].To) {
+					actions[i].Interpolated = true
+				}
+			}
+		}
+	}
+	return actions, nil
+}
+
+func finiteBounds(h *dto.Histogram) []float64 {
+	var bounds []float64
+	for _, b := range h.GetBucket() {
+		if !math.IsInf(b.GetUpperBound(), 1) {
+			bounds = append(bounds, b.GetUpperBound())
+		}
+	}
+	sort.Float64s(bounds)
+	return bounds
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// histogramBucket is a cumulative bucket of a classic histogram.
+type histogramBucket struct {
+	UpperBound float64
+	Count      float64
+}
+
+// rebucket replaces the buckets of h with the target bounds and reports
+// whether any count was interpolated.
+//
+// A target bound present in the pushed layout keeps its exact count. Other
+// bounds get a count interpolated linearly between the surrounding pushed
+// bounds, assuming observations are spread evenly within a bucket, the same
+// assumption histogram_quantile makes. The first pushed bucket is taken to
+// start at 0 (or to be a single point if its bound is not positive).
+// Observations above the highest pushed finite bound cannot be placed, so
+// target bounds above it get the count of that bound and the rest stays in
+// the +Inf bucket. Counts are rounded to whole observations and exemplars
+// are dropped.
+func rebucket(h *dto.Histogram, target []float64) bool {
+	isFloat := false
+	var pushed []histogramBucket
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		count := float64(b.GetCumulativeCount())
+		if b.CumulativeCountFloat != nil {
+			isFloat = true
+			count = b.GetCumulativeCountFloat()
+		}
+		pushed = append(pushed, histogramBucket{UpperBound: b.GetUpperBound(), Count: count})
+	}
+	sort.Slice(pushed, func(i, j int) bool { return pushed[i].UpperBound < pushed[j].UpperBound })
+
+	total := float64(h.GetSampleCount())
+	if h.SampleCountFloat != nil {
+		total = h.GetSampleCountFloat()
+	}
+
+	interpolated := false
+	buckets := make([]*dto.Bucket, 0, len(target))
+	prev := 0.0
+	for _, bound := range target {
+		count, exact := cumulativeCountAt(bound, pushed)
+		if !exact {
+			interpolated = true
+		}
+		if !isFloat {
+			count = math.Round(count)
+		}
+		count = math.Min(math.Max(count, prev), total)
+		prev = count
+
+		b := &dto.Bucket{UpperBound: proto.Float64(bound)}
+		if isFloat {
+			b.CumulativeCountFloat = proto.Float64(count)
+		} else {
+			b.CumulativeCount = proto.Uint64(uint64(count))
+		}
+		buckets = append(buckets, b)
+	}
+	h.Bucket = buckets
+	return interpolated
+}
+
+// cumulativeCountAt estimates the number of observations <= bound from the
+// sorted finite pushed buckets, reporting whether the count is exact.
+func cumulativeCountAt(bound float64, pushed []histogramBucket) (float64, bool) {
+	i := sort.Search(len(pushed), func(i int) bool { return pushed[i].UpperBound >= bound })
+	if i < len(pushed) && pushed[i].UpperBound == bound {
+		return pushed[i].Count, true
+	}
+	if i == len(pushed) {
+		if i == 0 {
+			return 0, false
+		}
+		return pushed[i-1].Count, false
+	}
+
+	hi := pushed[i]
+	lo := histogramBucket{}
+	if i > 0 {
+		lo = pushed[i-1]
+	} else if hi.UpperBound <= 0 || bound <= 0 {
+		return 0, false
+	}
+	return lo.Count + (hi.Count-lo.Count)*(bound-lo.UpperBound)/(hi.UpperBound-lo.UpperBound), false
+}
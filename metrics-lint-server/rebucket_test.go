@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const pushedLatency = `
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="0.5"} 5
+latency_seconds_bucket{le="1"} 8
+latency_seconds_bucket{le="+Inf"} 10
+latency_seconds_sum 7.5
+latency_seconds_count 10
+`
+
+func TestRebucket(t *testing.T) {
+	tests := []struct {
+		name             string
+		target           []float64
+		want             string // le=count of each resulting bucket
+		wantInterpolated bool
+	}{
+		{name: "subset keeps exact counts", target: []float64{0.5, 1}, want: "0.5=5 1=8"},
+		{name: "interpolated between bounds", target: []float64{0.25, 0.75}, want: "0.25=3 0.75=7", wantInterpolated: true},
+		{name: "first bucket starts at zero", target: []float64{0.05}, want: "0.05=1", wantInterpolated: true},
+		{name: "non-positive bounds", target: []float64{-1, 0}, want: "-1=0 0=0", wantInterpolated: true},
+		{name: "above the highest finite bound", target: []float64{1, 2.5, 10}, want: "1=8 2.5=8 10=8", wantInterpolated: true},
+		{name: "finer layout", target: []float64{0.1, 0.3, 0.5, 1}, want: "0.1=2 0.3=4 0.5=5 1=8", wantInterpolated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := parseFamilies(t, pushedLatency)[0].GetMetric()[0].GetHistogram()
+			interpolated := rebucket(h, tt.target)
+			var got []string
+			for _, b := range h.GetBucket() {
+				got = append(got, fmt.Sprintf("%g=%d", b.GetUpperBound(), b.GetCumulativeCount()))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("buckets %s, want %s", strings.Join(got, " "), tt.want)
+			}
+			if interpolated != tt.wantInterpolated {
+				t.Errorf("interpolated = %v, want %v", interpolated, tt.wantInterpolated)
+			}
+			if h.GetSampleCount() != 10 || h.GetSampleSum() != 7.5 {
+				t.Errorf("count and sum changed to %d and %g", h.GetSampleCount(), h.GetSampleSum())
+			}
+		})
+	}
+}
+
+func TestHistogramLayoutsApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		relaxed    bool
+		buckets    []float64
+		wantAction string
+		wantErr    bool
+		wantText   string
+	}{
+		{name: "canonical layout", mode: "reject", buckets: []float64{0.1, 0.5, 1}},
+		{
+			name: "rebucketed", buckets: []float64{0.5, 1}, wantAction: "rebucketed",
+			wantText: `latency_seconds_bucket{le="0.5"} 5
+latency_seconds_bucket{le="1"} 8
+latency_seconds_bucket{le="+Inf"} 10`,
+		},
+		{name: "rejected", mode: "reject", buckets: []float64{0.5, 1}, wantAction: "rejected", wantErr: true},
+		{name: "flagged for the control cohort", mode: "reject", relaxed: true, buckets: []float64{0.5, 1}, wantAction: "flagged"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layouts, err := newHistogramLayouts([]HistogramLayout{{Metric: "latency_seconds", Buckets: tt.buckets, Mode: tt.mode}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.relaxed {
+				layouts = layouts.Relaxed()
+			}
+			families := parseFamilies(t, pushedLatency)
+			before := formatFamilies(t, families)
+			actions, err := layouts.Apply(families)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantAction == "" {
+				if len(actions) > 0 {
+					t.Fatalf("unexpected actions %+v", actions)
+				}
+				return
+			}
+			if len(actions) != 1 || actions[0].Action != tt.wantAction {
+				t.Fatalf("actions %+v, want one %s", actions, tt.wantAction)
+			}
+			after := formatFamilies(t, families)
+			if tt.wantText == "" {
+				if after != before {
+					t.Errorf("families changed to\n%s", after)
+				}
+			} else if !strings.Contains(after, tt.wantText) {
+				t.Errorf("got\n%s\nwant buckets\n%s", after, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestNewHistogramLayoutsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout HistogramLayout
+		want   string
+	}{
+		{name: "no metric", layout: HistogramLayout{Buckets: []float64{1}}, want: "metric is required"},
+		{name: "no buckets", layout: HistogramLayout{Metric: "m"}, want: "no buckets"},
+		{name: "not increasing", layout: HistogramLayout{Metric: "m", Buckets: []float64{1, 1}}, want: "strictly increasing"},
+		{name: "unknown mode", layout: HistogramLayout{Metric: "m", Buckets: []float64{1}, Mode: "drop"}, want: "unknown mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newHistogramLayouts([]HistogramLayout{tt.layout})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
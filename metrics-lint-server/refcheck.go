@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// DanglingReference is a metric or label referenced by a rule or dashboard
+// that is neither registered nor pushed by any client.
+type DanglingReference struct {
+	Source   string `json:"source"`
+	Location string `json:"location"`
+	Expr     string `json:"expr"`
+	Kind     string `json:"kind"`
+	Metric   string `json:"metric,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Text     string `json:"text"`
+}
+
+// ReferenceReport is the result of validating rule files and dashboards.
+type ReferenceReport struct {
+	Status   string              `json:"status"`
+	Message  string              `json:"message,omitempty"`
+	Checked  int                 `json:"checked"`
+	Dangling []DanglingReference `json:"dangling,omitempty"`
+}
+
+// builtinMetrics are series Prometheus generates itself, which rules may
+// reference without any client pushing them.
+var builtinMetrics = []string{
+	"up", "scrape_duration_seconds", "scrape_samples_scraped",
+	"scrape_samples_post_metric_relabeling", "scrape_series_added",
+	"ALERTS", "ALERTS_FOR_STATE", "push_time_seconds", "push_failure_time_seconds",
+}
+
+// knownMetrics indexes the series names and labels clients are known to emit.
+type knownMetrics struct {
+	// series maps exposed series names (including _bucket, _sum and _count
+	// of histograms and summaries) to the labels they may carry. A nil
+	// label set means any label is acceptable.
+	series map[string]map[string]bool
+	// groupingLabels are attached to every pushed series by the gateway.
+	groupingLabels map[string]bool
+}
+
+func newKnownMetrics(registry *Schema, observed map[string]familyObservation, groupingLabels []string) *knownMetrics {
+	k := &knownMetrics{
+		series:         map[string]map[string]bool{},
+		groupingLabels: map[string]bool{"job": true, "instance": true},
+	}
+	for _, l := range groupingLabels {
+		k.groupingLabels[l] = true
+	}
+	for _, ms := range registry.Metrics {
+		k.addFamily(ms)
+	}
+	for _, o := range observed {
+		k.addFamily(o.Schema)
+	}
+	for _, name := range builtinMetrics {
+		k.series[name] = nil
+	}
+	return k
+}
+
+func (k *knownMetrics) addFamily(ms MetricSchema) {
+	add := func(name string, extra ...string) {
+		names, ok := k.series[name]
+		if !ok {
+			names = map[string]bool{}
+			k.series[name] = names
+		}
+		for _, l := range ms.Labels {
+			names[l] = true
+		}
+		for _, l := range extra {
+			names[l] = true
+		}
+	}
+
+	// Classic histograms expose no series under the bare family name.
+	switch ms.Type {
+	case "histogram", "gauge_histogram":
+		add(ms.Name+"_bucket", model.BucketLabel)
+		add(ms.Name + "_sum")
+		add(ms.Name + "_count")
+	case "summary":
+		add(ms.Name, model.QuantileLabel)
+		add(ms.Name + "_sum")
+		add(ms.Name + "_count")
+	default:
+		add(ms.Name)
+	}
+}
+
+// addAnyLabels registers a series name that may carry arbitrary labels, such
+// as the output of a recording rule.
+func (k *knownMetrics) addAnyLabels(name string) {
+	k.series[name] = nil
+}
+
+// checkSelector returns the dangling references of a single selector.
+func (k *knownMetrics) checkSelector(vs *parser.VectorSelector) []DanglingReference {
+	var nameMatcher *labels.Matcher
+	for _, m := range vs.LabelMatchers {
+		if m.Name == model.MetricNameLabel {
+			nameMatcher = m
+		}
+	}
+	if nameMatcher == nil || nameMatcher.Type == labels.MatchNotEqual || nameMatcher.Type == labels.MatchNotRegexp {
+		return nil
+	}
+
+	if nameMatcher.Type == labels.MatchRegexp {
+		for name := range k.series {
+			if nameMatcher.Matches(name) {
+				return nil
+			}
+		}
+		return []DanglingReference{{
+			Kind:   "unknown_metric",
+			Metric: nameMatcher.Value,
+			Text:   fmt.Sprintf("no known metric matches %s", nameMatcher),
+		}}
+	}
+
+	known, ok := k.series[nameMatcher.Value]
+	if !ok {
+		return []DanglingReference{{
+			Kind:   "unknown_metric",
+			Metric: nameMatcher.Value,
+			Text:   fmt.Sprintf("metric %q is not registered and has not been pushed", nameMatcher.Value),
+		}}
+	}
+	if known == nil {
+		return nil
+	}
+
+	var dangling []DanglingReference
+	for _, m := range vs.LabelMatchers {
+		// Matchers that accept the empty string also select series without the label.
+		if m == nameMatcher || known[m.Name] || k.groupingLabels[m.Name] || m.Matches("") {
+			continue
+		}
+		dangling = append(dangling, DanglingReference{
+			Kind:   "unknown_label",
+			Metric: nameMatcher.Value,
+			Label:  m.Name,
+			Text:   fmt.Sprintf("metric %q has no label %q", nameMatcher.Value, m.Name),
+		})
+	}
+	return dangling
+}
+
+// referencedExpr is a PromQL expression found in a rule file or dashboard.
+type referencedExpr struct {
+	Location string
+	Expr     string
+	Record   string
+}
+
+type ruleFile struct {
+	Groups []struct {
+		Name  string `yaml:"name"`
+		Rules []struct {
+			Record string `yaml:"record"`
+			Alert  string `yaml:"alert"`
+			Expr   string `yaml:"expr"`
+		} `yaml:"rules"`
+	} `yaml:"groups"`
+}
+
+// grafanaPanel covers the parts of Grafana dashboard panels holding queries.
+type grafanaPanel struct {
+	Title   string `json:"title"`
+	Targets []struct {
+		Expr  string `json:"expr"`
+		RefID string `json:"refId"`
+	} `json:"targets"`
+	Panels []grafanaPanel `json:"panels"`
+}
+
+type grafanaDashboard struct {
+	Title  string         `json:"title"`
+	Panels []grafanaPanel `json:"panels"`
+	Rows   []struct {
+		Panels []grafanaPanel `json:"panels"`
+	} `json:"rows"`
+	Templating struct {
+		List []struct {
+			Name  string          `json:"name"`
+			Type  string          `json:"type"`
+			Query json.RawMessage `json:"query"`
+		} `json:"list"`
+	} `json:"templating"`
+}
+
+// extractExprs finds all PromQL expressions in a Prometheus rule file or a
+// Grafana dashboard (optionally wrapped in {"dashboard": ...}).
+func extractExprs(data []byte) ([]referencedExpr, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var wrapper struct {
+			Dashboard *grafanaDashboard `json:"dashboard"`
+		}
+		if err := json.Unmarshal(trimmed, &wrapper); err != nil {
+			return nil, fmt.Errorf("invalid dashboard JSON: %v", err)
+		}
+		d := wrapper.Dashboard
+		if d == nil {
+			d = &grafanaDashboard{}
+			if err := json.Unmarshal(trimmed, d); err != nil {
+				return nil, fmt.Errorf("invalid dashboard JSON: %v", err)
+			}
+		}
+		return dashboardExprs(d), nil
+	}
+
+	var rf ruleFile
+	if err := yaml.Unmarshal(trimmed, &rf); err != nil {
+		return nil, fmt.Errorf("invalid rule file: %v", err)
+	}
+	var exprs []referencedExpr
+	for _, g := range rf.Groups {
+		for i, r := range g.Rules {
+			name := fmt.Sprintf("rule %d", i+1)
+			switch {
+			case r.Alert != "":
+				name = "alert " + r.Alert
+			case r.Record != "":
+				name = "record " + r.Record
+			}
+			exprs = append(exprs, referencedExpr{
+				Location: fmt.Sprintf("group %q, %s", g.Name, name),
+				Expr:     r.Expr,
+				Record:   r.Record,
+			})
+		}
+	}
+	return exprs, nil
+}
+
+func dashboardExprs(d *grafanaDashboard) []referencedExpr {
+	var exprs []referencedExpr
+	var walk func(panels []grafanaPanel)
+	walk = func(panels []grafanaPanel) {
+		for _, p := range panels {
+			for _, t := range p.Targets {
+				if t.Expr != "" {
+					exprs = append(exprs, referencedExpr{
+						Location: fmt.Sprintf("panel %q, query %s", p.Title, t.RefID),
+						Expr:     t.Expr,
+					})
+				}
+			}
+			walk(p.Panels)
+		}
+	}
+	walk(d.Panels)
+	for _, row := range d.Rows {
+		walk(row.Panels)
+	}
+
+	for _, v := range d.Templating.List {
+		if v.Type != "query" {
+			continue
+		}
+		var query string
+		if json.Unmarshal(v.Query, &query) != nil {
+			var obj struct {
+				Query string `json:"query"`
+			}
+			json.Unmarshal(v.Query, &obj)
+			query = obj.Query
+		}
+		if expr := grafanaVariableQueryExpr(query); expr != "" {
+			exprs = append(exprs, referencedExpr{Location: fmt.Sprintf("variable %q", v.Name), Expr: expr})
+		}
+	}
+	return exprs
+}
+
+var (
+	labelValuesRE = regexp.MustCompile(`^\s*label_values\(\s*(.+?)\s*,\s*[a-zA-Z_][a-zA-Z0-9_]*\s*\)\s*$`)
+	queryResultRE = regexp.MustCompile(`^\s*query_result\((.+)\)\s*$`)
+)
+
+// grafanaVariableQueryExpr extracts the PromQL part of a Grafana variable
+// query such as label_values(metric{job="x"}, label) or query_result(expr).
+func grafanaVariableQueryExpr(query string) string {
+	if m := labelValuesRE.FindStringSubmatch(query); m != nil {
+		return m[1]
+	}
+	if m := queryResultRE.FindStringSubmatch(query); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+var grafanaVariableRE = regexp.MustCompile(`\$\{[^}]+\}|\$[a-zA-Z_][a-zA-Z0-9_]*|\[\[[a-zA-Z0-9_:]+\]\]`)
+
+// expandGrafanaVariables replaces dashboard variables with placeholders so
+// the expression parses: durations inside range brackets, a dummy value
+// inside quoted strings and a number elsewhere.
+func expandGrafanaVariables(expr string) string {
+	var b strings.Builder
+	var quote byte
+	bracket := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(expr) {
+				b.WriteByte(c)
+				i++
+				b.WriteByte(expr[i])
+				continue
+			}
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '[' && !strings.HasPrefix(expr[i:], "[["):
+			bracket = true
+		case c == ']':
+			bracket = false
+		}
+
+		if loc := grafanaVariableRE.FindStringIndex(expr[i:]); loc != nil && loc[0] == 0 {
+			switch {
+			case quote != 0:
+				b.WriteString("grafana_variable")
+			case bracket:
+				b.WriteString("5m")
+			default:
+				b.WriteString("1")
+			}
+			i += loc[1] - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// validateReferences checks all expressions of the given sources against
+// the known metrics. Recording rules defined in any source count as known.
+func validateReferences(sources map[string][]referencedExpr, known *knownMetrics) *ReferenceReport {
+	report := &ReferenceReport{}
+	for _, exprs := range sources {
+		for _, e := range exprs {
+			if e.Record != "" {
+				known.addAnyLabels(e.Record)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, source := range names {
+		for _, e := range sources[source] {
+			report.Checked++
+			expr, err := parser.ParseExpr(expandGrafanaVariables(e.Expr))
+			if err != nil {
+				report.Dangling = append(report.Dangling, DanglingReference{
+					Source: source, Location: e.Location, Expr: e.Expr,
+					Kind: "parse_error", Text: err.Error(),
+				})
+				continue
+			}
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					for _, d := range known.checkSelector(vs) {
+						d.Source, d.Location, d.Expr = source, e.Location, e.Expr
+						report.Dangling = append(report.Dangling, d)
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	if len(report.Dangling) > 0 {
+		report.Status = "error"
+		report.Message = fmt.Sprintf("Found %d dangling references in %d expressions", len(report.Dangling), report.Checked)
+	} else {
+		report.Status = "success"
+		report.Message = fmt.Sprintf("All %d expressions reference known metrics.", report.Checked)
+	}
+	return report
+}
+
+// handleValidate checks a rule file or dashboard posted in the request body
+// against registered schemas and observed pushes.
+func handleValidate(store *metricStore, registry *Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed. Use POST or PUT.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		exprs, err := extractExprs(body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ReferenceReport{Status: "error", Message: err.Error()})
+			return
+		}
+
+		known := newKnownMetrics(registry, store.Observations(), store.GroupingLabelNames())
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "request"
+		}
+		writeJSON(w, http.StatusOK, validateReferences(map[string][]referencedExpr{name: exprs}, known))
+	}
+}
+
+// runValidate implements the "validate" subcommand for rule files and
+// dashboards. It exits non-zero when dangling references are found.
+func runValidate(cfg *Config, args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	metricsFiles := fs.String("metrics", "", "Comma-separated exposition files to treat as observed traffic.")
+	output := fs.String("output", "text", "Output format: text or json.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: metriclint_server [-config file] validate [flags] <rule or dashboard files...>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	registry, err := loadSchemas(cfg.Schemas)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var paths []string
+	if *metricsFiles != "" {
+		paths = strings.Split(*metricsFiles, ",")
+	}
+	store, err := storeFromFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	sources := map[string][]referencedExpr{}
+	for _, path := range fs.Args() {
+		data, err := readInput(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if sources[path], err = extractExprs(data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+	}
+
+	report := validateReferences(sources, newKnownMetrics(registry, store.Observations(), store.GroupingLabelNames()))
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, d := range report.Dangling {
+			fmt.Printf("%s: %s: %s\n    %s\n", d.Source, d.Location, d.Text, strings.TrimSpace(d.Expr))
+		}
+		fmt.Println(report.Message)
+	}
+
+	if len(report.Dangling) > 0 {
+		return 1
+	}
+	return 0
+}
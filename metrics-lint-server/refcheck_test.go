@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateReferences(t *testing.T) {
+	registry := &Schema{Metrics: []MetricSchema{
+		{Name: "request_duration_seconds", Type: "histogram", Labels: []string{"method"}},
+		{Name: "rpc_latency_seconds", Type: "summary"},
+		{Name: "requests_total", Type: "counter", Labels: []string{"endpoint", "method"}},
+	}}
+	observed := map[string]familyObservation{
+		"queue_size": {Schema: MetricSchema{Name: "queue_size", Type: "gauge", Labels: []string{"queue"}}},
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		want []string // kind:metric:label of each dangling reference
+	}{
+		{name: "known counter", expr: `sum by (endpoint) (rate(requests_total{method="GET"}[5m]))`},
+		{name: "observed gauge", expr: `queue_size{queue="a"}`},
+		{name: "histogram series", expr: `histogram_quantile(0.9, sum by (le) (rate(request_duration_seconds_bucket[5m])))`},
+		{name: "histogram sum and count", expr: `request_duration_seconds_sum / request_duration_seconds_count`},
+		{name: "bare histogram name", expr: `request_duration_seconds`, want: []string{"unknown_metric:request_duration_seconds:"}},
+		{name: "summary quantiles", expr: `rpc_latency_seconds{quantile="0.99"}`},
+		{name: "unknown metric", expr: `sum(missing_total)`, want: []string{"unknown_metric:missing_total:"}},
+		{name: "unknown label", expr: `requests_total{status="500"}`, want: []string{"unknown_label:requests_total:status"}},
+		{name: "matcher accepting empty", expr: `requests_total{status=""}`},
+		{name: "grouping labels", expr: `requests_total{job="batch",instance="a"}`},
+		{name: "name regex", expr: `{__name__=~"requests_.*"}`},
+		{name: "unmatched name regex", expr: `{__name__=~"nothing_.*"}`, want: []string{"unknown_metric:nothing_.*:"}},
+		{name: "negative name matcher", expr: `{__name__!="x",job="batch"}`},
+		{name: "builtin metric", expr: `time() - push_time_seconds > 3600`},
+		{name: "recording rule output", expr: `job:requests:rate5m{anything="x"}`},
+		{name: "every selector is checked", expr: `requests_total / on() group_left missing_total offset 5m`, want: []string{"unknown_metric:missing_total:"}},
+		{name: "subqueries", expr: `max_over_time(rate(missing_total[1m])[10m:1m])`, want: []string{"unknown_metric:missing_total:"}},
+		{name: "grafana variables", expr: `rate(requests_total{method="$method"}[$__rate_interval]) * $scale`},
+		{name: "parse error", expr: `sum(requests_total`, want: []string{"parse_error::"}},
+		{name: "not PromQL", expr: `requests_total[5m] offset`, want: []string{"parse_error::"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := map[string][]referencedExpr{
+				"rules.yml": {
+					{Location: "record", Expr: `sum(rate(requests_total[5m])) by (job)`, Record: "job:requests:rate5m"},
+					{Location: "test", Expr: tt.expr},
+				},
+			}
+			report := validateReferences(sources, newKnownMetrics(registry, observed, nil))
+			var got []string
+			for _, d := range report.Dangling {
+				got = append(got, d.Kind+":"+d.Metric+":"+d.Label)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("dangling %v, want %v", got, tt.want)
+			}
+			if report.Checked != 2 {
+				t.Errorf("checked %d expressions, want 2", report.Checked)
+			}
+		})
+	}
+}
+
+func TestExtractExprs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name: "rule file",
+			input: `
+groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum(up) by (job)
+      - alert: Down
+        expr: up == 0
+`,
+			want: []string{`group "g", record job:up:sum|sum(up) by (job)`, `group "g", alert Down|up == 0`},
+		},
+		{
+			name: "dashboard",
+			input: `{"dashboard": {"panels": [
+  {"title": "A", "targets": [{"expr": "up", "refId": "A"}]},
+  {"title": "Row", "panels": [{"title": "B", "targets": [{"expr": "queue_size", "refId": "B"}]}]}
+], "templating": {"list": [
+  {"name": "job", "type": "query", "query": "label_values(up{env=\"prod\"}, job)"},
+  {"name": "q", "type": "query", "query": {"query": "query_result(topk(5, queue_size))"}},
+  {"name": "c", "type": "custom", "query": "a,b"}
+]}}}`,
+			want: []string{
+				`panel "A", query A|up`,
+				`panel "B", query B|queue_size`,
+				`variable "job"|up{env="prod"}`,
+				`variable "q"|topk(5, queue_size)`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exprs, err := extractExprs([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range exprs {
+				got = append(got, e.Location+"|"+e.Expr)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
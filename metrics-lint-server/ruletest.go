@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// RuleTestFile is a file of policy unit tests, run with the test rules
+// subcommand.
+type RuleTestFile struct {
+	// Config is the config file the tests run against, relative to the
+	// test file. Defaults to the file given with -config.
+	Config string     `yaml:"config"`
+	Tests  []RuleTest `yaml:"tests"`
+}
+
+// RuleTest pushes one exposition through the configured policies and
+// compares the problems found with the expected ones.
+type RuleTest struct {
+	Name string `yaml:"name"`
+	// Config overrides the file's config for this test.
+	Config string `yaml:"config"`
+	// GroupingKey is the grouping key pushed to. The job defaults to
+	// "test".
+	GroupingKey map[string]string `yaml:"grouping_key"`
+	// Format is text (default) or openmetrics.
+	Format           string        `yaml:"format"`
+	Input            string        `yaml:"input"`
+	ExpectedProblems []TestProblem `yaml:"expected_problems"`
+}
+
+// TestProblem is a problem expected or found by a rule test. Lint problems
+// are warnings; a rejected push is a single error with the rejecting rule
+// as its code.
+type TestProblem struct {
+	Code     string `yaml:"code" json:"code"`
+	Metric   string `yaml:"metric" json:"metric,omitempty"`
+	Severity string `yaml:"severity" json:"severity"`
+	Text     string `yaml:"-" json:"text,omitempty"`
+}
+
+func (p TestProblem) key() string {
+	return p.Severity + "\xff" + p.Code + "\xff" + p.Metric
+}
+
+func (p TestProblem) String() string {
+	s := p.Severity + " " + p.Code
+	if p.Metric != "" {
+		s += " " + p.Metric
+	}
+	if p.Text != "" {
+		s += ": " + p.Text
+	}
+	return s
+}
+
+// RuleTestResult is the outcome of one rule test.
+type RuleTestResult struct {
+	File       string        `json:"file"`
+	Name       string        `json:"name"`
+	Passed     bool          `json:"passed"`
+	Missing    []TestProblem `json:"missing,omitempty"`
+	Unexpected []TestProblem `json:"unexpected,omitempty"`
+}
+
+// RuleTestReport summarizes a run of rule tests.
+type RuleTestReport struct {
+	Status  string           `json:"status"`
+	Message string           `json:"message"`
+	Tests   []RuleTestResult `json:"tests"`
+}
+
+// loadRuleTests reads a test file and the configs its tests run against.
+// Tests without a config use cfg.
+func loadRuleTests(path string, cfg *Config) (*RuleTestFile, []*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := &RuleTestFile{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	loaded := map[string]*Config{}
+	load := func(name string) (*Config, error) {
+		if name == "" {
+			return cfg, nil
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		if c, ok := loaded[name]; ok {
+			return c, nil
+		}
+		c, err := loadConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		loaded[name] = c
+		return c, nil
+	}
+
+	fileCfg, err := load(file.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	configs := make([]*Config, len(file.Tests))
+	for i, t := range file.Tests {
+		configs[i] = fileCfg
+		if t.Config != "" {
+			if configs[i], err = load(t.Config); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return file, configs, nil
+}
+
+// runRuleTest pushes the test input through a proxy built from cfg.
+func runRuleTest(cfg *Config, t RuleTest) (RuleTestResult, error) {
+	result := RuleTestResult{Name: t.Name}
+
+	labels := model.LabelSet{model.JobLabel: "test"}
+	for name, value := range t.GroupingKey {
+		labels[model.LabelName(name)] = model.LabelValue(value)
+	}
+	push := recordedPush{
+		Method: http.MethodPut,
+		Path:   "/metrics" + groupingKeyPath(labels),
+		Body:   []byte(t.Input),
+	}
+	switch t.Format {
+	case "", "text":
+		push.ContentType = string(expfmt.NewFormat(expfmt.TypeTextPlain))
+	case "openmetrics":
+		push.ContentType = string(expfmt.NewFormat(expfmt.TypeOpenMetrics))
+	default:
+		return result, fmt.Errorf("unknown format %q, expected text or openmetrics", t.Format)
+	}
+
+	proxy, cleanup, err := newReplayProxy(cfg)
+	if err != nil {
+		return result, err
+	}
+	defer cleanup()
+
+	var found []TestProblem
+	code, resp := replayPush(proxy, push)
+	if code >= 400 {
+		found = append(found, TestProblem{Code: resp.Rule, Severity: "error", Text: resp.ErrorText})
+	}
+	for _, p := range resp.Problems {
+		found = append(found, TestProblem{Code: p.Code, Metric: p.Metric, Severity: "warning", Text: p.Text})
+	}
+
+	want := make([]TestProblem, len(t.ExpectedProblems))
+	expected := map[string]int{}
+	for i, p := range t.ExpectedProblems {
+		if p.Severity == "" {
+			p.Severity = "warning"
+		}
+		want[i] = p
+		expected[p.key()]++
+	}
+	for _, p := range found {
+		if expected[p.key()] > 0 {
+			expected[p.key()]--
+			continue
+		}
+		result.Unexpected = append(result.Unexpected, p)
+	}
+	for _, p := range want {
+		if expected[p.key()] > 0 {
+			expected[p.key()]--
+			result.Missing = append(result.Missing, p)
+		}
+	}
+	result.Passed = len(result.Missing) == 0 && len(result.Unexpected) == 0
+	return result, nil
+}
+
+// runTest dispatches the test subcommands.
+func runTest(cfg *Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: metriclint_server test rules <test file>...")
+		return 2
+	}
+	switch args[0] {
+	case "rules":
+		return runTestRules(cfg, args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown test %q\n", args[0])
+	return 2
+}
+
+// runTestRules runs policy unit tests and exits non-zero when a test fails.
+func runTestRules(cfg *Config, args []string) int {
+	fs := flag.NewFlagSet("test rules", flag.ExitOnError)
+	output := fs.String("output", "text", "Output format: text or json.")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: metriclint_server [-config file] test rules [flags] <test file>...")
+		return 2
+	}
+
+	report := RuleTestReport{Status: "success", Tests: []RuleTestResult{}}
+	failed := 0
+	for _, path := range fs.Args() {
+		file, configs, err := loadRuleTests(path, cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		for i, t := range file.Tests {
+			result, err := runRuleTest(configs[i], t)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: test %q: %v\n", path, t.Name, err)
+				return 2
+			}
+			result.File = path
+			if result.Name == "" {
+				result.Name = fmt.Sprintf("test %d", i+1)
+			}
+			if !result.Passed {
+				failed++
+			}
+			report.Tests = append(report.Tests, result)
+		}
+	}
+
+	report.Message = fmt.Sprintf("All %d tests passed.", len(report.Tests))
+	if failed > 0 {
+		report.Status = "error"
+		report.Message = fmt.Sprintf("%d of %d tests failed", failed, len(report.Tests))
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, r := range report.Tests {
+			if r.Passed {
+				continue
+			}
+			fmt.Printf("FAILED %s: %s\n", r.File, r.Name)
+			for _, p := range r.Missing {
+				fmt.Printf("    missing:    %s\n", p)
+			}
+			for _, p := range r.Unexpected {
+				fmt.Printf("    unexpected: %s\n", p)
+			}
+		}
+		fmt.Println(report.Message)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
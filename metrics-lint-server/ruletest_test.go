@@ -0,0 +1,237 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// problemKeys renders problems as "severity code metric" lines.
+func problemKeys(problems []TestProblem) []string {
+	var out []string
+	for _, p := range problems {
+		out = append(out, strings.TrimSpace(p.Severity+" "+p.Code+" "+p.Metric))
+	}
+	return out
+}
+
+func TestRunRuleTest(t *testing.T) {
+	strict := &Config{Config: lint.Config{UntypedMetrics: "reject"}}
+	tests := []struct {
+		name           string
+		cfg            *Config
+		test           RuleTest
+		wantMissing    []string
+		wantUnexpected []string
+	}{
+		{
+			name: "expected problem",
+			cfg:  &Config{},
+			test: RuleTest{
+				Input:            "# TYPE jobs_total counter\njobs_total 3\n",
+				ExpectedProblems: []TestProblem{{Code: "help", Metric: "jobs_total"}},
+			},
+		},
+		{
+			name: "missing problem",
+			cfg:  &Config{},
+			test: RuleTest{
+				Input: "# HELP jobs_total Jobs.\n# TYPE jobs_total counter\njobs_total 3\n",
+				ExpectedProblems: []TestProblem{
+					{Code: "help", Metric: "jobs_total"},
+					{Code: "help", Metric: "other"},
+				},
+			},
+			wantMissing: []string{"warning help jobs_total", "warning help other"},
+		},
+		{
+			name: "unexpected problem",
+			cfg:  &Config{},
+			test: RuleTest{
+				Input: "# TYPE jobs_total counter\njobs_total 3\n",
+			},
+			wantUnexpected: []string{"warning help jobs_total"},
+		},
+		{
+			name: "severity must match",
+			cfg:  &Config{},
+			test: RuleTest{
+				Input:            "# TYPE jobs_total counter\njobs_total 3\n",
+				ExpectedProblems: []TestProblem{{Code: "help", Metric: "jobs_total", Severity: "error"}},
+			},
+			wantMissing:    []string{"error help jobs_total"},
+			wantUnexpected: []string{"warning help jobs_total"},
+		},
+		{
+			name: "duplicate expectations are counted",
+			cfg:  &Config{},
+			test: RuleTest{
+				Input: "# TYPE jobs_total counter\njobs_total 3\n",
+				ExpectedProblems: []TestProblem{
+					{Code: "help", Metric: "jobs_total"},
+					{Code: "help", Metric: "jobs_total"},
+				},
+			},
+			wantMissing: []string{"warning help jobs_total"},
+		},
+		{
+			name: "rejected push",
+			cfg:  strict,
+			test: RuleTest{
+				Input:            "foo 1\n",
+				ExpectedProblems: []TestProblem{{Code: lint.RuleUntypedMetrics, Severity: "error"}},
+			},
+		},
+		{
+			name: "rejected push without expectation",
+			cfg:  strict,
+			test: RuleTest{
+				Input: "foo 1\n",
+			},
+			wantUnexpected: []string{"error untyped_metrics"},
+		},
+		{
+			name: "grouping key",
+			cfg:  &Config{},
+			test: RuleTest{
+				GroupingKey:      map[string]string{"job": "batch", "instance": "a"},
+				Input:            "# HELP up Up.\n# TYPE up gauge\nup{instance=\"b\"} 1\n",
+				ExpectedProblems: []TestProblem{{Code: lint.RuleGroupingKeyConflict, Metric: "up"}},
+			},
+		},
+		{
+			name: "openmetrics",
+			cfg:  &Config{},
+			test: RuleTest{
+				Format: "openmetrics",
+				Input:  "# TYPE jobs counter\n# HELP jobs Jobs.\njobs_total 3\njobs_created 1.7e9\n# EOF\n",
+			},
+		},
+		{
+			name: "openmetrics input read as text",
+			cfg:  &Config{},
+			test: RuleTest{
+				Input: "# TYPE jobs counter\n# HELP jobs Jobs.\njobs_total 3\njobs_created 1.7e9\n# EOF\n",
+			},
+			// The text parser sees untyped jobs_total and jobs_created.
+			wantUnexpected: []string{
+				"warning untyped_metrics jobs_created",
+				"warning help jobs_created",
+				"warning untyped_metrics jobs_total",
+				"warning help jobs_total",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := runRuleTest(tt.cfg, tt.test)
+			if err != nil {
+				t.Fatal(err)
+			}
+			missing, unexpected := problemKeys(result.Missing), problemKeys(result.Unexpected)
+			if strings.Join(missing, "\n") != strings.Join(tt.wantMissing, "\n") {
+				t.Errorf("missing %q, want %q", missing, tt.wantMissing)
+			}
+			if strings.Join(unexpected, "\n") != strings.Join(tt.wantUnexpected, "\n") {
+				t.Errorf("unexpected %q, want %q", unexpected, tt.wantUnexpected)
+			}
+			if want := len(tt.wantMissing) == 0 && len(tt.wantUnexpected) == 0; result.Passed != want {
+				t.Errorf("passed %v, want %v", result.Passed, want)
+			}
+		})
+	}
+}
+
+func TestRunRuleTestUnknownFormat(t *testing.T) {
+	_, err := runRuleTest(&Config{}, RuleTest{Format: "protobuf", Input: "up 1\n"})
+	if err == nil || !strings.Contains(err.Error(), `unknown format "protobuf"`) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestLoadRuleTests(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("metriclint.yml", "untyped_metrics: warn\n")
+	write("tests/strict.yml", "untyped_metrics: reject\n")
+	withConfig := write("tests/with_config.yml", `
+config: ../metriclint.yml
+tests:
+  - name: file config
+    input: "foo 1\n"
+  - name: test config
+    config: strict.yml
+    input: "foo 1\n"
+`)
+	withoutConfig := write("tests/without_config.yml", `
+tests:
+  - name: default config
+    input: "foo 1\n"
+  - name: test config
+    config: strict.yml
+    input: "foo 1\n"
+`)
+	cfg := &Config{Config: lint.Config{UntypedMetrics: "allow"}}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		// Config paths are relative to the test file, and tests without
+		// a config use the file's config or else the one given.
+		{path: withConfig, want: []string{"warn", "reject"}},
+		{path: withoutConfig, want: []string{"allow", "reject"}},
+	}
+	for _, tt := range tests {
+		file, configs, err := loadRuleTests(tt.path, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(configs) != len(file.Tests) {
+			t.Fatalf("%s: %d configs for %d tests", tt.path, len(configs), len(file.Tests))
+		}
+		var got []string
+		for _, c := range configs {
+			got = append(got, c.UntypedMetrics)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: untyped_metrics %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	// Both tests of a file share the config loaded for them.
+	_, configs, err := loadRuleTests(write("tests/shared.yml", "tests: [{config: strict.yml}, {config: ./strict.yml}]\n"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configs[0] != configs[1] {
+		t.Error("strict.yml was loaded twice")
+	}
+
+	errorTests := []struct {
+		content string
+		wantErr string
+	}{
+		{content: "tests: [{config: missing.yml}]\n", wantErr: "missing.yml"},
+		{content: "config: missing.yml\n", wantErr: "missing.yml"},
+		{content: "tests: {\n", wantErr: "parsing"},
+	}
+	for _, tt := range errorTests {
+		_, _, err := loadRuleTests(write("tests/invalid.yml", tt.content), cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tt.content, err, tt.wantErr)
+		}
+	}
+}
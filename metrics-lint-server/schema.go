@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// Schema describes the metric families a client is expected to expose,
+// independent of sample values. It can be written by hand as YAML or JSON,
+// or derived from an exposition.
+type Schema struct {
+	Metrics []MetricSchema `json:"metrics" yaml:"metrics"`
+}
+
+// MetricSchema describes a single metric family.
+type MetricSchema struct {
+	Name    string    `json:"name" yaml:"name"`
+	Type    string    `json:"type" yaml:"type"`
+	Help    string    `json:"help,omitempty" yaml:"help,omitempty"`
+	Unit    string    `json:"unit,omitempty" yaml:"unit,omitempty"`
+	Labels  []string  `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Buckets []float64 `json:"buckets,omitempty" yaml:"buckets,omitempty"`
+}
+
+// knownUnits are metric name suffixes recognised as units, longest first so
+// that "milliseconds" wins over "seconds".
+var knownUnits = []string{
+	"milliseconds", "microseconds", "nanoseconds", "seconds", "minutes", "hours", "days",
+	"kilobytes", "megabytes", "gigabytes", "bytes", "bits",
+	"percent", "ratio", "celsius", "fahrenheit", "volts", "amperes", "joules",
+	"watts", "hertz", "grams", "meters",
+}
+
+// unitFromName infers the unit from the metric name suffix, ignoring the
+// "_total" suffix of counters.
+func unitFromName(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	for _, u := range knownUnits {
+		if strings.HasSuffix(name, "_"+u) {
+			return u
+		}
+	}
+	return ""
+}
+
+// Lookup returns the schema of the named family, or nil.
+func (s *Schema) Lookup(name string) *MetricSchema {
+	for i := range s.Metrics {
+		if s.Metrics[i].Name == name {
+			return &s.Metrics[i]
+		}
+	}
+	return nil
+}
+
+// normalize fills in units implied by metric names and sorts label and
+// bucket lists, so hand-written schemas compare equal to derived ones.
+func (s *Schema) normalize() *Schema {
+	for i := range s.Metrics {
+		ms := &s.Metrics[i]
+		if ms.Unit == "" {
+			ms.Unit = unitFromName(ms.Name)
+		}
+		sort.Strings(ms.Labels)
+		sort.Float64s(ms.Buckets)
+	}
+	return s
+}
+
+// schemaFromFamilies derives a schema from parsed metric families.
+func schemaFromFamilies(families []*dto.MetricFamily) *Schema {
+	s := &Schema{}
+	for _, mf := range families {
+		s.Metrics = append(s.Metrics, metricSchemaFromFamily(mf))
+	}
+	sort.Slice(s.Metrics, func(i, j int) bool { return s.Metrics[i].Name < s.Metrics[j].Name })
+	return s
+}
+
+func metricSchemaFromFamily(mf *dto.MetricFamily) MetricSchema {
+	ms := MetricSchema{
+		Name: mf.GetName(),
+		Type: strings.ToLower(mf.GetType().String()),
+		Help: mf.GetHelp(),
+		Unit: mf.GetUnit(),
+	}
+	if ms.Unit == "" {
+		ms.Unit = unitFromName(ms.Name)
+	}
+
+	labels := map[string]bool{}
+	buckets := map[float64]bool{}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = true
+		}
+		for _, b := range m.GetHistogram().GetBucket() {
+			if !math.IsInf(b.GetUpperBound(), 1) {
+				buckets[b.GetUpperBound()] = true
+			}
+		}
+	}
+	for l := range labels {
+		ms.Labels = append(ms.Labels, l)
+	}
+	sort.Strings(ms.Labels)
+	for b := range buckets {
+		ms.Buckets = append(ms.Buckets, b)
+	}
+	sort.Float64s(ms.Buckets)
+	return ms
+}
+
+// parseSchema reads either a YAML/JSON schema document or a text exposition
+// and returns the schema it describes.
+func parseSchema(data []byte) (*Schema, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("empty input")
+	}
+
+	if trimmed[0] == '{' {
+		s := &Schema{}
+		if err := json.Unmarshal(trimmed, s); err != nil {
+			return nil, fmt.Errorf("invalid JSON schema: %v", err)
+		}
+		return s.normalize(), nil
+	}
+
+	// A text exposition is not a YAML mapping, so only treat the input as a
+	// schema if it has a top-level metrics key.
+	var doc map[string]interface{}
+	if yaml.Unmarshal(trimmed, &doc) == nil && doc["metrics"] != nil {
+		s := &Schema{}
+		if err := yaml.Unmarshal(trimmed, s); err != nil {
+			return nil, fmt.Errorf("invalid YAML schema: %v", err)
+		}
+		return s.normalize(), nil
+	}
+
+	families, err := lint.DecodeFamilies(bytes.NewReader(append(trimmed, '\n')), expfmt.NewFormat(expfmt.TypeTextPlain))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %v", err)
+	}
+	return schemaFromFamilies(families), nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	commoncfg "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/discovery/file"
+	_ "github.com/prometheus/prometheus/discovery/install" // Register every service discovery config.
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"gopkg.in/yaml.v3"
+)
+
+// GatewayBackend is a Pushgateway that Prometheus scrapes pushed metrics from.
+type GatewayBackend struct {
+	// Address is the host:port (or URL) Prometheus uses to reach the gateway.
+	Address string `yaml:"address"`
+	// Auth is the authentication the gateway requires from scrapers:
+	// "none" (default), "basic", "bearer" or "tls".
+	Auth string `yaml:"auth"`
+}
+
+// The interval above which pushed series start to flap because they miss the
+// default 5m lookback window after one failed scrape, and the interval below
+// which every scrape serialises all pushed groups.
+const (
+	maxGatewayInterval = model.Duration(2 * time.Minute)
+	minGatewayInterval = model.Duration(5 * time.Second)
+)
+
+// Severities of scrape findings. Errors break pushed metrics, info findings
+// name what the check could not look at.
+const (
+	scrapeError   = "error"
+	scrapeWarning = "warning"
+	scrapeInfo    = "info"
+)
+
+// ScrapeFinding is a problem with a scrape job targeting a gateway.
+type ScrapeFinding struct {
+	Severity string `json:"severity"`
+	Job      string `json:"job,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Text     string `json:"text"`
+}
+
+// ScrapeCheckReport is the result of checking a Prometheus configuration.
+type ScrapeCheckReport struct {
+	Status   string          `json:"status"`
+	Message  string          `json:"message,omitempty"`
+	Findings []ScrapeFinding `json:"findings,omitempty"`
+}
+
+// gatewayHost normalises a gateway address or URL to host:port so it can be
+// compared with scrape targets.
+func gatewayHost(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		address = u.Host
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if host == "127.0.0.1" || host == "::1" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// loadPrometheusConfig parses a Prometheus configuration with Prometheus' own
+// loader, so defaults, validation and service discovery configs match what
+// the server sees.
+func loadPrometheusConfig(data []byte) (*config.Config, error) {
+	cfg, err := config.Load(string(data), promslog.NewNopLogger())
+	if err != nil {
+		return nil, fmt.Errorf("invalid Prometheus config: %v", err)
+	}
+	return cfg, nil
+}
+
+// scrapeTargets returns the addresses a scrape job gets from its static
+// configs and, if readFiles is set, from its file_sd files. The names of the
+// service discovery mechanisms whose targets are only known at runtime are
+// returned as dynamic.
+func scrapeTargets(sc *config.ScrapeConfig, readFiles bool) (targets, dynamic []string, err error) {
+	addTargets := func(groups []*targetgroup.Group) {
+		for _, g := range groups {
+			for _, t := range g.Targets {
+				targets = append(targets, string(t[model.AddressLabel]))
+			}
+		}
+	}
+	for _, c := range sc.ServiceDiscoveryConfigs {
+		switch c := c.(type) {
+		case discovery.StaticConfig:
+			addTargets(c)
+		case *file.SDConfig:
+			if !readFiles {
+				dynamic = append(dynamic, c.Name())
+				continue
+			}
+			for _, pattern := range c.Files {
+				paths, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, nil, fmt.Errorf("job %q: %v", sc.JobName, err)
+				}
+				for _, path := range paths {
+					groups, err := readTargetGroups(path)
+					if err != nil {
+						return nil, nil, fmt.Errorf("job %q: %v", sc.JobName, err)
+					}
+					addTargets(groups)
+				}
+			}
+		default:
+			dynamic = append(dynamic, c.Name())
+		}
+	}
+	return targets, dynamic, nil
+}
+
+// readTargetGroups reads a file_sd file, JSON or YAML by its extension like
+// Prometheus does.
+func readTargetGroups(path string) ([]*targetgroup.Group, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*targetgroup.Group
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, &groups)
+	} else {
+		err = yaml.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return groups, nil
+}
+
+// checkCredentials verifies the certificates, keys and secret files of a
+// gateway scrape job, so credentials that would fail at scrape time are
+// caught before the config is deployed.
+func checkCredentials(hc commoncfg.HTTPClientConfig, now time.Time) []string {
+	var problems []string
+	read := func(inline, file string) ([]byte, bool) {
+		if inline != "" {
+			return []byte(inline), true
+		}
+		if file == "" {
+			return nil, false
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			problems = append(problems, err.Error())
+			return nil, false
+		}
+		return data, true
+	}
+
+	t := hc.TLSConfig
+	if ca, ok := read(t.CA, t.CAFile); ok && !x509.NewCertPool().AppendCertsFromPEM(ca) {
+		problems = append(problems, fmt.Sprintf("tls_config CA %s contains no PEM certificates", t.CAFile))
+	}
+	certPEM, hasCert := read(t.Cert, t.CertFile)
+	keyPEM, hasKey := read(string(t.Key), t.KeyFile)
+	if hasCert && hasKey {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("tls_config certificate %s: %v", t.CertFile, err))
+		} else if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && now.After(leaf.NotAfter) {
+			problems = append(problems, fmt.Sprintf("tls_config certificate %s expired on %s", t.CertFile, leaf.NotAfter.Format(time.DateOnly)))
+		}
+	}
+
+	var secrets [][2]string
+	if hc.BasicAuth != nil {
+		secrets = append(secrets, [2]string{"basic_auth password_file", hc.BasicAuth.PasswordFile})
+	}
+	if hc.Authorization != nil {
+		secrets = append(secrets, [2]string{"authorization credentials_file", hc.Authorization.CredentialsFile})
+	}
+	if hc.OAuth2 != nil {
+		secrets = append(secrets, [2]string{"oauth2 client_secret_file", hc.OAuth2.ClientSecretFile})
+	}
+	for _, s := range secrets {
+		if secret, ok := read("", s[1]); ok && strings.TrimSpace(string(secret)) == "" {
+			problems = append(problems, fmt.Sprintf("%s %s is empty", s[0], s[1]))
+		}
+	}
+	return problems
+}
+
+// checkScrapeConfig flags scrape jobs pointing at known gateways that would
+// mangle pushed labels, scrape at risky intervals or lack required auth.
+// readFiles resolves file_sd targets and scrape_config_files and verifies the
+// credentials of gateway jobs. It is only set for configs read from the local
+// disk, so a POSTed config cannot make the server read its files.
+func checkScrapeConfig(cfg *config.Config, gateways []GatewayBackend, readFiles bool) (*ScrapeCheckReport, error) {
+	known := map[string]GatewayBackend{}
+	for _, g := range gateways {
+		known[gatewayHost(g.Address)] = g
+	}
+
+	report := &ScrapeCheckReport{}
+	add := func(severity string, job, target, format string, args ...interface{}) {
+		report.Findings = append(report.Findings, ScrapeFinding{
+			Severity: severity,
+			Job:      job,
+			Target:   target,
+			Text:     fmt.Sprintf(format, args...),
+		})
+	}
+
+	scrapeConfigs := cfg.ScrapeConfigs
+	if readFiles {
+		var err error
+		if scrapeConfigs, err = cfg.GetScrapeConfigs(); err != nil {
+			return nil, fmt.Errorf("invalid Prometheus config: %v", err)
+		}
+	} else if len(cfg.ScrapeConfigFiles) > 0 {
+		add(scrapeInfo, "", "", "scrape_config_files are not read; run the check scrape-config command to include them")
+	}
+
+	errors, warnings := 0, 0
+	for _, sc := range scrapeConfigs {
+		targets, dynamic, err := scrapeTargets(sc, readFiles)
+		if err != nil {
+			return nil, err
+		}
+		if len(dynamic) > 0 {
+			add(scrapeInfo, sc.JobName, "", "targets from %s_sd_configs are only known at runtime and are not checked", strings.Join(dynamic, "_sd_configs, "))
+		}
+
+		var gatewayTargets, otherTargets []string
+		var backend GatewayBackend
+		for _, t := range targets {
+			if g, ok := known[gatewayHost(t)]; ok {
+				gatewayTargets = append(gatewayTargets, t)
+				backend = g
+			} else {
+				otherTargets = append(otherTargets, t)
+			}
+		}
+		if len(gatewayTargets) == 0 {
+			continue
+		}
+		job, target := sc.JobName, strings.Join(gatewayTargets, ", ")
+		before := len(report.Findings)
+
+		if !sc.HonorLabels {
+			add(scrapeError, job, target, "honor_labels is not true: pushed job and instance labels will be renamed to exported_job and exported_instance")
+		}
+		if len(otherTargets) > 0 {
+			add(scrapeWarning, job, target, "gateway shares the scrape job with %s; give the gateway its own job so honor_labels does not apply to other targets", strings.Join(otherTargets, ", "))
+		}
+
+		// The loader has applied the global interval and rejected timeouts
+		// longer than the interval.
+		if sc.ScrapeInterval > maxGatewayInterval {
+			add(scrapeWarning, job, target, "scrape_interval %s is longer than %s: a single failed scrape makes pushed series go stale within the 5m lookback", sc.ScrapeInterval, maxGatewayInterval)
+		}
+		if sc.ScrapeInterval < minGatewayInterval {
+			add(scrapeWarning, job, target, "scrape_interval %s is shorter than %s: every scrape serialises all pushed groups", sc.ScrapeInterval, minGatewayInterval)
+		}
+		if sc.MetricsPath != "/metrics" {
+			add(scrapeWarning, job, target, "metrics_path %q differs from the gateway's /metrics", sc.MetricsPath)
+		}
+
+		// The loader has turned bearer_token and bearer_token_file into an
+		// authorization.
+		hc := sc.HTTPClientConfig
+		switch backend.Auth {
+		case "basic":
+			if hc.BasicAuth == nil {
+				add(scrapeError, job, target, "gateway requires basic auth but the job has no basic_auth")
+			}
+		case "bearer":
+			if hc.Authorization == nil && hc.OAuth2 == nil {
+				add(scrapeError, job, target, "gateway requires a bearer token but the job has no authorization")
+			}
+		case "tls":
+			if hc.TLSConfig.CertFile == "" && hc.TLSConfig.Cert == "" {
+				add(scrapeError, job, target, "gateway requires client certificates but tls_config has no cert_file")
+			}
+			if sc.Scheme != "https" {
+				add(scrapeError, job, target, "gateway requires TLS but the job scrapes with scheme %q", sc.Scheme)
+			}
+		}
+		if readFiles {
+			for _, p := range checkCredentials(hc, time.Now()) {
+				add(scrapeError, job, target, "%s", p)
+			}
+		}
+
+		for _, f := range report.Findings[before:] {
+			switch f.Severity {
+			case scrapeError:
+				errors++
+			case scrapeWarning:
+				warnings++
+			}
+		}
+	}
+
+	switch {
+	case errors > 0:
+		report.Status = "error"
+		report.Message = fmt.Sprintf("Found %d problems that break pushed metrics", errors)
+	case warnings > 0:
+		report.Status = "warning"
+		report.Message = "Gateway scrape jobs work but have risky settings"
+	default:
+		report.Status = "success"
+		report.Message = "All gateway scrape jobs are configured correctly."
+	}
+	return report, nil
+}
+
+func handleScrapeCheck(gateways []GatewayBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed. Use POST or PUT.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		cfg, err := loadPrometheusConfig(body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ScrapeCheckReport{Status: "error", Message: err.Error()})
+			return
+		}
+		report, err := checkScrapeConfig(cfg, gateways, false)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ScrapeCheckReport{Status: "error", Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// runCheck implements the "check" subcommand group.
+func runCheck(cfg *Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: metriclint_server check scrape-config <prometheus.yml> | config <config file>")
+		return 2
+	}
+	switch args[0] {
+	case "scrape-config":
+		return runCheckScrapeConfig(cfg.Gateways, args[1:])
+	case "config":
+		return runCheckConfig(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown check %q\n", args[0])
+	return 2
+}
+
+// runCheckScrapeConfig exits non-zero when a gateway scrape job would break
+// pushed metrics.
+func runCheckScrapeConfig(gateways []GatewayBackend, args []string) int {
+	fs := flag.NewFlagSet("check scrape-config", flag.ExitOnError)
+	output := fs.String("output", "text", "Output format: text or json.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: metriclint_server [-config file] check scrape-config [flags] <prometheus.yml>")
+		return 2
+	}
+
+	// LoadFile resolves relative file_sd and scrape_config_files paths
+	// against the config's directory, like Prometheus.
+	var promCfg *config.Config
+	var err error
+	if fs.Arg(0) == "-" {
+		var data []byte
+		if data, err = readInput(fs.Arg(0)); err == nil {
+			promCfg, err = loadPrometheusConfig(data)
+		}
+	} else {
+		promCfg, err = config.LoadFile(fs.Arg(0), false, promslog.NewNopLogger())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	report, err := checkScrapeConfig(promCfg, gateways, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 2
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, f := range report.Findings {
+			switch {
+			case f.Target != "":
+				fmt.Printf("%-8s job %q (%s): %s\n", strings.ToUpper(f.Severity), f.Job, f.Target, f.Text)
+			case f.Job != "":
+				fmt.Printf("%-8s job %q: %s\n", strings.ToUpper(f.Severity), f.Job, f.Text)
+			default:
+				fmt.Printf("%-8s %s\n", strings.ToUpper(f.Severity), f.Text)
+			}
+		}
+		fmt.Println(report.Message)
+	}
+
+	if report.Status == "error" {
+		return 1
+	}
+	return 0
+}
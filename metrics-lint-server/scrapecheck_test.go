@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/config"
+)
+
+// scrapeFindings renders findings as "severity job: text" lines.
+func scrapeFindings(report *ScrapeCheckReport) []string {
+	var out []string
+	for _, f := range report.Findings {
+		out = append(out, fmt.Sprintf("%s %s: %s", f.Severity, f.Job, f.Text))
+	}
+	return out
+}
+
+func TestCheckScrapeConfig(t *testing.T) {
+	gateways := []GatewayBackend{
+		{Address: "http://localhost:9091"},
+		{Address: "secure-gw:9091", Auth: "basic"},
+		{Address: "token-gw:9091", Auth: "bearer"},
+		{Address: "tls-gw:9091", Auth: "tls"},
+	}
+	tests := []struct {
+		name       string
+		config     string
+		wantStatus string
+		want       []string // substrings of the findings, in order
+	}{
+		{
+			name: "correct gateway job",
+			config: `
+scrape_configs:
+  - job_name: pushgateway
+    honor_labels: true
+    static_configs: [{targets: ['127.0.0.1:9091']}]
+  - job_name: node
+    static_configs: [{targets: ['localhost:9100']}]
+`,
+			wantStatus: "success",
+		},
+		{
+			name: "honor_labels missing",
+			config: `
+scrape_configs:
+  - job_name: pushgateway
+    static_configs: [{targets: ['localhost:9091']}]
+`,
+			wantStatus: "error",
+			want:       []string{"error pushgateway: honor_labels is not true"},
+		},
+		{
+			name: "shared job and risky settings",
+			config: `
+global:
+  scrape_interval: 5m
+scrape_configs:
+  - job_name: everything
+    honor_labels: true
+    metrics_path: /federate
+    static_configs: [{targets: ['localhost:9091', 'localhost:9100']}]
+`,
+			wantStatus: "warning",
+			want: []string{
+				"warning everything: gateway shares the scrape job with localhost:9100",
+				"warning everything: scrape_interval 5m is longer than 2m",
+				`warning everything: metrics_path "/federate" differs`,
+			},
+		},
+		{
+			name: "short interval",
+			config: `
+scrape_configs:
+  - job_name: pushgateway
+    honor_labels: true
+    scrape_interval: 1s
+    scrape_timeout: 1s
+    static_configs: [{targets: ['localhost:9091']}]
+`,
+			wantStatus: "warning",
+			want:       []string{"warning pushgateway: scrape_interval 1s is shorter than 5s"},
+		},
+		{
+			name: "missing auth",
+			config: `
+scrape_configs:
+  - job_name: secure
+    honor_labels: true
+    static_configs: [{targets: ['secure-gw:9091']}]
+  - job_name: token
+    honor_labels: true
+    static_configs: [{targets: ['token-gw:9091']}]
+  - job_name: tls
+    honor_labels: true
+    static_configs: [{targets: ['tls-gw:9091']}]
+`,
+			wantStatus: "error",
+			want: []string{
+				"error secure: gateway requires basic auth",
+				"error token: gateway requires a bearer token",
+				"error tls: gateway requires client certificates",
+				`error tls: gateway requires TLS but the job scrapes with scheme "http"`,
+			},
+		},
+		{
+			name: "configured auth",
+			config: `
+scrape_configs:
+  - job_name: secure
+    honor_labels: true
+    basic_auth: {username: prom, password: secret}
+    static_configs: [{targets: ['secure-gw:9091']}]
+  - job_name: token
+    honor_labels: true
+    bearer_token: secret
+    static_configs: [{targets: ['token-gw:9091']}]
+  - job_name: tls
+    honor_labels: true
+    scheme: https
+    tls_config: {cert_file: client.crt, key_file: client.key}
+    static_configs: [{targets: ['tls-gw:9091']}]
+`,
+			wantStatus: "success",
+		},
+		{
+			name: "runtime service discovery",
+			config: `
+scrape_configs:
+  - job_name: pods
+    kubernetes_sd_configs: [{role: pod}]
+    static_configs: [{targets: ['localhost:9091']}]
+    honor_labels: true
+`,
+			wantStatus: "success",
+			want:       []string{"info pods: targets from kubernetes_sd_configs are only known at runtime"},
+		},
+		{
+			name: "file_sd is not read",
+			config: `
+scrape_configs:
+  - job_name: files
+    file_sd_configs: [{files: [targets.json]}]
+`,
+			wantStatus: "success",
+			want:       []string{"info files: targets from file_sd_configs are only known at runtime"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadPrometheusConfig([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := checkScrapeConfig(cfg, gateways, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := scrapeFindings(report)
+			if report.Status != tt.wantStatus || len(got) != len(tt.want) {
+				t.Fatalf("status %s with findings\n%s\nwant %s with %d findings", report.Status, strings.Join(got, "\n"), tt.wantStatus, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("finding %d is %q, want %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPrometheusConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "timeout longer than interval",
+			config:  "scrape_configs: [{job_name: a, scrape_interval: 10s, scrape_timeout: 1m}]",
+			wantErr: "scrape timeout greater than scrape interval",
+		},
+		{
+			name:    "unknown field",
+			config:  "scrape_configs: [{job_name: a, honour_labels: true}]",
+			wantErr: "field honour_labels not found",
+		},
+		{
+			name:    "invalid file_sd path",
+			config:  "scrape_configs: [{job_name: a, file_sd_configs: [{files: [targets.txt]}]}]",
+			wantErr: "not valid for file discovery",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadPrometheusConfig([]byte(tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckScrapeConfigFileSD(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("prometheus.yml", `
+scrape_configs:
+  - job_name: gateways
+    file_sd_configs: [{files: ['targets/*.json', 'targets/*.yml']}]
+`)
+	if err := os.Mkdir(filepath.Join(dir, "targets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write("targets/a.json", `[{"targets": ["localhost:9100"]}]`)
+	write("targets/b.yml", "- targets: ['localhost:9091']\n")
+
+	// Relative file_sd paths resolve against the config's directory.
+	cfg, err := config.LoadFile(filepath.Join(dir, "prometheus.yml"), false, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := checkScrapeConfig(cfg, []GatewayBackend{{Address: "localhost:9091"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := scrapeFindings(report)
+	want := []string{
+		"error gateways: honor_labels is not true",
+		"warning gateways: gateway shares the scrape job with localhost:9100",
+	}
+	if report.Status != "error" || len(got) != len(want) {
+		t.Fatalf("status %s with findings\n%s", report.Status, strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("finding %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	write("targets/c.json", "not json")
+	if _, err := checkScrapeConfig(cfg, nil, true); err == nil || !strings.Contains(err.Error(), "c.json") {
+		t.Errorf("invalid target file: got error %v", err)
+	}
+}
+
+// writeCertificate writes a self-signed certificate valid until notAfter and
+// its key as PEM files.
+func writeCertificate(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "prometheus"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckScrapeConfigCredentials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCertificate(t, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), time.Now().Add(24*time.Hour))
+	writeCertificate(t, filepath.Join(dir, "expired.crt"), filepath.Join(dir, "expired.key"), time.Now().Add(-24*time.Hour))
+	writeCertificate(t, filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"), time.Now().Add(24*time.Hour))
+	write("password", "secret\n")
+	write("empty", "\n")
+	write("not-a-ca.pem", "not a certificate")
+	gateways := []GatewayBackend{{Address: "gw:9091", Auth: "tls"}}
+
+	tests := []struct {
+		name string
+		job  string
+		want []string
+	}{
+		{
+			name: "valid credentials",
+			job:  "tls_config: {cert_file: client.crt, key_file: client.key, ca_file: client.crt}\nbasic_auth: {username: prom, password_file: password}",
+		},
+		{
+			name: "missing files",
+			job:  "tls_config: {cert_file: missing.crt, key_file: client.key, ca_file: missing-ca.pem}",
+			want: []string{"open DIR/missing-ca.pem: no such file", "open DIR/missing.crt: no such file"},
+		},
+		{
+			name: "key of another certificate",
+			job:  "tls_config: {cert_file: client.crt, key_file: other.key}",
+			want: []string{"tls_config certificate DIR/client.crt: tls: private key does not match public key"},
+		},
+		{
+			name: "expired certificate",
+			job:  "tls_config: {cert_file: expired.crt, key_file: expired.key}",
+			want: []string{"tls_config certificate DIR/expired.crt expired on"},
+		},
+		{
+			name: "CA without certificates",
+			job:  "tls_config: {cert_file: client.crt, key_file: client.key, ca_file: not-a-ca.pem}",
+			want: []string{"tls_config CA DIR/not-a-ca.pem contains no PEM certificates"},
+		},
+		{
+			name: "empty secrets",
+			job:  "tls_config: {cert_file: client.crt, key_file: client.key}\nauthorization: {credentials_file: empty}",
+			want: []string{"authorization credentials_file DIR/empty is empty"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := strings.ReplaceAll("\n"+tt.job, "\n", "\n    ")
+			write("prometheus.yml", `
+scrape_configs:
+  - job_name: gateway
+    honor_labels: true
+    scheme: https`+job+`
+    static_configs: [{targets: ['gw:9091']}]
+`)
+			cfg, err := config.LoadFile(filepath.Join(dir, "prometheus.yml"), false, promslog.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := checkScrapeConfig(cfg, gateways, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := scrapeFindings(report)
+			if len(got) != len(tt.want) {
+				t.Fatalf("findings\n%s\nwant %d", strings.Join(got, "\n"), len(tt.want))
+			}
+			for i, want := range tt.want {
+				want = "error gateway: " + strings.ReplaceAll(want, "DIR", dir)
+				if !strings.Contains(got[i], want) {
+					t.Errorf("finding %d is %q, want %q", i, got[i], want)
+				}
+			}
+
+			// A POSTed config never makes the server read its files.
+			if report, _ := checkScrapeConfig(cfg, gateways, false); report.Status != "success" {
+				t.Errorf("without reading files: %q", scrapeFindings(report))
+			}
+		})
+	}
+}
+
+func TestHandleScrapeCheck(t *testing.T) {
+	handler := handleScrapeCheck([]GatewayBackend{{Address: "localhost:9091"}})
+	tests := []struct {
+		method     string
+		body       string
+		wantCode   int
+		wantStatus string
+	}{
+		{method: http.MethodPost, body: "scrape_configs: [{job_name: gw, static_configs: [{targets: ['localhost:9091']}]}]", wantCode: http.StatusOK, wantStatus: "error"},
+		{method: http.MethodPut, body: "scrape_configs: []", wantCode: http.StatusOK, wantStatus: "success"},
+		{method: http.MethodPost, body: "scrape_configs: {", wantCode: http.StatusBadRequest, wantStatus: "error"},
+		{method: http.MethodGet, wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(tt.method, "/check/scrape-config", strings.NewReader(tt.body)))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %q: code %d, want %d", tt.method, tt.body, rec.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantStatus == "" {
+			continue
+		}
+		var report ScrapeCheckReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Status != tt.wantStatus {
+			t.Errorf("%s %q: status %s, want %s", tt.method, tt.body, report.Status, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// queryScrapeInterval is the interval Prometheus is assumed to scrape the
+// gateway at. Queries see a sample of every exposed series at each multiple
+// of it, and one at every push as if the gateway was scraped right then, so
+// just pushed values are visible immediately.
+const queryScrapeInterval = 15 * time.Second
+
+// Querier implements storage.Queryable, so the PromQL engine can query the
+// series history of the store.
+func (s *metricStore) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &storeQuerier{store: s, mint: mint, maxt: maxt}, nil
+}
+
+// storeQuerier synthesizes the samples scrapes of the gateway would have
+// collected between mint and maxt from the store's series history.
+type storeQuerier struct {
+	store      *metricStore
+	mint, maxt int64
+}
+
+// floatSample implements chunks.Sample for float samples.
+type floatSample struct {
+	t int64
+	f float64
+}
+
+func (s floatSample) T() int64                      { return s.t }
+func (s floatSample) F() float64                    { return s.f }
+func (s floatSample) H() *histogram.Histogram       { return nil }
+func (s floatSample) FH() *histogram.FloatHistogram { return nil }
+func (s floatSample) Type() chunkenc.ValueType      { return chunkenc.ValFloat }
+func (s floatSample) Copy() chunks.Sample           { return s }
+
+// samples returns the samples of the series between mint and maxt. A series
+// that stops being exposed gets a stale marker, as a scrape would record.
+func (h *seriesHistory) samples(mint, maxt int64) []chunks.Sample {
+	step := queryScrapeInterval.Milliseconds()
+	var out []chunks.Sample
+	add := func(t int64, v float64) {
+		if t >= mint && t <= maxt {
+			out = append(out, floatSample{t: t, f: v})
+		}
+	}
+	for i, seg := range h.segments {
+		from, end := seg.From.UnixMilli(), maxt
+		if !seg.To.IsZero() {
+			end = min(maxt, seg.To.UnixMilli()-1)
+		}
+		add(from, seg.Value)
+		first := max(from+1, mint)
+		for t := (first + step - 1) / step * step; t <= end; t += step {
+			add(t, seg.Value)
+		}
+		continued := i+1 < len(h.segments) && h.segments[i+1].From.Equal(seg.To)
+		if !seg.To.IsZero() && !continued {
+			add(seg.To.UnixMilli(), math.Float64frombits(value.StaleNaN))
+		}
+	}
+	return out
+}
+
+func (q *storeQuerier) Select(_ context.Context, _ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	mint, maxt := q.mint, q.maxt
+	if hints != nil {
+		mint, maxt = hints.Start, hints.End
+	}
+
+	q.store.mu.RLock()
+	defer q.store.mu.RUnlock()
+
+	var series []storage.Series
+	for _, h := range q.store.series {
+		if !matchesAll(h.labels, matchers) {
+			continue
+		}
+		if samples := h.samples(mint, maxt); len(samples) > 0 {
+			series = append(series, storage.NewListSeries(h.labels, samples))
+		}
+	}
+	// Series are always sorted, which the engine relies on for some
+	// selectors even when it does not ask for it.
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i].Labels(), series[j].Labels()) < 0 })
+	return &listSeriesSet{series: series, i: -1}
+}
+
+func (q *storeQuerier) LabelValues(_ context.Context, name string, _ *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	q.store.mu.RLock()
+	defer q.store.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var values []string
+	for _, h := range q.store.series {
+		if v := h.labels.Get(name); v != "" && !seen[v] && matchesAll(h.labels, matchers) {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values, nil, nil
+}
+
+func (q *storeQuerier) LabelNames(_ context.Context, _ *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	q.store.mu.RLock()
+	defer q.store.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var names []string
+	for _, h := range q.store.series {
+		if !matchesAll(h.labels, matchers) {
+			continue
+		}
+		h.labels.Range(func(l labels.Label) {
+			if !seen[l.Name] {
+				seen[l.Name] = true
+				names = append(names, l.Name)
+			}
+		})
+	}
+	sort.Strings(names)
+	return names, nil, nil
+}
+
+func (q *storeQuerier) Close() error { return nil }
+
+func matchesAll(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// listSeriesSet iterates over a slice of series.
+type listSeriesSet struct {
+	series []storage.Series
+	i      int
+}
+
+func (s *listSeriesSet) Next() bool                        { s.i++; return s.i < len(s.series) }
+func (s *listSeriesSet) At() storage.Series                { return s.series[s.i] }
+func (s *listSeriesSet) Err() error                        { return nil }
+func (s *listSeriesSet) Warnings() annotations.Annotations { return nil }
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/devYaoYH/prometheus_proxy_gateway/metrics-lint-server/lint"
+)
+
+// metricGroup holds the latest accepted push for one grouping key,
+// mirroring what the Pushgateway exposes for that group.
+type metricGroup struct {
+	Labels      model.LabelSet
+	Families    map[string]*dto.MetricFamily
+	LastPush    time.Time
+	LastFailure time.Time
+	// exposed lists the keys of the series each family of the group
+	// currently exposes.
+	exposed map[string][]string
+}
+
+// queryRetention is how long the values of replaced and deleted series stay
+// queryable, so queries can look back at recent pushes.
+const queryRetention = time.Hour
+
+// seriesHistory is what Prometheus scraping the gateway with honor_labels
+// sees of one series: the values it was exposed with, and since when.
+type seriesHistory struct {
+	labels   labels.Labels
+	segments []seriesSegment
+}
+
+// seriesSegment is a value exposed from From until To. To is zero while the
+// series is still exposed with the value.
+type seriesSegment struct {
+	Value    float64
+	From, To time.Time
+}
+
+// set exposes the series with value v from t on.
+func (h *seriesHistory) set(v float64, t time.Time) {
+	if n := len(h.segments); n > 0 {
+		last := &h.segments[n-1]
+		if last.To.IsZero() && math.Float64bits(last.Value) == math.Float64bits(v) {
+			return
+		}
+		if last.From.UnixMilli() == t.UnixMilli() {
+			// Replaced within the same millisecond, which no scrape could
+			// have seen.
+			last.Value, last.To = v, time.Time{}
+			return
+		}
+		h.end(t)
+	}
+	h.segments = append(h.segments, seriesSegment{Value: v, From: t})
+}
+
+// end stops exposing the series at t.
+func (h *seriesHistory) end(t time.Time) {
+	if n := len(h.segments); n > 0 && h.segments[n-1].To.IsZero() {
+		h.segments[n-1].To = t
+	}
+}
+
+// familyObservation records what has been seen of a metric family across
+// all accepted pushes, including pushes that were since replaced.
+type familyObservation struct {
+	Schema    MetricSchema
+	Examples  map[string][]string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Jobs maps the jobs emitting the family to when they last did.
+	Jobs map[string]time.Time
+}
+
+const (
+	// maxExampleValues caps the example values remembered per label.
+	maxExampleValues = 5
+	// maxExampleLabels caps the labels example values are remembered for.
+	maxExampleLabels = 20
+	// maxObservedJobs caps the jobs remembered per family. Jobs named per
+	// run would otherwise grow the list forever, so the least recently
+	// seen job is forgotten first.
+	maxObservedJobs = 20
+)
+
+// metricStore keeps the latest pushed state per grouping key in memory,
+// along with the recent history of every series for queries.
+type metricStore struct {
+	mu       sync.RWMutex
+	groups   map[string]*metricGroup
+	observed map[string]*familyObservation
+	series   map[string]*seriesHistory
+	pruned   time.Time
+}
+
+func newMetricStore() *metricStore {
+	return &metricStore{
+		groups:   make(map[string]*metricGroup),
+		observed: make(map[string]*familyObservation),
+		series:   make(map[string]*seriesHistory),
+	}
+}
+
+// group returns the group for the given grouping key, creating it if needed.
+// The caller must hold the write lock.
+func (s *metricStore) group(labels model.LabelSet) *metricGroup {
+	key := labels.String()
+	g, ok := s.groups[key]
+	if !ok {
+		g = &metricGroup{Labels: labels, Families: make(map[string]*dto.MetricFamily), exposed: make(map[string][]string)}
+		s.groups[key] = g
+	}
+	return g
+}
+
+// Replace drops all metrics of the group and stores the pushed families (PUT).
+func (s *metricStore) Replace(labels model.LabelSet, families []*dto.MetricFamily, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.group(labels)
+	samples := make(map[string][]*model.Sample, len(g.Families)+len(families))
+	for name := range g.Families {
+		samples[name] = nil
+	}
+	g.Families = make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		g.Families[mf.GetName()] = mf
+		samples[mf.GetName()] = familySamples(mf)
+	}
+	g.LastPush = t
+	s.expose(g, samples, t)
+	s.observe(labels, families, t)
+}
+
+// Merge replaces only the metrics with the same names as the pushed families (POST).
+func (s *metricStore) Merge(labels model.LabelSet, families []*dto.MetricFamily, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.group(labels)
+	samples := make(map[string][]*model.Sample, len(families))
+	for _, mf := range families {
+		g.Families[mf.GetName()] = mf
+		samples[mf.GetName()] = familySamples(mf)
+	}
+	g.LastPush = t
+	s.expose(g, samples, t)
+	s.observe(labels, families, t)
+}
+
+// expose records that the group exposes the given samples from t on, in
+// place of what it exposed for the same families before, and updates the
+// group's push_time_seconds and push_failure_time_seconds. The caller must
+// hold the write lock.
+func (s *metricStore) expose(g *metricGroup, families map[string][]*model.Sample, t time.Time) {
+	families["push_time_seconds"] = []*model.Sample{{Metric: model.Metric{}, Value: model.SampleValue(unixSeconds(g.LastPush))}}
+	families["push_failure_time_seconds"] = []*model.Sample{{Metric: model.Metric{}, Value: model.SampleValue(unixSeconds(g.LastFailure))}}
+	for name, samples := range families {
+		keys := make([]string, 0, len(samples))
+		current := make(map[string]bool, len(samples))
+		for _, smpl := range samples {
+			lset := seriesLabels(name, smpl.Metric, g.Labels)
+			key := lset.String()
+			h, ok := s.series[key]
+			if !ok {
+				h = &seriesHistory{labels: lset}
+				s.series[key] = h
+			}
+			h.set(float64(smpl.Value), t)
+			if !current[key] {
+				current[key] = true
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range g.exposed[name] {
+			if !current[key] {
+				s.series[key].end(t)
+			}
+		}
+		if len(keys) == 0 {
+			delete(g.exposed, name)
+		} else {
+			g.exposed[name] = keys
+		}
+	}
+	if t.Sub(s.pruned) > time.Minute {
+		s.prune(t)
+	}
+}
+
+// prune forgets values that stopped being exposed longer than
+// queryRetention ago. The caller must hold the write lock.
+func (s *metricStore) prune(t time.Time) {
+	cutoff := t.Add(-queryRetention)
+	for key, h := range s.series {
+		i := 0
+		for i < len(h.segments) && !h.segments[i].To.IsZero() && h.segments[i].To.Before(cutoff) {
+			i++
+		}
+		h.segments = h.segments[i:]
+		if len(h.segments) == 0 {
+			delete(s.series, key)
+		}
+	}
+	s.pruned = t
+}
+
+// familySamples flattens a family into samples the way the gateway exposes
+// it. Families were validated on push, so anything that cannot be flattened
+// is skipped.
+func familySamples(mf *dto.MetricFamily) []*model.Sample {
+	vec, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{}, mf)
+	if err != nil {
+		return nil
+	}
+	return vec
+}
+
+// seriesLabels returns the labels of a sample as Prometheus stores them
+// after scraping the gateway with honor_labels: grouping labels are attached
+// to every series and take precedence over the pushed labels.
+func seriesLabels(name string, m model.Metric, groupLabels model.LabelSet) labels.Labels {
+	b := labels.NewScratchBuilder(len(m) + len(groupLabels) + 1)
+	for ln, lv := range groupLabels {
+		b.Add(string(ln), string(lv))
+	}
+	for ln, lv := range m {
+		if _, ok := groupLabels[ln]; !ok {
+			b.Add(string(ln), string(lv))
+		}
+	}
+	if _, ok := m[model.MetricNameLabel]; !ok {
+		b.Add(model.MetricNameLabel, name)
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// observe updates the per-family observations. The caller must hold the
+// write lock.
+func (s *metricStore) observe(groupLabels model.LabelSet, families []*dto.MetricFamily, t time.Time) {
+	for _, mf := range families {
+		o, ok := s.observed[mf.GetName()]
+		if !ok {
+			o = &familyObservation{
+				FirstSeen: t,
+				Examples:  make(map[string][]string),
+				Jobs:      make(map[string]time.Time),
+			}
+			s.observed[mf.GetName()] = o
+		}
+
+		ms := metricSchemaFromFamily(mf)
+		_, added := diffStrings(o.Schema.Labels, ms.Labels)
+		ms.Labels = append(o.Schema.Labels, added...)
+		sort.Strings(ms.Labels)
+		o.Schema = ms
+		o.LastSeen = t
+		o.Jobs[string(groupLabels[model.JobLabel])] = t
+		if len(o.Jobs) > maxObservedJobs {
+			forgetOldestJob(o.Jobs)
+		}
+
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				examples, ok := o.Examples[lp.GetName()]
+				if !ok && len(o.Examples) >= maxExampleLabels {
+					continue
+				}
+				if len(examples) < maxExampleValues && !containsString(examples, lp.GetValue()) {
+					o.Examples[lp.GetName()] = append(examples, lp.GetValue())
+				}
+			}
+		}
+	}
+}
+
+// forgetOldestJob removes the least recently seen job.
+func forgetOldestJob(jobs map[string]time.Time) {
+	oldest := ""
+	for job, seen := range jobs {
+		if oldest == "" || seen.Before(jobs[oldest]) || seen.Equal(jobs[oldest]) && job < oldest {
+			oldest = job
+		}
+	}
+	delete(jobs, oldest)
+}
+
+// Observations returns a copy of the per-family observations.
+func (s *metricStore) Observations() map[string]familyObservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]familyObservation, len(s.observed))
+	for name, o := range s.observed {
+		cp := *o
+		cp.Examples = make(map[string][]string, len(o.Examples))
+		for l, v := range o.Examples {
+			cp.Examples[l] = append([]string(nil), v...)
+		}
+		cp.Jobs = make(map[string]time.Time, len(o.Jobs))
+		for j, seen := range o.Jobs {
+			cp.Jobs[j] = seen
+		}
+		out[name] = cp
+	}
+	return out
+}
+
+// GroupingLabelNames returns the label names used in grouping keys of all
+// stored groups, such as job and instance.
+func (s *metricStore) GroupingLabelNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var names []string
+	for _, g := range s.groups {
+		for ln := range g.Labels {
+			if !seen[string(ln)] {
+				seen[string(ln)] = true
+				names = append(names, string(ln))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordFailure marks a failed push for the group without touching its metrics.
+func (s *metricStore) RecordFailure(labels model.LabelSet, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.group(labels)
+	g.LastFailure = t
+	s.expose(g, map[string][]*model.Sample{}, t)
+}
+
+// Delete removes the group entirely (DELETE).
+func (s *metricStore) Delete(labels model.LabelSet, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.groups[labels.String()]
+	if !ok {
+		return
+	}
+	for _, keys := range g.exposed {
+		for _, key := range keys {
+			s.series[key].end(t)
+		}
+	}
+	delete(s.groups, labels.String())
+}
+
+// storeFromFiles builds a store from exposition files for offline commands,
+// pushing each file as its own job named after the file.
+func storeFromFiles(paths []string) (*metricStore, error) {
+	store := newMetricStore()
+	for _, path := range paths {
+		data, err := readInput(path)
+		if err != nil {
+			return nil, err
+		}
+		families, err := lint.DecodeFamilies(bytes.NewReader(append(data, '\n')), expfmt.NewFormat(expfmt.TypeTextPlain))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		job := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		store.Merge(model.LabelSet{model.JobLabel: model.LabelValue(job)}, families, time.Now())
+	}
+	return store, nil
+}
+
+// unixSeconds returns t as fractional Unix seconds, or 0 for the zero time.
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestObservationsAreBounded(t *testing.T) {
+	store := newMetricStore()
+	for i := 0; i < 3*maxObservedJobs; i++ {
+		job := model.LabelSet{model.JobLabel: model.LabelValue(fmt.Sprintf("run-%03d", i))}
+		var b strings.Builder
+		b.WriteString("# TYPE work_total counter\nwork_total{")
+		for l := 0; l < 2*maxExampleLabels; l++ {
+			fmt.Fprintf(&b, "l%02d=\"v%d\",", l, i)
+		}
+		b.WriteString("} 1\n")
+		store.Merge(job, parseFamilies(t, b.String()), t0.Add(time.Duration(i)*time.Second))
+	}
+
+	o := store.Observations()["work_total"]
+	if len(o.Jobs) != maxObservedJobs {
+		t.Errorf("%d jobs remembered, want %d", len(o.Jobs), maxObservedJobs)
+	}
+	last := fmt.Sprintf("run-%03d", 3*maxObservedJobs-1)
+	if _, ok := o.Jobs[last]; !ok {
+		t.Errorf("most recent job %s was forgotten", last)
+	}
+	if _, ok := o.Jobs["run-000"]; ok {
+		t.Error("oldest job run-000 is still remembered")
+	}
+	if len(o.Examples) != maxExampleLabels {
+		t.Errorf("examples for %d labels, want %d", len(o.Examples), maxExampleLabels)
+	}
+	for l, values := range o.Examples {
+		if len(values) != maxExampleValues {
+			t.Errorf("label %s has %d examples, want %d", l, len(values), maxExampleValues)
+		}
+	}
+	if len(o.Schema.Labels) != 2*maxExampleLabels {
+		t.Errorf("%d label names, want all %d", len(o.Schema.Labels), 2*maxExampleLabels)
+	}
+}